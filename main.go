@@ -1,22 +1,63 @@
 package main
 
 import (
-	flags "github.com/jessevdk/go-flags"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+
+	"github.com/heap/terraform-ebs-attachmentizer/pkg/attachmentizer"
+	flags "github.com/jessevdk/go-flags"
 )
 
 type Options struct {
-	Region          string         `short:"r" long:"region" description:"AWS region" required:"true"`
-	InstancePattern string         `short:"p" long:"pattern" description:"EC2 instance name pattern" required:"true"`
-	StatePath       flags.Filename `short:"s" long:"statepath" description:"Current .tfstate location" required:"true"`
-	StateOutPath    flags.Filename `short:"o" long:"stateoutpath" default:"/tmp/out.tfstate" description:"State file out path"`
-	ConfigOutPath   flags.Filename `short:"c" long:"configoutpath" default:"/tmp/config.tf" description:"Config out path"`
+	Region           string         `short:"r" long:"region" description:"AWS region (not needed with --revert or --ec2-inventory)"`
+	InstancePatterns []string       `short:"p" long:"pattern" description:"Only convert instances whose Name tag matches this pattern; may be repeated"`
+	Tags             []string       `short:"t" long:"tag" value-name:"KEY=VALUE" description:"Only convert instances with this tag; may be repeated"`
+	EC2Concurrency   int            `long:"ec2-concurrency" default:"4" description:"Most EC2 queries to run at once"`
+	StatePath        flags.Filename `short:"s" long:"statepath" description:"Current .tfstate location (with apply, defaults to the plan's)"`
+	Backend          string         `long:"backend" value-name:"TYPE" choice:"consul" choice:"etcd" choice:"http" choice:"s3" description:"Read the state from this remote backend, and push the new state back to it, instead of --statepath"`
+	BackendConfig    []string       `long:"backend-config" value-name:"KEY=VALUE" description:"A setting of the --backend, as in its backend block; may be repeated. With apply, adds to the plan's, which has no credentials"`
+	StateOutPath     flags.Filename `short:"o" long:"stateoutpath" default:"/tmp/out.tfstate" description:"State file out path"`
+	ConfigOutPath    flags.Filename `short:"c" long:"configoutpath" default:"/tmp/config.tf" description:"Config out path"`
+	EC2Inventory     flags.Filename `long:"ec2-inventory" description:"Read instances from saved 'aws ec2 describe-instances' output instead of querying EC2"`
+	EC2Volumes       flags.Filename `long:"ec2-volumes" description:"Saved 'aws ec2 describe-volumes' output to go with --ec2-inventory"`
+	Revert           bool           `long:"revert" description:"Fold aws_ebs_volume and aws_volume_attachment resources back into ebs_block_device blocks"`
+	DryRun           bool           `short:"n" long:"dry-run" description:"Print the changes to the state instead of writing anything"`
+	PlanFormat       string         `long:"plan-format" default:"text" choice:"text" choice:"json" description:"Format of the --dry-run output"`
+	HCL2             bool           `long:"hcl2" description:"Write config for Terraform 0.12 and later, using for_each where the state allows"`
+	ConfigDir        flags.Filename `long:"config-dir" description:"Rewrite the config in this directory (and its local modules) in place"`
+	ImportScript     flags.Filename `long:"import-script" description:"Write a script of terraform import commands (and a manifest of them) here instead of writing a new state; implies --hcl2, and needs a version 4 state and --aws-provider 3.x or later"`
+	NameTemplate     string         `long:"name-template" description:"Go template for the names of the new resources; see the README for the fields" default:"{{.Instance}}-{{.Device}}"`
+	SkipInvalid      bool           `long:"skip-invalid" description:"Convert the instances without problems, and list the ones skipped, rather than converting none"`
+	ImportBlocks     bool           `long:"import-blocks" description:"Write config with import blocks for Terraform 1.5 and later instead of writing a new state; implies --hcl2, and needs a version 4 state and --aws-provider 3.x or later"`
+	AWSProvider      string         `long:"aws-provider" value-name:"VERSION" default:"0.9" choice:"0.9" choice:"3.x" choice:"5.x" description:"Version of the AWS provider to write the new resources for, which decides the attributes they get"`
+}
+
+// `plan`: do everything but write, and save what would be written to apply
+// later.
+type PlanCommand struct {
+	Out flags.Filename `long:"out" required:"true" description:"Where to write the plan"`
+}
+
+// `apply`: write what a saved plan says, without AWS.
+type ApplyCommand struct {
+	Args struct {
+		Plan flags.Filename `positional-arg-name:"PLAN" required:"true"`
+	} `positional-args:"yes"`
 }
 
 func main() {
 	opts := new(Options)
+	planCmd := new(PlanCommand)
+	applyCmd := new(ApplyCommand)
 	parser := flags.NewParser(opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("plan", "Write a plan to apply later",
+		"Look the instances up and work out the conversion, and write it to a plan file for apply, without writing anything else.", planCmd)
+	parser.AddCommand("apply", "Apply a plan",
+		"Write out what a plan file says, without AWS, as long as the state hasn't changed since the plan was made.", applyCmd)
 
 	if _, err := parser.Parse(); err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
@@ -26,10 +67,233 @@ func main() {
 		}
 	}
 
-	instDevMap, err := GetEC2AWSState(opts.InstancePattern, opts.Region)
+	if parser.Active != nil && parser.Active.Name == "apply" {
+		applyPlanFile(string(applyCmd.Args.Plan), opts)
+		return
+	}
+	if opts.StatePath == "" && opts.Backend == "" {
+		log.Fatal("--statepath or --backend is required")
+	}
+
+	if opts.ConfigDir != "" && (opts.HCL2 || opts.ImportScript != "" || opts.ImportBlocks) {
+		log.Fatal("--config-dir can only rewrite Terraform 0.9 config, so it can't be used with --hcl2, --import-script or --import-blocks")
+	}
+
+	converter, err := attachmentizer.NewConverter(converterOptions(opts))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	plan, err := converter.Plan()
+	if errs, ok := err.(attachmentizer.ValidationErrors); ok {
+		log.Fatalf("%v\nFix them, or pass --skip-invalid to convert the other instances", errs)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	printWarnings(plan.Warnings)
+	if len(plan.Unchanged) != 0 {
+		printUnchanged(plan.Unchanged)
+	}
+	printAliased(plan.Devices)
+	if len(plan.Skipped) != 0 {
+		printSkipped(plan.Skipped)
+	}
+
+	if parser.Active != nil && parser.Active.Name == "plan" {
+		if err := converter.PlanFile(plan).Write(string(planCmd.Out)); err != nil {
+			log.Fatal(err)
+		}
+		printPlan(plan.State, opts.PlanFormat)
+		fmt.Printf("\nWrote plan to %v\n", planCmd.Out)
+		return
+	}
+	if opts.DryRun {
+		printPlan(plan.State, opts.PlanFormat)
+		return
+	}
+
+	result, err := converter.Apply(plan)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printWarnings(result.Warnings)
+	printResult(result, opts.Revert)
+}
+
+// Apply a saved plan, to the state given by `--statepath` or `--backend` if
+// either is given rather than the one the plan was made from. The plan's
+// backend settings are added to with `--backend-config`.
+func applyPlanFile(path string, opts *Options) {
+	planFile, err := attachmentizer.ReadPlanFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case opts.StatePath != "":
+		planFile.State.Path, planFile.State.Backend = string(opts.StatePath), nil
+	case opts.Backend != "":
+		planFile.State.Path, planFile.State.Backend = "", backendConfig(opts)
+	case planFile.State.Backend != nil:
+		config, err := attachmentizer.ParseBackendConfig(opts.BackendConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if planFile.State.Backend.Config == nil {
+			planFile.State.Backend.Config = config
+		}
+		for k, v := range config {
+			planFile.State.Backend.Config[k] = v
+		}
+	}
+
+	result, err := planFile.Apply()
+	if err != nil {
+		log.Fatal(err)
+	}
+	printWarnings(result.Warnings)
+	printResult(result, planFile.Options.Revert)
+}
+
+// The `--backend` and its settings, or nil without one.
+func backendConfig(opts *Options) *attachmentizer.BackendConfig {
+	if opts.Backend == "" {
+		if len(opts.BackendConfig) != 0 {
+			log.Fatal("--backend-config needs a --backend")
+		}
+		return nil
+	}
+	config, err := attachmentizer.ParseBackendConfig(opts.BackendConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &attachmentizer.BackendConfig{Type: opts.Backend, Config: config}
+}
+
+// Turn the flags into options for the converter, connecting to EC2 (or
+// loading the inventory) if the instances need looking up.
+func converterOptions(opts *Options) attachmentizer.Options {
+	convOpts := attachmentizer.Options{
+		StatePath:        string(opts.StatePath),
+		Backend:          backendConfig(opts),
+		NamePatterns:     opts.InstancePatterns,
+		Revert:           opts.Revert,
+		HCL2:             opts.HCL2,
+		NameTemplate:     opts.NameTemplate,
+		SkipInvalid:      opts.SkipInvalid,
+		StateOutPath:     string(opts.StateOutPath),
+		ConfigOutPath:    string(opts.ConfigOutPath),
+		ConfigDir:        string(opts.ConfigDir),
+		ImportScriptPath: string(opts.ImportScript),
+		AWSProvider:      opts.AWSProvider,
+	}
+	switch {
+	case opts.ImportBlocks:
+		convOpts.Output = attachmentizer.OutputImportBlocks
+	case opts.ImportScript != "":
+		convOpts.Output = attachmentizer.OutputImportScript
+	}
+	if opts.Revert {
+		return convOpts
+	}
+
+	var err error
+	convOpts.Tags, err = attachmentizer.ParseTagFilters(opts.Tags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.EC2Inventory != "" {
+		convOpts.EC2, err = attachmentizer.LoadEC2Inventory(string(opts.EC2Inventory), string(opts.EC2Volumes))
+	} else {
+		if opts.Region == "" {
+			log.Fatal("--region is required without --ec2-inventory")
+		}
+		convOpts.EC2, err = attachmentizer.NewEC2(opts.Region, opts.EC2Concurrency)
+	}
 	if err != nil {
 		log.Fatalf("ec2 failed: %v", err)
 	}
+	return convOpts
+}
+
+func printWarnings(warnings []string) {
+	for _, warning := range warnings {
+		log.Print(warning)
+	}
+}
+
+func printUnchanged(devs []attachmentizer.BlockDevice) {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Left %d devices alone, which are converted already:", len(devs)))
+	for _, dev := range devs {
+		buf.WriteString(fmt.Sprintf("\n  %v %v (%v)", dev.InstanceAddress(), dev.DeviceName(), dev.VolumeID()))
+	}
+	log.Print(buf.String())
+}
+
+// Print the devices whose name in the state differs from the one in EC2,
+// and the rules by which they were matched.
+func printAliased(devs []attachmentizer.BlockDevice) {
+	var buf bytes.Buffer
+	count := 0
+	for _, dev := range devs {
+		if dev.AliasRule() != "" {
+			buf.WriteString(fmt.Sprintf("\n  %v %v is %v in EC2 (%v)", dev.InstanceAddress(), dev.StateDeviceName(), dev.DeviceName(), dev.AliasRule()))
+			count++
+		}
+	}
+	if count != 0 {
+		log.Printf("Matched %d devices to EC2's by another name:%v", count, buf.String())
+	}
+}
+
+func printSkipped(skipped attachmentizer.ValidationErrors) {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Skipped %d instances:", len(skipped.Instances())))
+	for _, err := range skipped {
+		buf.WriteString("\n  " + err.Error())
+	}
+	log.Print(buf.String())
+}
+
+// Print the changes to the state, as text or JSON.
+func printPlan(plan *attachmentizer.StatePlan, format string) {
+	if format == "json" {
+		out, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Print(plan.String())
+}
 
-	ConvertTFState(string(opts.StatePath), string(opts.StateOutPath), string(opts.ConfigOutPath), instDevMap)
+func printResult(result *attachmentizer.Result, revert bool) {
+	if result.StatePath != "" {
+		if !revert {
+			fmt.Print("========Successfully generated new state========\n")
+		}
+		fmt.Printf("Wrote new state file to %v", result.StatePath)
+	}
+	if result.Backend != "" {
+		if !revert {
+			fmt.Print("========Successfully generated new state========\n")
+		}
+		fmt.Printf("Pushed new state to the %v backend", result.Backend)
+	}
+	if result.BackupPath != "" {
+		fmt.Printf("\nBacked the old state up to %v", result.BackupPath)
+	}
+	if result.ScriptPath != "" {
+		fmt.Printf("\nWrote import script to %v", result.ScriptPath)
+		fmt.Printf("\nWrote import manifest to %v", result.ManifestPath)
+	}
+	for _, path := range result.RewrittenPaths {
+		fmt.Printf("\nRewrote %v", path)
+	}
+	if result.ConfigPath != "" {
+		fmt.Printf("\nWrote configuration suggestion to %v", result.ConfigPath)
+	}
+	fmt.Println()
 }
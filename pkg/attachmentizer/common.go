@@ -0,0 +1,411 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	tfhash "github.com/hashicorp/terraform/helper/hashcode"
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// Add the `/dev/` prefix if a device name doesn't have it. Names that are
+// different but refer to the same device are handled by `deviceAliasRule`.
+func normalizeDeviceName(dev string) string {
+	if strings.HasPrefix(dev, "/dev/") {
+		return dev
+	} else {
+		return fmt.Sprintf("/dev/%v", dev)
+	}
+}
+
+// A wrapper around a device name that allows getting it with and without the
+// `/dev/` prefix.
+type DeviceName struct {
+	longName string
+}
+
+func NewDeviceName(dev string) DeviceName {
+	return DeviceName{normalizeDeviceName(dev)}
+}
+
+// Without `/dev/`.
+func (dn DeviceName) ShortName() string {
+	return strings.TrimPrefix(dn.longName, "/dev/")
+}
+
+// With `/dev/`.
+func (dn DeviceName) LongName() string {
+	return dn.longName
+}
+
+func (dn DeviceName) String() string {
+	return dn.longName
+}
+
+// Xen-style names like `sdf`, `xvdf` and `sda1`: the prefix, the drive's
+// letters, and the partition if any.
+var xenDeviceNameRegexp = regexp.MustCompile(`^(sd|xvd)([a-z]+)(\d*)$`)
+
+// The names NVMe devices get on Nitro instances, like `nvme1n1` or
+// `nvme0n1p1`.
+var nvmeDeviceNameRegexp = regexp.MustCompile(`^nvme\d+n\d+(p\d+)?$`)
+
+// Whether it's the name of an NVMe device, which says nothing about which
+// `sdX` or `xvdX` name it was attached as.
+func (dn DeviceName) IsNVMe() bool {
+	return nvmeDeviceNameRegexp.MatchString(dn.ShortName())
+}
+
+// The rules by which differently named devices can be the same one.
+const (
+	// `sdf` is `xvdf` to the Xen driver, and EC2 reports either.
+	aliasSdXvd = "sd/xvd"
+	// `sda1` is the first partition of `sda`, and root devices are attached
+	// by either.
+	aliasPartition = "partition"
+	// The names don't say, e.g. because one is an NVMe name, but the volume
+	// attached is the one the state has.
+	aliasVolumeID = "volume ID"
+)
+
+// Get the rules by which two device names can be the same device, e.g.
+// "sd/xvd" for `/dev/sdf` and `/dev/xvdf`, or "sd/xvd and partition" for
+// `/dev/sda1` and `/dev/xvda`. Returns false if they can't, and "" if they're
+// the same name.
+func deviceAliasRule(a DeviceName, b DeviceName) (string, bool) {
+	if a.ShortName() == b.ShortName() {
+		return "", true
+	}
+	ma := xenDeviceNameRegexp.FindStringSubmatch(a.ShortName())
+	mb := xenDeviceNameRegexp.FindStringSubmatch(b.ShortName())
+	if ma == nil || mb == nil || ma[2] != mb[2] {
+		return "", false
+	}
+
+	var rules []string
+	if ma[1] != mb[1] {
+		rules = append(rules, aliasSdXvd)
+	}
+	if ma[3] != mb[3] {
+		if ma[3] != "" && mb[3] != "" {
+			// Different partitions of the same drive.
+			return "", false
+		}
+		rules = append(rules, aliasPartition)
+	}
+	return strings.Join(rules, " and "), true
+}
+
+type Instance struct {
+	ID           string
+	BlockDevices map[DeviceName]BlockDevice
+	Tags         map[string]string
+}
+
+// This struct includes all attributes present in the tfstate representation of
+// a block device (in tf_attrs.go), as well as the ec2 instance attributes necessary
+// to generate the relevant ebs attachment resource.
+type BlockDevice struct {
+	volumeID            string
+	size                int
+	volumeType          string
+	deleteOnTermination string
+	deviceName          DeviceName
+	encrypted           string
+	iops                int
+	snapshotId          string
+	kmsKeyID            string
+	tags                map[string]string
+	// Only carried by the profiles whose `aws_ebs_volume` has them.
+	throughput         int
+	multiAttachEnabled string
+	outpostArn         string
+
+	// Relevant instance information
+	instanceID       string
+	availabilityZone string
+	// The instance's `availability_zone` in the state, which the config
+	// refers to for the volume's if they're the same.
+	instanceAvailabilityZone string
+	instanceResName          *TerraformName
+	// The path of the module the instance lives in, e.g. `["root", "web"]`.
+	modulePath []string
+
+	// The name of the new resources from the name template, if there is one.
+	resourceName string
+	// The device of an instance with a `count` has resources of its own,
+	// named with the index, rather than sharing the count with the devices of
+	// the other instances. See `splitCountGroups`.
+	ungrouped bool
+	// The name of the `ebs_block_device` in the state, if it's different from
+	// the name EC2 has, which `deviceName` is then, and the rule by which
+	// they were matched.
+	stateDeviceName DeviceName
+	aliasRule       string
+	// The version of the provider to write the new resources for. Nil for
+	// the default.
+	provider *providerProfile
+}
+
+// Make a block device as attached to an instance in EC2, for implementations
+// of `EC2Interface`. The rest of its attributes come from its volume.
+func NewBlockDevice(instanceID string, availabilityZone string, deviceName string, volumeID string, deleteOnTermination bool) BlockDevice {
+	return BlockDevice{
+		volumeID:            volumeID,
+		deviceName:          NewDeviceName(deviceName),
+		deleteOnTermination: strconv.FormatBool(deleteOnTermination),
+		instanceID:          instanceID,
+		availabilityZone:    availabilityZone,
+	}
+}
+
+func (dev *BlockDevice) profile() *providerProfile {
+	if dev.provider == nil {
+		return providerProfiles[DefaultAWSProvider]
+	}
+	return dev.provider
+}
+
+func (dev *BlockDevice) DeviceName() DeviceName {
+	return dev.deviceName
+}
+
+// The name of the device in the state's `ebs_block_device`, which is the name
+// EC2 has unless they were matched by `AliasRule`.
+func (dev *BlockDevice) StateDeviceName() DeviceName {
+	if dev.aliasRule != "" {
+		return dev.stateDeviceName
+	}
+	return dev.deviceName
+}
+
+// The rule by which the device in the state was matched to the one in EC2,
+// e.g. "sd/xvd", or "" if they have the same name.
+func (dev *BlockDevice) AliasRule() string {
+	return dev.aliasRule
+}
+
+func (dev *BlockDevice) VolumeID() string {
+	return dev.volumeID
+}
+
+func (dev *BlockDevice) InstanceID() string {
+	return dev.instanceID
+}
+
+// The address of the instance in the state, e.g.
+// `module.web.aws_instance.web[0]`. Empty for devices straight from EC2.
+func (dev *BlockDevice) InstanceAddress() string {
+	if dev.instanceResName == nil {
+		return ""
+	}
+	return moduleAddressPrefix(dev.modulePath) + dev.instanceResName.Address()
+}
+
+func (dev *BlockDevice) Size() int {
+	return dev.size
+}
+
+func (dev *BlockDevice) VolumeType() string {
+	return dev.volumeType
+}
+
+func (dev *BlockDevice) NameWithoutCount() string {
+	name := dev.resourceName
+	if name == "" {
+		name = fmt.Sprintf("%s-%s", dev.instanceResName.name, dev.deviceName.ShortName())
+	}
+	if dev.ungrouped {
+		return fmt.Sprintf("%s-%d", name, dev.instanceResName.index)
+	}
+	return name
+}
+
+// The `count` index of the device's new resources, or -1 if they have none.
+func (dev *BlockDevice) countIndex() int {
+	if dev.ungrouped {
+		return -1
+	}
+	return dev.instanceResName.index
+}
+
+func (dev *BlockDevice) UniqueName() string {
+	indexPart := ""
+	if dev.countIndex() != -1 {
+		indexPart = fmt.Sprintf(".%v", dev.countIndex())
+	}
+
+	return fmt.Sprintf("%s%s", dev.NameWithoutCount(), indexPart)
+}
+
+// The name of the resources for a device when they use `for_each`. Without a
+// name template, the devices of an instance without `count` or `for_each`
+// share a resource keyed by device, and each device of the other instances has
+// a resource keyed by instance. With one, each device has the resource it's
+// named, keyed the same way.
+func (dev *BlockDevice) ForEachName() string {
+	if dev.resourceName == "" && dev.instanceResName.index == -1 && dev.instanceResName.key == "" {
+		return dev.instanceResName.name
+	}
+	return dev.NameWithoutCount()
+}
+
+// The key of a device in its `for_each` resources. See `ForEachName`.
+func (dev *BlockDevice) ForEachKey() string {
+	switch {
+	case dev.instanceResName.key != "":
+		return dev.instanceResName.key
+	case dev.instanceResName.index != -1:
+		return strconv.Itoa(dev.instanceResName.index)
+	default:
+		return dev.deviceName.ShortName()
+	}
+}
+
+func (dev *BlockDevice) VolumeName() string {
+	resourceName := dev.UniqueName()
+	return fmt.Sprintf("aws_ebs_volume.%s", resourceName)
+}
+
+func (dev *BlockDevice) VolumeAttachmentName() string {
+	resourceName := dev.UniqueName()
+	return fmt.Sprintf("aws_volume_attachment.%s", resourceName)
+}
+
+// Get the ID Terraform synthesises for a volume attachment.
+//
+// From
+//    https://github.com/hashicorp/terraform/blob/ef94acbf1f753dd1d03d3249cd58f4876cd19682/builtin/providers/aws/resource_aws_volume_attachment.go#L244-L251
+// with hat-tip to:
+//  - https://github.com/hashicorp/terraform/issues/8458#issuecomment-258831650
+//  - https://github.com/foxsy/tfvolattid
+func (dev *BlockDevice) volumeAttachmentID() string {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%s-", dev.deviceName.LongName()))
+	buf.WriteString(fmt.Sprintf("%s-", dev.instanceID))
+	buf.WriteString(fmt.Sprintf("%s-", dev.volumeID))
+
+	return fmt.Sprintf("vai-%d", tfhash.String(buf.String()))
+}
+
+// Get the ID `terraform import` takes for a volume attachment, which is
+// `DEVICE_NAME:VOLUME_ID:INSTANCE_ID` rather than the ID in the state.
+func (dev *BlockDevice) volumeAttachmentImportID() string {
+	return fmt.Sprintf("%s:%s:%s", dev.deviceName.LongName(), dev.volumeID, dev.instanceID)
+}
+
+// Get the address of one of the new resources for a device, e.g.
+// `module.web.aws_ebs_volume.web-xvdb[0]`, matching the address in the state.
+func (dev *BlockDevice) resourceAddress(resourceType string, opts configOptions) string {
+	name := &TerraformName{resourceType, dev.NameWithoutCount(), dev.countIndex(), dev.instanceResName.key}
+	if opts.forEach {
+		name = &TerraformName{resourceType, dev.ForEachName(), -1, dev.ForEachKey()}
+	}
+
+	return moduleAddressPrefix(dev.modulePath) + name.Address()
+}
+
+// Get the prefix of the addresses of resources in a module, e.g. `module.web.`
+// for `["root", "web"]`.
+func moduleAddressPrefix(modulePath []string) string {
+	var buf bytes.Buffer
+	for _, module := range modulePath[1:] {
+		buf.WriteString(fmt.Sprintf("module.%s.", module))
+	}
+	return buf.String()
+}
+
+// Make a map of relevant volume attributes from an `ebs_block_device` block.
+// used in `dev.makeVolumeRes` and `dev.makeVolumeConfig`
+func (dev *BlockDevice) makeVolumeAttrs() map[string]string {
+	var attrs = make(map[string]string)
+
+	attrs["size"] = strconv.Itoa(dev.size)
+	attrs["type"] = dev.volumeType
+	attrs["id"] = dev.volumeID
+	attrs["encrypted"] = dev.encrypted
+	attrs["availability_zone"] = dev.availabilityZone
+	attrs["snapshot_id"] = dev.snapshotId
+	if dev.iops != 0 {
+		attrs["iops"] = strconv.Itoa(dev.iops)
+	}
+	if dev.kmsKeyID != "" {
+		attrs["kms_key_id"] = dev.kmsKeyID
+	}
+	if len(dev.tags) > 0 {
+		attrs["tags.%"] = strconv.Itoa(len(dev.tags))
+		for k, v := range dev.tags {
+			attrs[fmt.Sprintf("tags.%s", k)] = v
+		}
+	}
+
+	// Newer versions of the provider have more attributes.
+	p := dev.profile()
+	if dev.throughput != 0 {
+		attrs["throughput"] = strconv.Itoa(dev.throughput)
+	}
+	if p.volumeHas("multi_attach_enabled") {
+		attrs["multi_attach_enabled"] = dev.multiAttachEnabled
+		if dev.multiAttachEnabled == "" {
+			attrs["multi_attach_enabled"] = "false"
+		}
+	}
+	if p.volumeHas("outpost_arn") {
+		attrs["outpost_arn"] = dev.outpostArn
+	}
+	// Without default tags, which aren't known here, they're the same.
+	if p.volumeHas("tags_all") {
+		attrs["tags_all.%"] = strconv.Itoa(len(dev.tags))
+		for k, v := range dev.tags {
+			attrs[fmt.Sprintf("tags_all.%s", k)] = v
+		}
+	}
+
+	return attrs
+}
+
+// Make a Terraform `aws_ebs_volume` resource from the attributes from an
+// `ebs_block_device` block.
+func (dev *BlockDevice) makeVolumeRes() *tf.ResourceState {
+	attrs := dev.makeVolumeAttrs()
+
+	newRes := &tf.ResourceState{
+		Type: "aws_ebs_volume",
+		Primary: &tf.InstanceState{
+			ID:         dev.volumeID,
+			Attributes: attrs,
+		},
+	}
+	return newRes
+}
+
+// Make a map of relevant attachment attributes from an `ebs_block_device` block.
+// used in `dev.makeAttachmentRes` and `dev.makeAttachmentConfig`
+func (dev *BlockDevice) makeAttachmentAttrs() map[string]string {
+	attrs := make(map[string]string)
+
+	attrs["device_name"] = dev.deviceName.LongName()
+	attrs["instance_id"] = dev.instanceID
+	attrs["volume_id"] = dev.volumeID
+	attrs["id"] = dev.volumeAttachmentID()
+
+	return attrs
+}
+
+// Make a Terraform `aws_volume_attachment` resource from the attributes from an
+// `ebs_block_device` block, which incldues the relevant instance information.
+func (dev *BlockDevice) makeAttachmentRes() *tf.ResourceState {
+	attrs := dev.makeAttachmentAttrs()
+
+	newRes := &tf.ResourceState{
+		Type: "aws_volume_attachment",
+		Primary: &tf.InstanceState{
+			ID:         dev.volumeAttachmentID(),
+			Attributes: attrs,
+		},
+	}
+	return newRes
+}
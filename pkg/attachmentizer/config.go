@@ -0,0 +1,1057 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/printer"
+	"github.com/hashicorp/hcl/hcl/token"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// How the new resources are named, and their config written.
+type configOptions struct {
+	// The template for the names of the new resources, if not the default.
+	nameTemplate *template.Template
+	// Convert the instances without problems, rather than none of them.
+	skipInvalid bool
+	// Write Terraform 0.12+ syntax, with native references.
+	hcl2 bool
+	// Group devices with `for_each` rather than `count`. Only used with `hcl2`,
+	// and only for state formats that can hold the keys.
+	forEach bool
+	// Add Terraform 1.5+ `import` blocks for the new resources. Only used with
+	// `hcl2`.
+	importBlocks bool
+	// The version of the provider to write the resources for. Nil for the
+	// default.
+	provider *providerProfile
+	// Where warnings about the conversion go. Nil to drop them.
+	warnings *warnings
+}
+
+func (opts configOptions) profile() *providerProfile {
+	if opts.provider == nil {
+		return providerProfiles[DefaultAWSProvider]
+	}
+	return opts.provider
+}
+
+// Builds HCL syntax trees for the printer. The printer lays out (and aligns)
+// items by their positions, so this numbers lines as it goes, the way the
+// parser would for `terraform fmt`ed source.
+type configBuilder struct {
+	line int
+	opts configOptions
+}
+
+func (b *configBuilder) nextLine() token.Pos {
+	b.line++
+	return token.Pos{Line: b.line, Column: 1}
+}
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// Make an object key, quoting it unless it's a valid identifier.
+func configKey(key string, pos token.Pos) *ast.ObjectKey {
+	if identifierRegexp.MatchString(key) {
+		return &ast.ObjectKey{Token: token.Token{Type: token.IDENT, Pos: pos, Text: key}}
+	}
+	return &ast.ObjectKey{Token: token.Token{Type: token.STRING, Pos: pos, Text: strconv.Quote(key)}}
+}
+
+// An HCL2 expression, written as is.
+type configExpr string
+
+// Get the expression of a string that's all one interpolation, e.g.
+// `var.num_web` for `"${var.num_web}"`.
+func nativeExpression(value string) (configExpr, bool) {
+	if strings.HasPrefix(value, "${") && strings.HasSuffix(value, "}") && strings.Count(value, "${") == 1 {
+		return configExpr(value[2 : len(value)-1]), true
+	}
+	return "", false
+}
+
+// Make a literal of the HCL type matching the Go type of the value.
+func configLiteral(value interface{}, pos token.Pos) *ast.LiteralType {
+	var tok token.Token
+	switch value := value.(type) {
+	case bool:
+		tok = token.Token{Type: token.BOOL, Text: strconv.FormatBool(value)}
+	case int:
+		tok = token.Token{Type: token.NUMBER, Text: strconv.Itoa(value)}
+	case configExpr:
+		tok = token.Token{Type: token.IDENT, Text: string(value)}
+	default:
+		tok = token.Token{Type: token.STRING, Text: strconv.Quote(fmt.Sprint(value))}
+	}
+	tok.Pos = pos
+	return &ast.LiteralType{Token: tok}
+}
+
+// Make an attribute, like `size = 100`. With HCL2, interpolations are written
+// as native expressions.
+func (b *configBuilder) attribute(key string, value interface{}) *ast.ObjectItem {
+	if s, ok := value.(string); ok && b.opts.hcl2 {
+		if expr, ok := nativeExpression(s); ok {
+			value = expr
+		}
+	}
+
+	pos := b.nextLine()
+	return &ast.ObjectItem{
+		Keys:   []*ast.ObjectKey{configKey(key, pos)},
+		Assign: pos,
+		Val:    configLiteral(value, pos),
+	}
+}
+
+// Make an object with the keys, and the body built by the callback, so that
+// its lines are numbered between the braces.
+func (b *configBuilder) object(keys []*ast.ObjectKey, assign bool, body func() []*ast.ObjectItem) *ast.ObjectItem {
+	pos := b.nextLine()
+	for _, key := range keys {
+		key.Token.Pos = pos
+	}
+	item := &ast.ObjectItem{Keys: keys}
+	if assign {
+		item.Assign = pos
+	}
+
+	items := body()
+	item.Val = &ast.ObjectType{
+		Lbrace: pos,
+		List:   &ast.ObjectList{Items: items},
+		Rbrace: b.nextLine(),
+	}
+	return item
+}
+
+// Make a block, like `resource "type" "name" { ... }`. The first key is always
+// written bare, and the rest quoted.
+func (b *configBuilder) block(keys []string, body func() []*ast.ObjectItem) *ast.ObjectItem {
+	objectKeys := []*ast.ObjectKey{{Token: token.Token{Type: token.IDENT, Text: keys[0]}}}
+	for _, key := range keys[1:] {
+		objectKeys = append(objectKeys, &ast.ObjectKey{Token: token.Token{Type: token.STRING, Text: strconv.Quote(key)}})
+	}
+	return b.object(objectKeys, false, body)
+}
+
+// Make a map attribute. HCL2 needs it assigned, like `tags = { ... }`, where
+// the 0.9-era config has it as a block.
+func (b *configBuilder) mapAttribute(key string, body func() []*ast.ObjectItem) *ast.ObjectItem {
+	return b.object([]*ast.ObjectKey{configKey(key, token.Pos{})}, b.opts.hcl2, body)
+}
+
+// Leave a blank line before the next top level block.
+func (b *configBuilder) blankLine() {
+	b.line++
+}
+
+// Print the blocks `terraform fmt` style, each preceded by its comment if it
+// has one.
+func printConfig(items []*ast.ObjectItem) (string, error) {
+	if len(items) == 0 {
+		return "", nil
+	}
+
+	var configBuf bytes.Buffer
+	file := &ast.File{Node: &ast.ObjectList{Items: items}}
+	if err := printer.Fprint(&configBuf, file); err != nil {
+		// Only possible if the tree is malformed, which would be a bug here.
+		return "", fmt.Errorf("Could not print the config: %v", err)
+	}
+	configBuf.WriteString("\n")
+	return configBuf.String(), nil
+}
+
+// Attach a `# ...` comment to the line before a block.
+func setLeadComment(item *ast.ObjectItem, text string) {
+	item.LeadComment = &ast.CommentGroup{
+		List: []*ast.Comment{{Start: item.Pos(), Text: "# " + text}},
+	}
+}
+
+// Convert an attribute value as stored in the state to the type it has in the
+// config. Returns nil for empty values, which are left out of the config.
+func configValue(attribute string, value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	if _, ok := numberAttrs[attribute]; ok {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	if _, ok := boolAttrs[attribute]; ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// Make the sorted attributes of a block from the flatmapped attributes of a
+// resource. Flatmapped maps like `tags.Name` become a nested map. `count` goes
+// first, as it applies to the whole resource.
+func (b *configBuilder) attributes(attrMap map[string]string) []*ast.ObjectItem {
+	var attributes []string
+	maps := make(map[string]map[string]string)
+	for attribute, value := range attrMap {
+		// The attribute map will contain the id, but it doesn't belong in the config.
+		if attribute == "id" || attribute == "count" {
+			continue
+		}
+		if i := strings.Index(attribute, "."); i != -1 {
+			name, key := attribute[:i], attribute[i+1:]
+			if key == "%" || key == "#" {
+				continue
+			}
+			if _, ok := maps[name]; !ok {
+				maps[name] = make(map[string]string)
+				attributes = append(attributes, name)
+			}
+			maps[name][key] = value
+			continue
+		}
+		if configValue(attribute, value) != nil {
+			attributes = append(attributes, attribute)
+		}
+	}
+	sort.Strings(attributes)
+
+	var items []*ast.ObjectItem
+	if count, ok := attrMap["count"]; ok {
+		items = append(items, b.attribute("count", count))
+	}
+	for _, attribute := range attributes {
+		if m, ok := maps[attribute]; ok {
+			items = append(items, b.mapAttribute(attribute, func() []*ast.ObjectItem {
+				var keys []string
+				for key := range m {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+
+				var mapItems []*ast.ObjectItem
+				for _, key := range keys {
+					mapItems = append(mapItems, b.attribute(key, m[key]))
+				}
+				return mapItems
+			}))
+			continue
+		}
+		items = append(items, b.attribute(attribute, configValue(attribute, attrMap[attribute])))
+	}
+	return items
+}
+
+// Generates a resource block from a type, name, and mapping of attributes.
+func generateResourceConfig(b *configBuilder, resourceType string, resourceName string, attrMap map[string]string) *ast.ObjectItem {
+	return b.block([]string{"resource", resourceType, resourceName}, func() []*ast.ObjectItem {
+		return b.attributes(attrMap)
+	})
+}
+
+// Generates a count variable block
+func genCountConfig(b *configBuilder, countVarName string, count int) *ast.ObjectItem {
+	return b.block([]string{"variable", countVarName}, func() []*ast.ObjectItem {
+		return []*ast.ObjectItem{b.attribute("default", count)}
+	})
+}
+
+// Generates a string referencing a count variable, e.g., "${var.countVarName}"
+func genCountVarReference(countVarName string) string {
+	return fmt.Sprintf("${var.%s}", countVarName)
+}
+
+// Generates a string referencing the aws_instance resource for a given BlockDevice
+// e.g., "${aws_instance.instanceName.id}", or "%{element(aws_instance.instanceName.*.id, count.index)}"
+// With HCL2 the lookup is an index, e.g. "${aws_instance.instanceName[count.index].id}"
+func genInstanceReference(dev BlockDevice, count int, hcl2 bool) string {
+	return genInstanceAttrReference(dev, "id", count, hcl2)
+}
+
+// Like `genInstanceReference`, for any attribute. A device taken out of its
+// `count` group refers to its instance by index, e.g.
+// "${aws_instance.instanceName.1.id}".
+func genInstanceAttrReference(dev BlockDevice, attr string, count int, hcl2 bool) string {
+	switch {
+	case !dev.ungrouped:
+		return genResourceAttrReference("aws_instance", dev.instanceResName.name, attr, count, hcl2)
+	case hcl2:
+		return fmt.Sprintf("${aws_instance.%s[%d].%s}", dev.instanceResName.name, dev.instanceResName.index, attr)
+	default:
+		return fmt.Sprintf("${aws_instance.%s.%d.%s}", dev.instanceResName.name, dev.instanceResName.index, attr)
+	}
+}
+
+// Similar to `genInstanceReference` for the the relevant ebs volume resource
+func genVolumeReference(dev BlockDevice, count int, hcl2 bool) string {
+	volumeName := dev.NameWithoutCount()
+	return genResourceReference("aws_ebs_volume", volumeName, count, hcl2)
+}
+
+func genResourceReference(resourceType string, name string, count int, hcl2 bool) string {
+	return genResourceAttrReference(resourceType, name, "id", count, hcl2)
+}
+
+// Like `genResourceReference`, for any attribute.
+func genResourceAttrReference(resourceType string, name string, attr string, count int, hcl2 bool) string {
+	switch {
+	case count == 1:
+		return fmt.Sprintf("${%s.%s.%s}", resourceType, name, attr)
+	case hcl2:
+		return fmt.Sprintf("${%s.%s[count.index].%s}", resourceType, name, attr)
+	default:
+		return fmt.Sprintf("${element(%s.%s.*.%s, count.index)}", resourceType, name, attr)
+	}
+}
+
+// Get the volumes' `availability_zone` as a reference to their instances',
+// e.g. "${element(aws_instance.web.*.availability_zone, count.index)}", so
+// that they stay with the instances. That's only if each instance has the
+// same one as its volume in the state, for the config to evaluate to what the
+// new state has, and, with a `count`, if `count.index` is each instance's
+// index; otherwise they're set by value.
+func (b *configBuilder) instanceAZReference(devList []BlockDevice, count int, hcl2 bool) (string, bool) {
+	if count > 1 && !contiguousIndexes(devList) {
+		return "", false
+	}
+	for _, dev := range devList {
+		switch {
+		case dev.instanceAvailabilityZone == "":
+			b.opts.warnings.addf("%v has no availability_zone in the state, so the config sets its volume's", dev.InstanceAddress())
+			return "", false
+		case dev.instanceAvailabilityZone != dev.availabilityZone:
+			b.opts.warnings.addf("%v has availability_zone %q in the state, but its volume is in %q, so the config sets the volume's",
+				dev.InstanceAddress(), dev.instanceAvailabilityZone, dev.availabilityZone)
+			return "", false
+		}
+	}
+	return genInstanceAttrReference(devList[0], "availability_zone", count, hcl2), true
+}
+
+// The volume types whose IOPS are set rather than following from the size.
+var provisionedIOPSTypes = map[string]bool{"io1": true, "io2": true, "gp3": true}
+
+// Make a map of relevant volume attributes from an `ebs_block_device` block.
+// used in generating the config for a volume
+func makeVolumeAttrs(dev BlockDevice, countVarName string, count int) map[string]string {
+	var attrs = make(map[string]string)
+
+	attrs["size"] = strconv.Itoa(dev.size)
+	attrs["type"] = dev.volumeType
+	attrs["id"] = dev.volumeID
+	attrs["encrypted"] = dev.encrypted
+	attrs["availability_zone"] = dev.availabilityZone
+	attrs["snapshot_id"] = dev.snapshotId
+	attrs["kms_key_id"] = dev.kmsKeyID
+	// IOPS can only be set for provisioned volumes; the rest get them by size.
+	if provisionedIOPSTypes[dev.volumeType] && dev.iops != 0 {
+		attrs["iops"] = strconv.Itoa(dev.iops)
+	}
+	for key, value := range dev.tags {
+		attrs["tags."+key] = value
+	}
+
+	// The attributes of newer versions of the provider, where they aren't
+	// their defaults.
+	p := dev.profile()
+	if dev.volumeType == "gp3" && dev.throughput != 0 && p.configurable("aws_ebs_volume", "throughput") {
+		attrs["throughput"] = strconv.Itoa(dev.throughput)
+	}
+	if dev.multiAttachEnabled == "true" && p.configurable("aws_ebs_volume", "multi_attach_enabled") {
+		attrs["multi_attach_enabled"] = dev.multiAttachEnabled
+	}
+	if dev.outpostArn != "" && p.configurable("aws_ebs_volume", "outpost_arn") {
+		attrs["outpost_arn"] = dev.outpostArn
+	}
+
+	if count > 1 {
+		attrs["count"] = genCountVarReference(countVarName)
+	}
+
+	return attrs
+}
+
+// Make a map of relevant attachment attributes from an `ebs_block_device` block.
+// used in generating the config for an attachment
+func makeAttachmentAttrs(dev BlockDevice, countVarName string, count int, hcl2 bool) map[string]string {
+	attrs := make(map[string]string)
+
+	attrs["device_name"] = dev.deviceName.LongName()
+	attrs["instance_id"] = genInstanceReference(dev, count, hcl2)
+	attrs["volume_id"] = genVolumeReference(dev, count, hcl2)
+	attrs["id"] = dev.volumeAttachmentID()
+
+	if count > 1 {
+		attrs["count"] = genCountVarReference(countVarName)
+	}
+
+	return attrs
+}
+
+// Takes a resource name and a list of Block Devices sharing the name and returns
+// the appropriate blocks. There's 2 cases here:
+// 1. len(devList) = 1: In this case, we just make a simple volume and attachment.
+// 2. len(devList) > 1: In this case, we need to make a count variable and the
+//    relevant count lookups for each resource, and variables for the volume
+//    attributes that differ between the devices.
+func getConfigForDevGroup(b *configBuilder, groupName string, devList []BlockDevice) []*ast.ObjectItem {
+	numDevs := len(devList)
+	// In the order of `count.index`.
+	sort.SliceStable(devList, func(i, j int) bool {
+		return devList[i].instanceResName.index < devList[j].instanceResName.index
+	})
+	dev := devList[0]
+	countVarName := fmt.Sprintf("num_%s", dev.instanceResName.name)
+
+	var items []*ast.ObjectItem
+	if numDevs > 1 {
+		items = append(items, genCountConfig(b, countVarName, numDevs))
+		b.blankLine()
+	}
+
+	volumeAttrs := makeVolumeAttrs(dev, countVarName, numDevs)
+	references := make(map[string]string)
+	if ref, ok := b.instanceAZReference(devList, numDevs, b.opts.hcl2); ok {
+		references["availability_zone"] = ref
+	}
+	if numDevs > 1 {
+		var varItems []*ast.ObjectItem
+		varItems, volumeAttrs = b.perIndexVolumeAttrs(groupName, devList, volumeAttrs, references)
+		items = append(items, varItems...)
+	}
+	for name, ref := range references {
+		volumeAttrs[name] = ref
+	}
+	items = append(items, generateResourceConfig(b, "aws_ebs_volume", dev.NameWithoutCount(), volumeAttrs))
+	b.blankLine()
+	items = append(items, b.rootImportBlocks("aws_ebs_volume", devList)...)
+
+	attachmentAttrs := makeAttachmentAttrs(dev, countVarName, numDevs, b.opts.hcl2)
+	items = append(items, generateResourceConfig(b, "aws_volume_attachment", dev.NameWithoutCount(), attachmentAttrs))
+	b.blankLine()
+	items = append(items, b.rootImportBlocks("aws_volume_attachment", devList)...)
+
+	return items
+}
+
+// Look up the volume attributes that differ between the devices of a `count`
+// group by `count.index`, in a variable for each with the values by index,
+// e.g.
+//
+//    variable "web-xvdb_size" {
+//      default {
+//        "0" = 100
+//        "1" = 500
+//      }
+//    }
+//
+// for `size = "${lookup(var.web-xvdb_size, count.index)}"`. The 0.9-era syntax
+// has no maps of maps, so there each tag that differs gets its own variable.
+// The attributes in `references` are set by reference rather than value, so
+// they don't need one. Returns the variables and the volume attributes of the
+// group, which are the first device's `volumeAttrs` for the attributes that
+// don't differ.
+func (b *configBuilder) perIndexVolumeAttrs(groupName string, devList []BlockDevice, volumeAttrs map[string]string, references map[string]string) ([]*ast.ObjectItem, map[string]string) {
+	var attrMaps []map[string]string
+	for _, dev := range devList {
+		attrMaps = append(attrMaps, makeVolumeAttrs(dev, "", 1))
+	}
+	varying := varyingAttributes(attrMaps)
+	for name := range references {
+		delete(varying, name)
+	}
+	if len(varying) == 0 {
+		return nil, volumeAttrs
+	}
+	var names []string
+	for name := range varying {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.opts.warnings.addf("The volumes of %v differ in %v, so the config looks them up by count.index",
+		groupName, strings.Join(names, ", "))
+
+	attrs := make(map[string]string)
+	for key, value := range volumeAttrs {
+		if !varying[attributeName(key)] {
+			attrs[key] = value
+		}
+	}
+
+	var items []*ast.ObjectItem
+	addVariable := func(varName string, attr string, value func(attrs map[string]string) interface{}) string {
+		// Leave a line for the comment.
+		b.nextLine()
+		item := b.block([]string{"variable", varName}, func() []*ast.ObjectItem {
+			return []*ast.ObjectItem{b.mapAttribute("default", func() []*ast.ObjectItem {
+				var values []*ast.ObjectItem
+				for i := range devList {
+					values = append(values, b.indexedValue(strconv.Itoa(i), value(attrMaps[i])))
+				}
+				return values
+			})}
+		})
+		setLeadComment(item, fmt.Sprintf("The %v of each %v volume, by count.index.", attr, groupName))
+		items = append(items, item)
+		b.blankLine()
+
+		if b.opts.hcl2 {
+			return fmt.Sprintf("${var.%s[count.index]}", varName)
+		}
+		return fmt.Sprintf("${lookup(var.%s, count.index)}", varName)
+	}
+
+	for _, name := range names {
+		name := name
+		isMap := devList[0].profile().ebsVolume.Schema[name].Type == schema.TypeMap
+		switch {
+		case isMap && b.opts.hcl2:
+			attrs[name] = addVariable(fmt.Sprintf("%s_%s", groupName, name), name, func(attrs map[string]string) interface{} {
+				m := make(map[string]string)
+				for key, value := range attrs {
+					if attributeName(key) == name {
+						m[strings.TrimPrefix(key, name+".")] = value
+					}
+				}
+				return m
+			})
+		case isMap:
+			for key, value := range volumeAttrs {
+				if attributeName(key) == name {
+					attrs[key] = value
+				}
+			}
+			for _, key := range varyingMapKeys(attrMaps, name) {
+				key := key
+				for i, attrs := range attrMaps {
+					if _, ok := attrs[key]; !ok {
+						b.opts.warnings.addf("%v isn't set on %v, so the config sets it empty", key, devList[i].VolumeName())
+					}
+				}
+				varName := fmt.Sprintf("%s_%s", groupName, variableNameRegexp.ReplaceAllString(key, "_"))
+				attrs[key] = addVariable(varName, key, func(attrs map[string]string) interface{} {
+					return attrs[key]
+				})
+			}
+		default:
+			attrs[name] = addVariable(fmt.Sprintf("%s_%s", groupName, name), name, func(attrs map[string]string) interface{} {
+				return b.indexedScalar(name, attrs[name])
+			})
+		}
+	}
+	return items, attrs
+}
+
+var variableNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Get the flatmapped keys of a map attribute, e.g. `tags.Name`, whose values
+// differ between the attributes, including the keys some of them don't have.
+// The `%` counting them is left out.
+func varyingMapKeys(attrMaps []map[string]string, name string) []string {
+	varying := make(map[string]bool)
+	for _, attrs := range attrMaps {
+		for key, value := range attrs {
+			if attributeName(key) != name || key == name+".%" {
+				continue
+			}
+			for _, other := range attrMaps {
+				if otherValue, ok := other[key]; !ok || otherValue != value {
+					varying[key] = true
+				}
+			}
+		}
+	}
+	var keys []string
+	for key := range varying {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Convert a device's value of an attribute for a per-index variable. A value
+// it doesn't have is null with HCL2, and otherwise its type's zero value,
+// which the provider treats the same.
+func (b *configBuilder) indexedScalar(attribute string, value string) interface{} {
+	if v := configValue(attribute, value); v != nil {
+		return v
+	}
+	if b.opts.hcl2 {
+		return configExpr("null")
+	}
+	if _, ok := numberAttrs[attribute]; ok {
+		return 0
+	}
+	if _, ok := boolAttrs[attribute]; ok {
+		return false
+	}
+	return ""
+}
+
+// Make an entry of a per-index variable's map.
+func (b *configBuilder) indexedValue(key string, value interface{}) *ast.ObjectItem {
+	if m, ok := value.(map[string]string); ok {
+		return b.object([]*ast.ObjectKey{configKey(key, token.Pos{})}, true, func() []*ast.ObjectItem {
+			var keys []string
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var items []*ast.ObjectItem
+			for _, k := range keys {
+				items = append(items, b.attribute(k, m[k]))
+			}
+			return items
+		})
+	}
+	return b.attribute(key, value)
+}
+
+// Make the `import` blocks adopting the resources of the given type for the
+// devices, e.g.
+//
+//    import {
+//      to = aws_ebs_volume.web-xvdb[0]
+//      id = "vol-1234"
+//    }
+//
+// Attachments are imported by `DEVICE_NAME:VOLUME_ID:INSTANCE_ID`.
+func (b *configBuilder) importBlocks(resourceType string, devList []BlockDevice) []*ast.ObjectItem {
+	devs := append([]BlockDevice(nil), devList...)
+	sort.SliceStable(devs, func(i, j int) bool {
+		if a, b := modulePathString(devs[i].modulePath), modulePathString(devs[j].modulePath); a != b {
+			return a < b
+		}
+		if a, b := devs[i].NameWithoutCount(), devs[j].NameWithoutCount(); a != b {
+			return a < b
+		}
+		a, b := devs[i].instanceResName, devs[j].instanceResName
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return devs[i].deviceName.LongName() < devs[j].deviceName.LongName()
+	})
+
+	var items []*ast.ObjectItem
+	for _, dev := range devs {
+		id := dev.volumeID
+		if resourceType == "aws_volume_attachment" {
+			id = dev.volumeAttachmentImportID()
+		}
+		address := dev.resourceAddress(resourceType, b.opts)
+		items = append(items, b.block([]string{"import"}, func() []*ast.ObjectItem {
+			return []*ast.ObjectItem{
+				b.attribute("to", configExpr(address)),
+				b.attribute("id", id),
+			}
+		}))
+		b.blankLine()
+	}
+	return items
+}
+
+// Terraform only reads `import` blocks from the root module, so the ones for
+// devices in other modules are made separately, by `genConfig`.
+func (b *configBuilder) rootImportBlocks(resourceType string, devList []BlockDevice) []*ast.ObjectItem {
+	if !b.opts.importBlocks || len(devList[0].modulePath) > 1 {
+		return nil
+	}
+	return b.importBlocks(resourceType, devList)
+}
+
+// This is a bit janky, but here goes. We'd like to make a mapping from resource
+// name to the block devices that share that name. The reason for this is to
+// group resources generated through a `count` variable.
+func getDevMapping(devs []BlockDevice) map[string][]BlockDevice {
+	devMap := make(map[string][]BlockDevice)
+
+	for _, dev := range devs {
+		nameWithoutCount := dev.NameWithoutCount()
+		devMap[nameWithoutCount] = append(devMap[nameWithoutCount], dev)
+	}
+
+	return devMap
+}
+
+// Take the devices of instances with a `count` out of their group, where the
+// group can't be one resource with a `count` in the config: where the
+// instances' indexes aren't 0 to n-1, for `count.index` to stand for, and,
+// without HCL2, where an attribute is set on only some of the volumes. Each of
+// those devices gets resources of its own instead, and is marked `ungrouped`.
+// `instDevs` are the devices by instance. With `for_each`, the resources are
+// keyed by instance, so any group will do.
+func splitCountGroups(instDevs [][]BlockDevice, opts configOptions) {
+	if opts.forEach {
+		return
+	}
+	type member struct{ inst, dev int }
+	groups := make(map[string][]BlockDevice)
+	members := make(map[string][]member)
+	for i, devs := range instDevs {
+		for j, dev := range devs {
+			if dev.instanceResName.index == -1 {
+				continue
+			}
+			key := modulePathString(dev.modulePath) + "." + dev.NameWithoutCount()
+			groups[key] = append(groups[key], dev)
+			members[key] = append(members[key], member{i, j})
+		}
+	}
+
+	for _, key := range sortedKeys(groups) {
+		devList := groups[key]
+		if len(devList) == 1 {
+			// A group of one has no `count`, but its instance still does, so
+			// it's referred to by its index.
+			m := members[key][0]
+			instDevs[m.inst][m.dev].ungrouped = true
+			continue
+		}
+		var reason string
+		switch names := partlySetAttributes(devList); {
+		case !contiguousIndexes(devList):
+			reason = "their instances' indexes aren't 0 to n-1"
+		case len(names) != 0 && !opts.hcl2:
+			reason = fmt.Sprintf("only some of them set %v", strings.Join(names, ", "))
+		default:
+			continue
+		}
+		opts.warnings.addf("The volumes of %v can't share a count, as %v, so each has resources of its own, named with its index",
+			devList[0].NameWithoutCount(), reason)
+		for _, m := range members[key] {
+			instDevs[m.inst][m.dev].ungrouped = true
+		}
+	}
+}
+
+// Whether the `count` indexes of a group's instances are 0 to n-1.
+func contiguousIndexes(devList []BlockDevice) bool {
+	seen := make(map[int]bool)
+	for _, dev := range devList {
+		index := dev.instanceResName.index
+		if index < 0 || index >= len(devList) || seen[index] {
+			return false
+		}
+		seen[index] = true
+	}
+	return true
+}
+
+// Get the volume attributes, and keys of map attributes, set on some of a
+// group's volumes but not the others, e.g. `iops` for an io1 and a gp2
+// volume. The 0.9-era syntax has no null for a per-index variable to leave
+// them unset with, and their zero values differ from the state.
+func partlySetAttributes(devList []BlockDevice) []string {
+	var attrMaps []map[string]string
+	for _, dev := range devList {
+		attrMaps = append(attrMaps, makeVolumeAttrs(dev, "", 1))
+	}
+	partly := make(map[string]bool)
+	for _, attrs := range attrMaps {
+		for key := range attrs {
+			for _, other := range attrMaps {
+				if _, ok := other[key]; !ok {
+					partly[key] = true
+				}
+			}
+		}
+	}
+	var names []string
+	for name := range partly {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Group block devices by the name of their `for_each` resources.
+func getForEachMapping(devs []BlockDevice) map[string][]BlockDevice {
+	devMap := make(map[string][]BlockDevice)
+
+	for _, dev := range devs {
+		name := dev.ForEachName()
+		devMap[name] = append(devMap[name], dev)
+	}
+
+	return devMap
+}
+
+// The name of a flatmapped attribute without its map key, e.g. `tags` for
+// `tags.Name`.
+func attributeName(key string) string {
+	if i := strings.Index(key, "."); i != -1 {
+		return key[:i]
+	}
+	return key
+}
+
+// Find the attributes whose values differ between the members of a group.
+func varyingAttributes(attrMaps []map[string]string) map[string]bool {
+	varying := make(map[string]bool)
+	for _, attrs := range attrMaps {
+		for key, value := range attrs {
+			for _, other := range attrMaps {
+				if otherValue, ok := other[key]; !ok || otherValue != value {
+					varying[attributeName(key)] = true
+				}
+			}
+		}
+	}
+	delete(varying, "id")
+	return varying
+}
+
+// Takes a resource name and the Block Devices in its `for_each`, and returns
+// the volume and attachment blocks. Attributes that are the same for every
+// device are set directly, and the rest are looked up in the `for_each` map.
+// The attachment iterates over the volumes, so it has the same keys.
+func getForEachConfigForDevGroup(b *configBuilder, groupName string, devList []BlockDevice) []*ast.ObjectItem {
+	sort.Slice(devList, func(i, j int) bool {
+		return devList[i].ForEachKey() < devList[j].ForEachKey()
+	})
+	dev := devList[0]
+
+	var volumeAttrMaps []map[string]string
+	for _, dev := range devList {
+		volumeAttrMaps = append(volumeAttrMaps, makeVolumeAttrs(dev, "", 1))
+	}
+	varying := varyingAttributes(volumeAttrMaps)
+	references := make(map[string]string)
+	if ref, ok := b.instanceAZReference(devList, 1, true); ok {
+		if dev.instanceResName.index != -1 || dev.instanceResName.key != "" {
+			ref = fmt.Sprintf("${aws_instance.%s[each.key].availability_zone}", dev.instanceResName.name)
+		}
+		references["availability_zone"] = ref
+		delete(varying, "availability_zone")
+	}
+
+	volumeAttrs := make(map[string]string)
+	for key, value := range volumeAttrMaps[0] {
+		if !varying[attributeName(key)] {
+			volumeAttrs[key] = value
+		}
+	}
+	for name := range varying {
+		volumeAttrs[name] = fmt.Sprintf("${each.value.%s}", name)
+	}
+	for name, ref := range references {
+		volumeAttrs[name] = ref
+	}
+
+	var items []*ast.ObjectItem
+	items = append(items, b.block([]string{"resource", "aws_ebs_volume", groupName}, func() []*ast.ObjectItem {
+		forEach := b.forEachAttribute(devList, volumeAttrMaps, varying)
+		return append([]*ast.ObjectItem{forEach}, b.attributes(volumeAttrs)...)
+	}))
+	b.blankLine()
+	items = append(items, b.rootImportBlocks("aws_ebs_volume", devList)...)
+
+	attachmentAttrs := make(map[string]string)
+	if dev.instanceResName.index == -1 && dev.instanceResName.key == "" {
+		// Keyed by device.
+		attachmentAttrs["device_name"] = "/dev/${each.key}"
+		attachmentAttrs["instance_id"] = fmt.Sprintf("${aws_instance.%s.id}", dev.instanceResName.name)
+	} else {
+		attachmentAttrs["device_name"] = dev.deviceName.LongName()
+		attachmentAttrs["instance_id"] = fmt.Sprintf("${aws_instance.%s[each.key].id}", dev.instanceResName.name)
+	}
+	attachmentAttrs["volume_id"] = "${each.value.id}"
+
+	items = append(items, b.block([]string{"resource", "aws_volume_attachment", groupName}, func() []*ast.ObjectItem {
+		forEach := b.attribute("for_each", configExpr(fmt.Sprintf("aws_ebs_volume.%s", groupName)))
+		return append([]*ast.ObjectItem{forEach}, b.attributes(attachmentAttrs)...)
+	}))
+	b.blankLine()
+	items = append(items, b.rootImportBlocks("aws_volume_attachment", devList)...)
+
+	return items
+}
+
+// Make the `for_each` of a group of devices: a set of their keys if nothing
+// varies between them, and otherwise a map from their keys to the attributes
+// that do.
+func (b *configBuilder) forEachAttribute(devList []BlockDevice, attrMaps []map[string]string, varying map[string]bool) *ast.ObjectItem {
+	if len(varying) == 0 {
+		var keys []string
+		for _, dev := range devList {
+			keys = append(keys, strconv.Quote(dev.ForEachKey()))
+		}
+		return b.attribute("for_each", configExpr(fmt.Sprintf("toset([%s])", strings.Join(keys, ", "))))
+	}
+
+	return b.mapAttribute("for_each", func() []*ast.ObjectItem {
+		var items []*ast.ObjectItem
+		for i, dev := range devList {
+			attrs := make(map[string]string)
+			for name := range varying {
+				// Every key needs every attribute for `each.value` to work.
+				attrs[name] = "${null}"
+			}
+			for key, value := range attrMaps[i] {
+				if varying[attributeName(key)] {
+					delete(attrs, attributeName(key))
+					attrs[key] = value
+				}
+			}
+			for key, value := range attrs {
+				if value == "" {
+					attrs[key] = "${null}"
+				}
+			}
+
+			items = append(items, b.object([]*ast.ObjectKey{configKey(dev.ForEachKey(), token.Pos{})}, true, func() []*ast.ObjectItem {
+				return b.attributes(attrs)
+			}))
+		}
+		return items
+	})
+}
+
+// Group block devices by the path of the module their instance lives in, since
+// the config for each has to go in that module's source.
+func getModuleMapping(devs []BlockDevice) map[string][]BlockDevice {
+	moduleMap := make(map[string][]BlockDevice)
+
+	for _, dev := range devs {
+		path := modulePathString(dev.modulePath)
+		moduleMap[path] = append(moduleMap[path], dev)
+	}
+
+	return moduleMap
+}
+
+// Get the keys of a map of block devices, sorted.
+func sortedKeys(devMap map[string][]BlockDevice) []string {
+	var keys []string
+	for key := range devMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Make the blocks for the block devices of a single module.
+func genModuleConfig(b *configBuilder, devs []BlockDevice, opts configOptions) []*ast.ObjectItem {
+	var items []*ast.ObjectItem
+	if opts.hcl2 && opts.forEach {
+		forEachMapping := getForEachMapping(devs)
+		for _, name := range sortedKeys(forEachMapping) {
+			items = append(items, getForEachConfigForDevGroup(b, name, forEachMapping[name])...)
+		}
+		return items
+	}
+
+	devNameMapping := getDevMapping(devs)
+	for _, devName := range sortedKeys(devNameMapping) {
+		items = append(items, getConfigForDevGroup(b, devName, devNameMapping[devName])...)
+	}
+	return items
+}
+
+// Take a list of block devices and generate a config, with a header comment
+// for each module path. Modules and resources are sorted, so the same devices
+// always give the same config.
+func genConfig(devs []BlockDevice, opts configOptions) (string, error) {
+	b := &configBuilder{opts: opts}
+	var items []*ast.ObjectItem
+	moduleMapping := getModuleMapping(devs)
+
+	var moduleDevs []BlockDevice
+	for _, path := range sortedKeys(moduleMapping) {
+		// Leave a line for the comment.
+		b.nextLine()
+		moduleItems := genModuleConfig(b, moduleMapping[path], opts)
+		setLeadComment(moduleItems[0], fmt.Sprintf("Module: %s", path))
+		items = append(items, moduleItems...)
+
+		if path != "root" {
+			moduleDevs = append(moduleDevs, moduleMapping[path]...)
+		}
+	}
+
+	if opts.importBlocks && len(moduleDevs) > 0 {
+		b.nextLine()
+		var importItems []*ast.ObjectItem
+		for _, resourceType := range []string{"aws_ebs_volume", "aws_volume_attachment"} {
+			importItems = append(importItems, b.importBlocks(resourceType, moduleDevs)...)
+		}
+		setLeadComment(importItems[0], "Module: root (imports of resources in other modules)")
+		items = append(items, importItems...)
+	}
+
+	return printConfig(items)
+}
+
+// Generates the `aws_instance` block with the `ebs_block_device` blocks for an
+// instance's config from the block devices folded back into it. Instances with
+// a `count` should all have the same devices, so only one of each device name
+// is used.
+func getRevertConfigForInstance(b *configBuilder, instanceName string, devList []BlockDevice) *ast.ObjectItem {
+	devsByName := make(map[string]BlockDevice)
+	var devNames []string
+	for _, dev := range devList {
+		name := dev.deviceName.LongName()
+		if _, ok := devsByName[name]; !ok {
+			devsByName[name] = dev
+			devNames = append(devNames, name)
+		}
+	}
+	sort.Strings(devNames)
+
+	return b.block([]string{"resource", "aws_instance", instanceName}, func() []*ast.ObjectItem {
+		var items []*ast.ObjectItem
+		for _, name := range devNames {
+			dev := devsByName[name]
+			attrMap := dev.makeEbsBlockDeviceAttrs()
+			if !provisionedIOPSTypes[dev.volumeType] {
+				delete(attrMap, "iops")
+			}
+
+			items = append(items, b.block([]string{"ebs_block_device"}, func() []*ast.ObjectItem {
+				return b.attributes(attrMap)
+			}))
+		}
+		return items
+	})
+}
+
+// Take a list of block devices folded back into their instances and generate
+// the config for those instances.
+func genRevertConfig(devs []BlockDevice) (string, error) {
+	b := &configBuilder{}
+	var items []*ast.ObjectItem
+	moduleMapping := getModuleMapping(devs)
+
+	for _, path := range sortedKeys(moduleMapping) {
+		b.nextLine()
+
+		instanceMapping := make(map[string][]BlockDevice)
+		for _, dev := range moduleMapping[path] {
+			name := dev.instanceResName.name
+			instanceMapping[name] = append(instanceMapping[name], dev)
+		}
+
+		var moduleItems []*ast.ObjectItem
+		for _, name := range sortedKeys(instanceMapping) {
+			moduleItems = append(moduleItems, getRevertConfigForInstance(b, name, instanceMapping[name]))
+			b.blankLine()
+		}
+		setLeadComment(moduleItems[0], fmt.Sprintf("Module: %s", path))
+		items = append(items, moduleItems...)
+	}
+
+	return printConfig(items)
+}
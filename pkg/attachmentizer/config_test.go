@@ -0,0 +1,479 @@
+package attachmentizer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/hcl/printer"
+)
+
+func testConfigDevs() []BlockDevice {
+	var devs []BlockDevice
+	for i, instanceID := range []string{"i-1d7683bd", "i-2e8794ce"} {
+		devs = append(devs, BlockDevice{
+			volumeID:            "v-abcd",
+			size:                100,
+			volumeType:          "io1",
+			deleteOnTermination: "false",
+			deviceName:          NewDeviceName("xvdb"),
+			encrypted:           "true",
+			iops:                1000,
+			tags:                map[string]string{"Name": "web-data", "Cost Center": "1234"},
+			instanceID:          instanceID,
+			availabilityZone:    "us-east-1a",
+			instanceResName:     &TerraformName{"aws_instance", "web", i, ""},
+			modulePath:          []string{"root"},
+		})
+	}
+	devs = append(devs, BlockDevice{
+		volumeID:            "v-1234",
+		size:                10,
+		volumeType:          "gp2",
+		deleteOnTermination: "false",
+		deviceName:          NewDeviceName("xvdc"),
+		encrypted:           "false",
+		instanceID:          "i-3f98a5df",
+		availabilityZone:    "us-east-1b",
+		instanceResName:     &TerraformName{"aws_instance", "db", -1, ""},
+		modulePath:          []string{"root", "db"},
+	})
+	return devs
+}
+
+func mustGenConfig(t *testing.T, devs []BlockDevice, opts configOptions) string {
+	t.Helper()
+	config, err := genConfig(devs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestGenConfig(t *testing.T) {
+	devs := testConfigDevs()
+	expected := `# Module: root
+variable "num_web" {
+  default = 2
+}
+
+resource "aws_ebs_volume" "web-xvdb" {
+  count             = "${var.num_web}"
+  availability_zone = "us-east-1a"
+  encrypted         = true
+  iops              = 1000
+  size              = 100
+
+  tags {
+    "Cost Center" = "1234"
+    Name          = "web-data"
+  }
+
+  type = "io1"
+}
+
+resource "aws_volume_attachment" "web-xvdb" {
+  count       = "${var.num_web}"
+  device_name = "/dev/xvdb"
+  instance_id = "${element(aws_instance.web.*.id, count.index)}"
+  volume_id   = "${element(aws_ebs_volume.web-xvdb.*.id, count.index)}"
+}
+
+# Module: root.db
+resource "aws_ebs_volume" "db-xvdc" {
+  availability_zone = "us-east-1b"
+  encrypted         = false
+  size              = 10
+  type              = "gp2"
+}
+
+resource "aws_volume_attachment" "db-xvdc" {
+  device_name = "/dev/xvdc"
+  instance_id = "${aws_instance.db.id}"
+  volume_id   = "${aws_ebs_volume.db-xvdc.id}"
+}
+`
+
+	for i := 0; i < 5; i++ {
+		actual := mustGenConfig(t, devs, configOptions{})
+		if actual != expected {
+			t.Fatalf("Expected:\n%s\nGot:\n%s", expected, actual)
+		}
+	}
+
+	formatted, err := printer.Format([]byte(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != expected {
+		t.Errorf("Expected the config to be formatted already, got:\n%s", formatted)
+	}
+}
+
+func TestGenConfigHCL2(t *testing.T) {
+	devs := testConfigDevs()
+	devs[1].availabilityZone = "us-east-1b"
+	devs = append(devs, BlockDevice{
+		volumeID:            "v-5678",
+		size:                20,
+		volumeType:          "gp2",
+		deleteOnTermination: "false",
+		deviceName:          NewDeviceName("xvdd"),
+		encrypted:           "false",
+		instanceID:          "i-3f98a5df",
+		availabilityZone:    "us-east-1b",
+		instanceResName:     &TerraformName{"aws_instance", "db", -1, ""},
+		modulePath:          []string{"root", "db"},
+	})
+
+	expected := `# Module: root
+resource "aws_ebs_volume" "web-xvdb" {
+  for_each = {
+    "0" = {
+      availability_zone = "us-east-1a"
+    }
+
+    "1" = {
+      availability_zone = "us-east-1b"
+    }
+  }
+
+  availability_zone = each.value.availability_zone
+  encrypted         = true
+  iops              = 1000
+  size              = 100
+
+  tags = {
+    "Cost Center" = "1234"
+    Name          = "web-data"
+  }
+
+  type = "io1"
+}
+
+resource "aws_volume_attachment" "web-xvdb" {
+  for_each    = aws_ebs_volume.web-xvdb
+  device_name = "/dev/xvdb"
+  instance_id = aws_instance.web[each.key].id
+  volume_id   = each.value.id
+}
+
+# Module: root.db
+resource "aws_ebs_volume" "db" {
+  for_each = {
+    xvdc = {
+      size = 10
+    }
+
+    xvdd = {
+      size = 20
+    }
+  }
+
+  availability_zone = "us-east-1b"
+  encrypted         = false
+  size              = each.value.size
+  type              = "gp2"
+}
+
+resource "aws_volume_attachment" "db" {
+  for_each    = aws_ebs_volume.db
+  device_name = "/dev/${each.key}"
+  instance_id = aws_instance.db.id
+  volume_id   = each.value.id
+}
+`
+
+	actual := mustGenConfig(t, devs, configOptions{hcl2: true, forEach: true})
+	if actual != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, actual)
+	}
+}
+
+// The volumes of a count group that differ get their attributes by index.
+func TestGenConfigCountVaryingAttributes(t *testing.T) {
+	devs := testConfigDevs()[:2]
+	devs[0], devs[1] = devs[1], devs[0]
+	devs[0].size = 500
+	devs[0].volumeType = "gp2"
+	devs[0].tags = map[string]string{"Name": "web-logs", "Cost Center": "1234", "Owner": "ops"}
+
+	var testCases = []struct {
+		hcl2     bool
+		expected string
+	}{
+		{
+			false,
+			`# Module: root
+variable "num_web" {
+  default = 2
+}
+
+# The iops of each web-xvdb volume, by count.index.
+variable "web-xvdb_iops" {
+  default {
+    "0" = 1000
+    "1" = 0
+  }
+}
+
+# The size of each web-xvdb volume, by count.index.
+variable "web-xvdb_size" {
+  default {
+    "0" = 100
+    "1" = 500
+  }
+}
+
+# The tags.Name of each web-xvdb volume, by count.index.
+variable "web-xvdb_tags_Name" {
+  default {
+    "0" = "web-data"
+    "1" = "web-logs"
+  }
+}
+
+# The tags.Owner of each web-xvdb volume, by count.index.
+variable "web-xvdb_tags_Owner" {
+  default {
+    "0" = ""
+    "1" = "ops"
+  }
+}
+
+# The type of each web-xvdb volume, by count.index.
+variable "web-xvdb_type" {
+  default {
+    "0" = "io1"
+    "1" = "gp2"
+  }
+}
+
+resource "aws_ebs_volume" "web-xvdb" {
+  count             = "${var.num_web}"
+  availability_zone = "us-east-1a"
+  encrypted         = true
+  iops              = "${lookup(var.web-xvdb_iops, count.index)}"
+  size              = "${lookup(var.web-xvdb_size, count.index)}"
+
+  tags {
+    "Cost Center" = "1234"
+    Name          = "${lookup(var.web-xvdb_tags_Name, count.index)}"
+    Owner         = "${lookup(var.web-xvdb_tags_Owner, count.index)}"
+  }
+
+  type = "${lookup(var.web-xvdb_type, count.index)}"
+}
+`,
+		},
+		{
+			true,
+			`# Module: root
+variable "num_web" {
+  default = 2
+}
+
+# The iops of each web-xvdb volume, by count.index.
+variable "web-xvdb_iops" {
+  default = {
+    "0" = 1000
+    "1" = null
+  }
+}
+
+# The size of each web-xvdb volume, by count.index.
+variable "web-xvdb_size" {
+  default = {
+    "0" = 100
+    "1" = 500
+  }
+}
+
+# The tags of each web-xvdb volume, by count.index.
+variable "web-xvdb_tags" {
+  default = {
+    "0" = {
+      "Cost Center" = "1234"
+      Name          = "web-data"
+    }
+
+    "1" = {
+      "Cost Center" = "1234"
+      Name          = "web-logs"
+      Owner         = "ops"
+    }
+  }
+}
+
+# The type of each web-xvdb volume, by count.index.
+variable "web-xvdb_type" {
+  default = {
+    "0" = "io1"
+    "1" = "gp2"
+  }
+}
+
+resource "aws_ebs_volume" "web-xvdb" {
+  count             = var.num_web
+  availability_zone = "us-east-1a"
+  encrypted         = true
+  iops              = var.web-xvdb_iops[count.index]
+  size              = var.web-xvdb_size[count.index]
+  tags              = var.web-xvdb_tags[count.index]
+  type              = var.web-xvdb_type[count.index]
+}
+`,
+		},
+	}
+
+	for _, tt := range testCases {
+		actual := mustGenConfig(t, devs, configOptions{hcl2: tt.hcl2})
+		if !strings.HasPrefix(actual, tt.expected) {
+			t.Errorf("[hcl2 %v] Expected it to start with:\n%s\nGot:\n%s", tt.hcl2, tt.expected, actual)
+		}
+	}
+}
+
+// The volumes of a count group are put in their instances' zones, or by index
+// if the state has another zone for any of the instances.
+func TestGenConfigInstanceAZ(t *testing.T) {
+	devs := testConfigDevs()[:2]
+	devs[1].availabilityZone = "us-east-1b"
+	for i := range devs {
+		devs[i].instanceAvailabilityZone = devs[i].availabilityZone
+	}
+
+	var testCases = []struct {
+		opts     configOptions
+		expected string
+	}{
+		{configOptions{}, `availability_zone = "${element(aws_instance.web.*.availability_zone, count.index)}"`},
+		{configOptions{hcl2: true}, "availability_zone = aws_instance.web[count.index].availability_zone"},
+		{configOptions{hcl2: true, forEach: true}, "availability_zone = aws_instance.web[each.key].availability_zone"},
+	}
+	for _, tt := range testCases {
+		config := mustGenConfig(t, devs, tt.opts)
+		if !strings.Contains(config, tt.expected) || strings.Contains(config, "us-east-1") {
+			t.Errorf("Expected the config to have %q, got:\n%s", tt.expected, config)
+		}
+	}
+
+	devs[1].instanceAvailabilityZone = "us-east-1c"
+	config := mustGenConfig(t, devs, configOptions{hcl2: true})
+	for _, line := range []string{`"1" = "us-east-1b"`, "availability_zone = var.web-xvdb_availability_zone[count.index]"} {
+		if !strings.Contains(config, line) {
+			t.Errorf("Expected the config to have %q, got:\n%s", line, config)
+		}
+	}
+
+	// Without an instance at index 1, `count.index` isn't the instances'
+	// index, so the zones are by value, by position.
+	devs[1].instanceAvailabilityZone = devs[1].availabilityZone
+	devs[1].instanceResName = &TerraformName{"aws_instance", "web", 2, ""}
+	config = mustGenConfig(t, devs, configOptions{hcl2: true})
+	for _, line := range []string{`"1" = "us-east-1b"`, "availability_zone = var.web-xvdb_availability_zone[count.index]"} {
+		if !strings.Contains(config, line) {
+			t.Errorf("Expected the config to have %q, got:\n%s", line, config)
+		}
+	}
+}
+
+func TestGenConfigImportBlocks(t *testing.T) {
+	devs := testConfigDevs()
+
+	expected := `# Module: root
+variable "num_web" {
+  default = 2
+}
+
+resource "aws_ebs_volume" "web-xvdb" {
+  count             = var.num_web
+  availability_zone = "us-east-1a"
+  encrypted         = true
+  iops              = 1000
+  size              = 100
+
+  tags = {
+    "Cost Center" = "1234"
+    Name          = "web-data"
+  }
+
+  type = "io1"
+}
+
+import {
+  to = aws_ebs_volume.web-xvdb[0]
+  id = "v-abcd"
+}
+
+import {
+  to = aws_ebs_volume.web-xvdb[1]
+  id = "v-abcd"
+}
+
+resource "aws_volume_attachment" "web-xvdb" {
+  count       = var.num_web
+  device_name = "/dev/xvdb"
+  instance_id = aws_instance.web[count.index].id
+  volume_id   = aws_ebs_volume.web-xvdb[count.index].id
+}
+
+import {
+  to = aws_volume_attachment.web-xvdb[0]
+  id = "/dev/xvdb:v-abcd:i-1d7683bd"
+}
+
+import {
+  to = aws_volume_attachment.web-xvdb[1]
+  id = "/dev/xvdb:v-abcd:i-2e8794ce"
+}
+
+# Module: root.db
+resource "aws_ebs_volume" "db-xvdc" {
+  availability_zone = "us-east-1b"
+  encrypted         = false
+  size              = 10
+  type              = "gp2"
+}
+
+resource "aws_volume_attachment" "db-xvdc" {
+  device_name = "/dev/xvdc"
+  instance_id = aws_instance.db.id
+  volume_id   = aws_ebs_volume.db-xvdc.id
+}
+
+# Module: root (imports of resources in other modules)
+import {
+  to = module.db.aws_ebs_volume.db-xvdc
+  id = "v-1234"
+}
+
+import {
+  to = module.db.aws_volume_attachment.db-xvdc
+  id = "/dev/xvdc:v-1234:i-3f98a5df"
+}
+`
+
+	actual := mustGenConfig(t, devs, configOptions{hcl2: true, importBlocks: true})
+	if actual != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, actual)
+	}
+}
+
+// Reverting keeps the iops of every type they're set for, not only io1.
+func TestGenRevertConfigIOPS(t *testing.T) {
+	devs := testConfigDevs()[:1]
+	devs[0].volumeType = "gp3"
+	devs = append(devs, testConfigDevs()[2])
+	devs[1].iops = 100
+
+	config, err := genRevertConfig(devs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "iops                  = 1000") {
+		t.Errorf("Expected the gp3 volume's iops to be kept, got:\n%v", config)
+	}
+	if strings.Contains(config, "iops                  = 100\n") {
+		t.Errorf("Expected the gp2 volume's iops to be left out, got:\n%v", config)
+	}
+}
@@ -0,0 +1,372 @@
+package attachmentizer
+
+// This file is the package's entry point: a `Converter` works out The
+// Conversion (or its revert) for a state file as a `Plan`, and applies it by
+// writing out the state, config, or imports.
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+)
+
+// What applying a conversion writes, other than the config.
+type OutputMode string
+
+const (
+	// Write a new state file.
+	OutputState OutputMode = "state"
+	// Leave the state alone, and write a script of `terraform import` commands
+	// for the new resources, with a manifest of them.
+	OutputImportScript OutputMode = "import-script"
+	// Leave the state alone, and write the config with Terraform 1.5+ `import`
+	// blocks for the new resources.
+	OutputImportBlocks OutputMode = "import-blocks"
+)
+
+// The file in the working directory a remote backend's state is backed up
+// to, with the time added.
+const remoteBackupPath = "terraform.tfstate"
+
+// The default template for the names of the new resources.
+const DefaultNameTemplate = "{{.Instance}}-{{.Device}}"
+
+type Options struct {
+	// The state file to convert.
+	StatePath string
+	// Or the remote backend whose state to convert, which the new state is
+	// pushed back to rather than written to `StateOutPath`.
+	Backend *BackendConfig
+	// Where to look the instances up. Not needed for `Revert`.
+	EC2 EC2Interface
+	// Only convert instances matching these, as well as being in the state.
+	// See `InstanceQuery`.
+	NamePatterns []string
+	Tags         map[string]string
+
+	// Fold the volumes back into `ebs_block_device` blocks instead. Only
+	// `OutputState` is supported.
+	Revert bool
+	// Write the config for Terraform 0.12 and later. Implied by
+	// `OutputImportScript` and `OutputImportBlocks`, which need a version 4
+	// state.
+	HCL2 bool
+	// The template for the names of the new resources. Defaults to
+	// `DefaultNameTemplate`; see `NameTemplateData` for the fields.
+	NameTemplate string
+	// Convert the instances without problems rather than failing, and list the
+	// ones skipped in the plan.
+	SkipInvalid bool
+	// The version of the AWS provider to write the new resources for, one of
+	// `AWSProviders`. Defaults to `DefaultAWSProvider`. Not used by `Revert`.
+	AWSProvider string
+
+	// Defaults to `OutputState`.
+	Output       OutputMode
+	StateOutPath string
+	// Where to write the config, or what couldn't be placed in `ConfigDir`.
+	ConfigOutPath string
+	// Rewrite the config in this directory (and its local modules) in place.
+	// Not supported with `HCL2`.
+	ConfigDir string
+	// Where to write the script for `OutputImportScript`. The manifest goes
+	// next to it, with `.json` added. The script, like `OutputImportBlocks`,
+	// needs a version 4 state and `AWSProvider` 3.x or later, since older
+	// providers can't import attachments.
+	ImportScriptPath string
+}
+
+type Converter struct {
+	opts         Options
+	nameTemplate *template.Template
+	provider     *providerProfile
+	remote       remoteClient
+}
+
+// Check the options and make a converter with them.
+func NewConverter(opts Options) (*Converter, error) {
+	if opts.Output == "" {
+		opts.Output = OutputState
+	}
+	if opts.NameTemplate == "" {
+		opts.NameTemplate = DefaultNameTemplate
+	}
+
+	switch opts.Output {
+	case OutputState:
+	case OutputImportScript:
+		if opts.ImportScriptPath == "" {
+			return nil, errors.New("The import script needs a path to write it to")
+		}
+		opts.HCL2 = true
+	case OutputImportBlocks:
+		opts.HCL2 = true
+	default:
+		return nil, fmt.Errorf("Unknown output mode %q", opts.Output)
+	}
+
+	if opts.StatePath == "" && opts.Backend == nil {
+		return nil, errors.New("A state file or backend to convert is needed")
+	}
+	if opts.StatePath != "" && opts.Backend != nil {
+		return nil, errors.New("Only one of a state file and a backend can be converted")
+	}
+	if opts.Revert && opts.Output != OutputState {
+		return nil, errors.New("Reverting can only write a new state")
+	}
+	if !opts.Revert && opts.EC2 == nil {
+		return nil, errors.New("EC2 is needed to look the instances up")
+	}
+	if opts.ConfigDir != "" && opts.HCL2 {
+		return nil, errors.New("The config can only be rewritten in place for Terraform 0.9, so not with HCL2, an import script or import blocks")
+	}
+
+	nameTemplate, err := ParseNameTemplate(opts.NameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid name template: %v", err)
+	}
+	// The default gives the names the devices have without a template, which
+	// keeps the devices of an instance in one `for_each` resource.
+	if opts.NameTemplate == DefaultNameTemplate {
+		nameTemplate = nil
+	}
+	provider, err := lookupProviderProfile(opts.AWSProvider)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Output != OutputState && !provider.importsAttachments {
+		return nil, fmt.Errorf("Version %v of the AWS provider can't import aws_volume_attachment resources, so the %v output needs version %v or later",
+			provider.name, opts.Output, minImportScriptAWSProvider)
+	}
+	c := &Converter{opts: opts, nameTemplate: nameTemplate, provider: provider}
+	if opts.Backend != nil {
+		if c.remote, err = newRemoteClient(opts.Backend); err != nil {
+			return nil, fmt.Errorf("Invalid config for %v: %v", opts.Backend, err)
+		}
+	}
+	return c, nil
+}
+
+// Where the state is, for messages.
+func (c *Converter) stateName() string {
+	if c.opts.Backend != nil {
+		return c.opts.Backend.String()
+	}
+	return c.opts.StatePath
+}
+
+func (c *Converter) readState() (*stateFile, error) {
+	if c.remote == nil {
+		return readStateFile(c.opts.StatePath)
+	}
+	data, err := c.remote.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the state from %v: %v", c.opts.Backend, err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("There's no state in %v", c.opts.Backend)
+	}
+	return parseStateFile(data, c.stateName())
+}
+
+// The Conversion, worked out in memory.
+type Plan struct {
+	// The changes to the state.
+	State *StatePlan
+	// The block devices converted. Empty when reverting.
+	Devices []BlockDevice
+	// The block devices converted already, by an earlier run or by hand,
+	// which are left alone.
+	Unchanged []BlockDevice
+	// The instances skipped with `SkipInvalid`, and why.
+	Skipped ValidationErrors
+	// Things worth knowing about the conversion that don't stop it, e.g. EC2
+	// values used over the state's.
+	Warnings []string
+
+	from      *stateFile
+	to        *stateFile
+	opts      configOptions
+	revertTo  string
+	instances map[string]Instance
+}
+
+// What applying a plan wrote. Paths are empty if they weren't written.
+type Result struct {
+	StatePath string
+	// The type of backend the new state was pushed to instead.
+	Backend string
+	// The copy of the input state kept when writing a new one.
+	BackupPath   string
+	ScriptPath   string
+	ManifestPath string
+	ConfigPath   string
+	// The files in `ConfigDir` rewritten in place.
+	RewrittenPaths []string
+	// Things worth knowing about what was written, e.g. config set by value
+	// rather than by reference.
+	Warnings []string
+}
+
+// Work out The Conversion, looking the instances in the state up in EC2.
+// Nothing is written. Problems with the instances are returned as
+// `ValidationErrors`, unless `SkipInvalid` is set.
+func (c *Converter) Plan() (*Plan, error) {
+	from, err := c.readState()
+	if err != nil {
+		return nil, err
+	}
+	if from.legacy != nil && c.opts.Output == OutputImportScript {
+		// Whatever `AWSProvider` says, Terraform 0.9 can't use a provider
+		// that imports attachments.
+		return nil, errors.New("The import script needs a version 4 state (Terraform 0.12 or later): the AWS provider for older Terraform can't import aws_volume_attachment resources")
+	}
+
+	plan := &Plan{from: from}
+	if c.opts.Revert {
+		plan.to, plan.revertTo, err = from.revert()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		query := InstanceQuery{
+			InstanceIDs:  from.instanceIDs(),
+			NamePatterns: c.opts.NamePatterns,
+			Tags:         c.opts.Tags,
+		}
+		instMap, err := getInstancesWithVolumes(c.opts.EC2, query)
+		if err != nil {
+			return nil, fmt.Errorf("ec2 failed: %v", err)
+		}
+
+		plan.instances = instMap
+		plan.opts = from.configOptions(c.opts.HCL2, c.nameTemplate, c.opts.SkipInvalid, (*warnings)(&plan.Warnings))
+		plan.opts.importBlocks = c.opts.Output == OutputImportBlocks
+		plan.opts.provider = c.provider
+		plan.to, plan.Devices, plan.Unchanged, plan.Skipped, err = from.convert(instMap, plan.opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	before, err := from.flatResources()
+	if err != nil {
+		return nil, err
+	}
+	after, err := plan.to.flatResources()
+	if err != nil {
+		return nil, err
+	}
+	plan.State = diffStates(before, after)
+	return plan, nil
+}
+
+// Write out a plan made by this converter.
+func (c *Converter) Apply(plan *Plan) (*Result, error) {
+	result := &Result{}
+	opts := plan.opts
+	opts.warnings = (*warnings)(&result.Warnings)
+	if c.opts.Revert {
+		if err := c.writeState(plan, result); err != nil {
+			return nil, err
+		}
+		if err := writeConfig(c.opts.ConfigOutPath, plan.revertTo); err != nil {
+			return nil, err
+		}
+		result.ConfigPath = c.opts.ConfigOutPath
+		return result, nil
+	}
+
+	// The config is rewritten first, in memory, since the state shouldn't be
+	// converted if it can't be.
+	var nc *newConfig
+	if c.opts.Output != OutputImportBlocks {
+		var err error
+		nc, err = makeNewConfig(c.opts.ConfigOutPath, c.opts.ConfigDir, plan.Devices, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch c.opts.Output {
+	case OutputState:
+		if err := c.writeState(plan, result); err != nil {
+			return nil, err
+		}
+	case OutputImportScript:
+		manifest := makeImportManifest(plan.Devices, plan.opts)
+		if err := manifest.write(c.opts.ImportScriptPath, c.stateName()); err != nil {
+			return nil, err
+		}
+		result.ScriptPath = c.opts.ImportScriptPath
+		result.ManifestPath = c.opts.ImportScriptPath + ".json"
+	case OutputImportBlocks:
+		config, err := genConfig(plan.Devices, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeConfig(c.opts.ConfigOutPath, config); err != nil {
+			return nil, err
+		}
+		result.ConfigPath = c.opts.ConfigOutPath
+		return result, nil
+	}
+
+	rewritten, wroteConfig, err := nc.write()
+	if err != nil {
+		return nil, err
+	}
+	result.RewrittenPaths = rewritten
+	if wroteConfig {
+		result.ConfigPath = c.opts.ConfigOutPath
+	}
+	return result, nil
+}
+
+// Write the plan's new state while holding the lock on the input, after
+// backing the input up, or push it to the backend.
+func (c *Converter) writeState(plan *Plan, result *Result) (err error) {
+	var unlock func() error
+	if c.remote != nil {
+		unlock, err = lockRemoteState(c.remote, c.opts.Backend, plan.from, (*warnings)(&result.Warnings))
+	} else {
+		unlock, err = lockState(c.opts.StatePath, plan.from)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); unlockErr != nil && err == nil {
+			err = fmt.Errorf("Could not unlock the state in %v: %v", c.stateName(), unlockErr)
+		}
+	}()
+
+	if c.remote != nil {
+		// Backed up to the working directory, like `terraform state`
+		// subcommands do with remote state.
+		if result.BackupPath, err = backupState(remoteBackupPath, plan.from); err != nil {
+			return err
+		}
+		data, err := plan.to.marshal(plan.from)
+		if err != nil {
+			return err
+		}
+		if err := c.remote.Put(data); err != nil {
+			return fmt.Errorf("Could not push the state to %v: %v", c.opts.Backend, err)
+		}
+		result.Backend = c.opts.Backend.Type
+		return nil
+	}
+
+	if result.BackupPath, err = backupState(c.opts.StatePath, plan.from); err != nil {
+		return err
+	}
+	if err := checkOutputLineage(c.opts.StateOutPath, plan.from); err != nil {
+		return err
+	}
+	if err := plan.to.write(c.opts.StateOutPath, plan.from); err != nil {
+		return err
+	}
+	result.StatePath = c.opts.StateOutPath
+	return nil
+}
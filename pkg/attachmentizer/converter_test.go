@@ -0,0 +1,179 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	ec2 "github.com/aws/aws-sdk-go/service/ec2"
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// An `EC2Interface` with fixed instances and volumes.
+type fakeEC2Source struct {
+	instances map[string]Instance
+	volumes   map[string]*ec2.Volume
+}
+
+func (f *fakeEC2Source) GetInstances(query InstanceQuery) (map[string]Instance, error) {
+	instMap := make(map[string]Instance)
+	for _, id := range query.InstanceIDs {
+		if inst, ok := f.instances[id]; ok {
+			instMap[id] = inst
+		}
+	}
+	return instMap, nil
+}
+
+func (f *fakeEC2Source) GetVolumes(volumeIDs []string) (map[string]*ec2.Volume, error) {
+	return f.volumes, nil
+}
+
+func testEC2Source() *fakeEC2Source {
+	return &fakeEC2Source{
+		instances: map[string]Instance{
+			"i-1d7683bd": {
+				ID: "i-1d7683bd",
+				BlockDevices: map[DeviceName]BlockDevice{
+					NewDeviceName("xvdb"): NewBlockDevice("i-1d7683bd", "us-east-1a", "/dev/xvdb", "v-abcd", false),
+				},
+			},
+		},
+		volumes: map[string]*ec2.Volume{
+			"v-abcd": {VolumeId: aws.String("v-abcd"), Size: aws.Int64(100), VolumeType: aws.String("gp2")},
+		},
+	}
+}
+
+func TestNewConverterOptions(t *testing.T) {
+	var testCases = []struct {
+		opts Options
+		err  string
+	}{
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source()}, ""},
+		{Options{StatePath: "in.tfstate", Revert: true}, ""},
+		{Options{StatePath: "in.tfstate"}, "EC2 is needed"},
+		{Options{EC2: testEC2Source()}, "A state file"},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), Output: OutputImportScript}, "needs a path"},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), Output: OutputImportScript, ImportScriptPath: "import.sh"}, "can't import aws_volume_attachment"},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), Output: OutputImportScript, ImportScriptPath: "import.sh", AWSProvider: "3.x"}, ""},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), Output: OutputImportBlocks}, "can't import aws_volume_attachment"},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), Output: OutputImportBlocks, AWSProvider: "5.x"}, ""},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), Output: OutputImportBlocks, ConfigDir: "."}, "in place"},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), Output: OutputImportScript, ImportScriptPath: "import.sh", AWSProvider: "3.x", ConfigDir: "."}, "in place"},
+		{Options{StatePath: "in.tfstate", Revert: true, Output: OutputImportBlocks}, "Reverting"},
+		{Options{StatePath: "in.tfstate", EC2: testEC2Source(), NameTemplate: "{{.Instance"}, "Invalid name template"},
+	}
+
+	for i, tt := range testCases {
+		_, err := NewConverter(tt.opts)
+		if tt.err == "" && err != nil {
+			t.Errorf("[%d] Unexpected error: %v", i, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("[%d] Expected an error with %q, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestConverterPlanAndApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "converter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "in.tfstate")
+	if err := ioutil.WriteFile(statePath, []byte(testV4State), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	converter, err := NewConverter(Options{
+		StatePath:     statePath,
+		EC2:           testEC2Source(),
+		StateOutPath:  filepath.Join(dir, "out.tfstate"),
+		ConfigOutPath: filepath.Join(dir, "config.tf"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := converter.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Devices) != 1 || plan.Devices[0].InstanceAddress() != "module.web.aws_instance.web[0]" {
+		t.Errorf("Expected the device of module.web.aws_instance.web[0] to be converted, got %+v", plan.Devices)
+	}
+	if len(plan.State.Instances) != 1 || len(plan.State.Instances[0].AddedResources) != 2 {
+		t.Errorf("Expected a volume and attachment to be added, got %v", plan.State)
+	}
+	// The state and EC2 differ in a couple of fields.
+	if len(plan.Warnings) == 0 || !strings.Contains(plan.Warnings[0], "using the EC2 value") {
+		t.Errorf("Expected warnings about the state and EC2 differing, got %q", plan.Warnings)
+	}
+
+	result, err := converter.Apply(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StatePath == "" || result.ConfigPath == "" {
+		t.Errorf("Expected the state and config to be written, got %+v", result)
+	}
+	// The instance's availability_zone isn't in the state to refer to.
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "no availability_zone") {
+		t.Errorf("Expected a warning about the availability_zone, got %q", result.Warnings)
+	}
+
+	newState, err := readV4State(result.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newState.Serial != 8 {
+		t.Errorf("Expected serial 8, got %v", newState.Serial)
+	}
+	config, err := ioutil.ReadFile(result.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), `resource "aws_ebs_volume" "web-xvdb-0"`) {
+		t.Errorf("Expected the volume in the config, got:\n%s", config)
+	}
+}
+
+// Terraform 0.9's provider can't import attachments, whichever provider is
+// asked for.
+func TestImportScriptNeedsV4State(t *testing.T) {
+	dir, err := ioutil.TempDir("", "converter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var legacy bytes.Buffer
+	if err := tf.WriteState(&tf.State{Version: 3, Serial: 1, Lineage: "3f1a8d0e-8c1b-4d1f-9c1e-7d2b8f0a1c2d"}, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(dir, "in.tfstate")
+	if err := ioutil.WriteFile(statePath, legacy.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	converter, err := NewConverter(Options{
+		StatePath:        statePath,
+		EC2:              testEC2Source(),
+		Output:           OutputImportScript,
+		ImportScriptPath: filepath.Join(dir, "import.sh"),
+		AWSProvider:      "3.x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := converter.Plan(); err == nil || !strings.Contains(err.Error(), "needs a version 4 state") {
+		t.Errorf("Expected the legacy state to be refused, got %v", err)
+	}
+}
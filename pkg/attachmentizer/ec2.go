@@ -0,0 +1,464 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	ec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	// "github.com/davecgh/go-spew/spew"
+)
+
+type volAtt struct {
+	name, instance, volume, device string
+}
+
+// Build a filter on the instance `Name` tags, matching any of the patterns. A
+// `*` wildcard is allowed.
+func nameFilter(instanceNamePatterns ...string) *ec2.Filter {
+	return tagFilter("Name", instanceNamePatterns...)
+}
+
+// Build a filter on an arbitrary instance tag, matching any of the patterns. A
+// `*` wildcard is allowed.
+func tagFilter(key string, valuePatterns ...string) *ec2.Filter {
+	return &ec2.Filter{
+		Name:   aws.String(fmt.Sprintf("tag:%s", key)),
+		Values: aws.StringSlice(valuePatterns),
+	}
+}
+
+// Build a filter matching any of the given instance IDs.
+func instanceIDFilter(instanceIDs []string) *ec2.Filter {
+	return &ec2.Filter{
+		Name:   aws.String("instance-id"),
+		Values: aws.StringSlice(instanceIDs),
+	}
+}
+
+// Build a filter matching any of the given volume IDs. Unlike passing
+// `VolumeIds`, this doesn't fail if one of them doesn't exist.
+func volumeIDFilter(volumeIDs []string) *ec2.Filter {
+	return &ec2.Filter{
+		Name:   aws.String("volume-id"),
+		Values: aws.StringSlice(volumeIDs),
+	}
+}
+
+// EC2 allows at most 200 values in a filter.
+const filterBatchSize = 200
+
+// Split IDs into batches that fit in a filter.
+func batchIDs(ids []string) [][]string {
+	var batches [][]string
+	for len(ids) > filterBatchSize {
+		batches = append(batches, ids[:filterBatchSize])
+		ids = ids[filterBatchSize:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
+// Which instances to get from EC2. Instances have to be one of the IDs, match
+// one of the name patterns if any are given, and match all the tags.
+type InstanceQuery struct {
+	InstanceIDs []string
+	// Optional. A `*` wildcard is allowed.
+	NamePatterns []string
+	// Tag keys to value patterns. A `*` wildcard is allowed.
+	Tags map[string]string
+}
+
+// Build the filters for the query other than the instance IDs.
+func (q InstanceQuery) filters() []*ec2.Filter {
+	var filters []*ec2.Filter
+	if len(q.NamePatterns) > 0 {
+		filters = append(filters, nameFilter(q.NamePatterns...))
+	}
+
+	var keys []string
+	for key := range q.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		filters = append(filters, tagFilter(key, q.Tags[key]))
+	}
+	return filters
+}
+
+// Parse tag filters given as `Key=Value`.
+func ParseTagFilters(tags []string) (map[string]string, error) {
+	tagMap := make(map[string]string)
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid tag filter %q, expected Key=Value", tag)
+		}
+		tagMap[parts[0]] = parts[1]
+	}
+	return tagMap, nil
+}
+
+type EC2Interface interface {
+	// Get the instances matching the query, keyed by their ID.
+	GetInstances(query InstanceQuery) (map[string]Instance, error)
+	// Get the volumes with the given IDs, keyed by their ID. Volumes that
+	// don't exist are left out.
+	GetVolumes(volumeIDs []string) (map[string]*ec2.Volume, error)
+}
+
+type EC2 struct {
+	svc ec2iface.EC2API
+	// The most queries to run at once. Less than 1 means 1.
+	concurrency int
+
+	mu     sync.Mutex
+	extras map[string]volumeExtras
+}
+
+// The attributes of a volume that are newer than the vendored SDK, so
+// `ec2.Volume` doesn't have them. The fields are named as in the CLI's
+// output, and tagged as in the API's.
+type volumeExtras struct {
+	Throughput         *int64  `xml:"throughput"`
+	MultiAttachEnabled *bool   `xml:"multiAttachEnabled"`
+	OutpostArn         *string `xml:"outpostArn"`
+}
+
+// Implemented by the `EC2Interface`s that can get a volume's `volumeExtras`
+// as well, for a volume they've got with `GetVolumes`.
+type volumeExtrasGetter interface {
+	volumeExtras(volumeID string) (volumeExtras, bool)
+}
+
+// Retry throttled queries this many times, waiting `throttleBaseDelay` before
+// the first retry and doubling it each time after.
+const maxThrottleRetries = 8
+
+var throttleBaseDelay = 500 * time.Millisecond
+
+// Run `fn`, retrying with exponential backoff (and some jitter, so concurrent
+// queries don't retry in lockstep) while EC2 throttles it.
+func retryOnThrottle(fn func() error) error {
+	delay := throttleBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !request.IsErrorThrottle(err) || attempt == maxThrottleRetries {
+			return err
+		}
+		jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		time.Sleep(delay/2 + jitter)
+		delay *= 2
+	}
+}
+
+// Get every page of the instances matching the filters.
+func (c *EC2) describeInstances(filters []*ec2.Filter) (map[string]Instance, error) {
+	params := &ec2.DescribeInstancesInput{Filters: filters}
+
+	var reservations []*ec2.Reservation
+	err := retryOnThrottle(func() error {
+		// Start over if a page was throttled part way through.
+		reservations = nil
+		return c.svc.DescribeInstancesPages(params, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			reservations = append(reservations, page.Reservations...)
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instancesFromReservations(reservations), nil
+}
+
+// Run `fn` on each batch of IDs, up to `c.concurrency` at once. Returns the
+// first error, if any.
+func (c *EC2) forEachBatch(ids []string, fn func(batch []string) error) error {
+	concurrency := c.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+
+	for _, batch := range batchIDs(ids) {
+		batch := batch
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(batch); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// Query each batch of instance IDs, running up to `c.concurrency` queries at
+// once.
+func (c *EC2) GetInstances(query InstanceQuery) (map[string]Instance, error) {
+	var mu sync.Mutex
+	instMap := make(map[string]Instance)
+
+	err := c.forEachBatch(query.InstanceIDs, func(batch []string) error {
+		batchMap, err := c.describeInstances(append(query.filters(), instanceIDFilter(batch)))
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for id, inst := range batchMap {
+			instMap[id] = inst
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instMap, nil
+}
+
+// Query each batch of volume IDs, running up to `c.concurrency` queries at
+// once.
+func (c *EC2) GetVolumes(volumeIDs []string) (map[string]*ec2.Volume, error) {
+	var mu sync.Mutex
+	volumes := make(map[string]*ec2.Volume)
+
+	err := c.forEachBatch(volumeIDs, func(batch []string) error {
+		params := &ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{volumeIDFilter(batch)},
+		}
+
+		var batchVolumes []*ec2.Volume
+		err := retryOnThrottle(func() error {
+			batchVolumes = nil
+			return c.svc.DescribeVolumesPagesWithContext(aws.BackgroundContext(), params, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+				batchVolumes = append(batchVolumes, page.Volumes...)
+				return true
+			}, c.readVolumeExtras)
+		})
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, vol := range batchVolumes {
+			volumes[*vol.VolumeId] = vol
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// A request option reading the `volumeExtras` of the volumes in a
+// `DescribeVolumes` response, before the SDK unmarshals it without them.
+func (c *EC2) readVolumeExtras(r *request.Request) {
+	r.Handlers.Unmarshal.PushFront(func(r *request.Request) {
+		body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+		r.HTTPResponse.Body.Close()
+		// Put the body back for the SDK, which reports any error reading it.
+		r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+
+		var resp struct {
+			Volumes []struct {
+				VolumeID string `xml:"volumeId"`
+				volumeExtras
+			} `xml:"volumeSet>item"`
+		}
+		if err := xml.Unmarshal(body, &resp); err != nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.extras == nil {
+			c.extras = make(map[string]volumeExtras)
+		}
+		for _, vol := range resp.Volumes {
+			c.extras[vol.VolumeID] = vol.volumeExtras
+		}
+	})
+}
+
+func (c *EC2) volumeExtras(volumeID string) (volumeExtras, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	extras, ok := c.extras[volumeID]
+	return extras, ok
+}
+
+// Build the `InstanceDeviceMap` from the reservations `DescribeInstances`
+// returns.
+func instancesFromReservations(reservations []*ec2.Reservation) map[string]Instance {
+	instMap := make(map[string]Instance)
+	for _, resv := range reservations {
+		for _, instance := range resv.Instances {
+			id := *instance.InstanceId
+			devMap := make(map[DeviceName]BlockDevice)
+			for _, blkDev := range instance.BlockDeviceMappings {
+				if blkDev.Ebs == nil {
+					// Instance store volumes don't have anything to convert.
+					continue
+				}
+				devMap[NewDeviceName(*blkDev.DeviceName)] = NewBlockDevice(id, *instance.Placement.AvailabilityZone,
+					*blkDev.DeviceName, *blkDev.Ebs.VolumeId, *blkDev.Ebs.DeleteOnTermination)
+			}
+			tags := make(map[string]string)
+			for _, tag := range instance.Tags {
+				if tag.Key != nil && tag.Value != nil {
+					tags[*tag.Key] = *tag.Value
+				}
+			}
+			instMap[id] = Instance{ID: id, BlockDevices: devMap, Tags: tags}
+		}
+	}
+	return instMap
+}
+
+// Look up the volumes of all the instances' block devices, and fill in their
+// attributes from them.
+func addVolumeAttributes(c EC2Interface, instMap map[string]Instance) error {
+	var volumeIDs []string
+	for _, inst := range instMap {
+		for _, dev := range inst.BlockDevices {
+			volumeIDs = append(volumeIDs, dev.volumeID)
+		}
+	}
+	sort.Strings(volumeIDs)
+
+	volumes, err := c.GetVolumes(volumeIDs)
+	if err != nil {
+		return err
+	}
+
+	getter, _ := c.(volumeExtrasGetter)
+	for _, inst := range instMap {
+		for name, dev := range inst.BlockDevices {
+			vol, ok := volumes[dev.volumeID]
+			if !ok {
+				continue
+			}
+			dev = blockDeviceWithVolume(dev, vol)
+			if getter != nil {
+				if extras, ok := getter.volumeExtras(dev.volumeID); ok {
+					dev = blockDeviceWithVolumeExtras(dev, extras)
+				}
+			}
+			inst.BlockDevices[name] = dev
+		}
+	}
+	return nil
+}
+
+// Get the instances matching the query along with their volumes.
+func getInstancesWithVolumes(c EC2Interface, query InstanceQuery) (map[string]Instance, error) {
+	instMap, err := c.GetInstances(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := addVolumeAttributes(c, instMap); err != nil {
+		return nil, err
+	}
+	return instMap, nil
+}
+
+// Connect to EC2 in a region, running up to `concurrency` queries at once.
+func NewEC2(region string, concurrency int) (*EC2, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &EC2{
+		svc:         ec2.New(sess, &aws.Config{Region: aws.String(region)}),
+		concurrency: concurrency,
+	}, nil
+}
+
+// Connect to EC2 and create the `InstanceDeviceMap` for instances matching the
+// query, running up to `concurrency` queries at once.
+func GetEC2AWSState(query InstanceQuery, availabilityZone string, concurrency int) (map[string]Instance, error) {
+	ec2, err := NewEC2(availabilityZone, concurrency)
+	if err != nil {
+		return nil, err
+	}
+	return getInstancesWithVolumes(ec2, query)
+}
+
+// Fill in the attributes of a block device from its volume.
+func blockDeviceWithVolume(dev BlockDevice, vol *ec2.Volume) BlockDevice {
+	if vol.Size != nil {
+		dev.size = int(*vol.Size)
+	}
+	if vol.VolumeType != nil {
+		dev.volumeType = *vol.VolumeType
+	}
+	if vol.Iops != nil {
+		dev.iops = int(*vol.Iops)
+	}
+	if vol.Encrypted != nil {
+		dev.encrypted = strconv.FormatBool(*vol.Encrypted)
+	}
+	if vol.SnapshotId != nil {
+		dev.snapshotId = *vol.SnapshotId
+	}
+	if vol.KmsKeyId != nil {
+		dev.kmsKeyID = *vol.KmsKeyId
+	}
+	if len(vol.Tags) > 0 {
+		dev.tags = make(map[string]string)
+		for _, tag := range vol.Tags {
+			dev.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	return dev
+}
+
+// Fill in the attributes of a block device from its volume's `volumeExtras`.
+func blockDeviceWithVolumeExtras(dev BlockDevice, extras volumeExtras) BlockDevice {
+	if extras.Throughput != nil {
+		dev.throughput = int(*extras.Throughput)
+	}
+	if extras.MultiAttachEnabled != nil {
+		dev.multiAttachEnabled = strconv.FormatBool(*extras.MultiAttachEnabled)
+	}
+	if extras.OutpostArn != nil {
+		dev.outpostArn = *extras.OutpostArn
+	}
+	return dev
+}
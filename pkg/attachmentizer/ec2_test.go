@@ -0,0 +1,132 @@
+package attachmentizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	ec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Returns one page per instance ID in the filter, throttling the first call.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	mu        sync.Mutex
+	calls     int
+	throttled bool
+}
+
+func (f *fakeEC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	f.mu.Lock()
+	f.calls++
+	if !f.throttled {
+		f.throttled = true
+		f.mu.Unlock()
+		return awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+	}
+	f.mu.Unlock()
+
+	var ids []*string
+	for _, filter := range input.Filters {
+		if *filter.Name == "instance-id" {
+			ids = filter.Values
+		}
+	}
+	for i, id := range ids {
+		page := &ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{{
+				Instances: []*ec2.Instance{{
+					InstanceId: id,
+					Placement:  &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+				}},
+			}},
+		}
+		if !fn(page, i == len(ids)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestEC2GetInstances(t *testing.T) {
+	defer func(delay time.Duration) { throttleBaseDelay = delay }(throttleBaseDelay)
+	throttleBaseDelay = time.Millisecond
+
+	var ids []string
+	for i := 0; i < 450; i++ {
+		ids = append(ids, fmt.Sprintf("i-%08x", i))
+	}
+
+	fake := &fakeEC2{}
+	client := &EC2{svc: fake, concurrency: 2}
+	instMap, err := client.GetInstances(InstanceQuery{InstanceIDs: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instMap) != len(ids) {
+		t.Errorf("Expected %d instances across all pages, got %d", len(ids), len(instMap))
+	}
+	// Three batches, plus one retry.
+	if fake.calls != 4 {
+		t.Errorf("Expected 4 calls, got %d", fake.calls)
+	}
+}
+
+func TestEC2ReadVolumeExtras(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<DescribeVolumesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+    <volumeSet>
+        <item>
+            <volumeId>v-abcd</volumeId>
+            <size>100</size>
+            <volumeType>gp3</volumeType>
+            <throughput>250</throughput>
+            <multiAttachEnabled>true</multiAttachEnabled>
+            <attachmentSet>
+                <item><volumeId>v-abcd</volumeId><device>/dev/xvdb</device></item>
+            </attachmentSet>
+        </item>
+        <item>
+            <volumeId>v-ef01</volumeId>
+            <size>8</size>
+            <volumeType>gp2</volumeType>
+        </item>
+    </volumeSet>
+</DescribeVolumesResponse>`
+	r := &request.Request{HTTPResponse: &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}}
+	client := &EC2{}
+	client.readVolumeExtras(r)
+	r.Handlers.Unmarshal.Run(r)
+
+	// The SDK can still read the body afterwards.
+	if rest, _ := ioutil.ReadAll(r.HTTPResponse.Body); string(rest) != body {
+		t.Errorf("Expected the body to be left for the SDK, got %q", rest)
+	}
+
+	dev := blockDeviceWithVolumeExtras(BlockDevice{}, mustVolumeExtras(t, client, "v-abcd"))
+	if dev.throughput != 250 || dev.multiAttachEnabled != "true" || dev.outpostArn != "" {
+		t.Errorf("Expected 250 throughput and Multi-Attach, got %+v", dev)
+	}
+	dev = blockDeviceWithVolumeExtras(BlockDevice{}, mustVolumeExtras(t, client, "v-ef01"))
+	if dev.throughput != 0 || dev.multiAttachEnabled != "" {
+		t.Errorf("Expected no extras, got %+v", dev)
+	}
+}
+
+func mustVolumeExtras(t *testing.T, client *EC2, volumeID string) volumeExtras {
+	extras, ok := client.volumeExtras(volumeID)
+	if !ok {
+		t.Fatalf("Expected extras for %v", volumeID)
+	}
+	return extras
+}
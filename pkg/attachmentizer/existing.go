@@ -0,0 +1,106 @@
+package attachmentizer
+
+// This file finds the volumes and attachments already in a state, so that
+// devices converted by an earlier run (or by hand) are left alone rather than
+// given a second owner, and running the tool again changes nothing.
+
+import (
+	"encoding/json"
+	"fmt"
+
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// The `aws_ebs_volume`s and `aws_volume_attachment`s in a state, in every
+// module, and the addresses of all its resources.
+type existingResources struct {
+	// The addresses of the volumes, keyed by volume ID.
+	volumes map[string]string
+	// The addresses of the attachments, keyed by attachment ID, which is
+	// derived from the device, instance and volume.
+	attachments map[string]string
+	// The IDs of all the resources, keyed by address.
+	addresses map[string]string
+}
+
+func newExistingResources() *existingResources {
+	return &existingResources{
+		volumes:     make(map[string]string),
+		attachments: make(map[string]string),
+		addresses:   make(map[string]string),
+	}
+}
+
+func (e *existingResources) add(resourceType string, addr string, id string) {
+	e.addresses[addr] = id
+	switch resourceType {
+	case "aws_ebs_volume":
+		e.volumes[id] = addr
+	case "aws_volume_attachment":
+		e.attachments[id] = addr
+	}
+}
+
+func legacyExistingResources(state *tf.State) *existingResources {
+	e := newExistingResources()
+	for _, module := range state.Modules {
+		for key, res := range module.Resources {
+			if res.Primary != nil {
+				e.add(res.Type, legacyAddress(module.Path, key), res.Primary.ID)
+			}
+		}
+	}
+	return e
+}
+
+func v4ExistingResources(state *stateV4) (*existingResources, error) {
+	e := newExistingResources()
+	for _, res := range state.Resources {
+		if res.Mode != "managed" {
+			continue
+		}
+		for _, inst := range res.Instances {
+			if inst.Deposed != "" {
+				continue
+			}
+			name, err := v4TerraformName(res, inst)
+			if err != nil {
+				return nil, err
+			}
+			var id struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(inst.Attributes, &id); err != nil {
+				return nil, fmt.Errorf("Could not read attributes of %v: %v", name.Address(), err)
+			}
+			e.add(res.Type, moduleAddressPrefix(v4ModulePath(res.Module))+name.Address(), id.ID)
+		}
+	}
+	return e, nil
+}
+
+// Check a device against the resources already in the state. Returns whether
+// it's already converted: its volume is managed by an `aws_ebs_volume` and
+// attached to its instance by an `aws_volume_attachment`. It's a conflict if
+// only one of those is in the state, or if either of its new resources would
+// take an address that's already used.
+func (e *existingResources) check(dev BlockDevice, opts configOptions) (bool, error) {
+	volumeAddr, volumeManaged := e.volumes[dev.volumeID]
+	attachmentAddr, attached := e.attachments[dev.volumeAttachmentID()]
+	switch {
+	case volumeManaged && attached:
+		return true, nil
+	case volumeManaged:
+		return false, fmt.Errorf("has its volume %v managed by %v already, but not attached to the instance by an aws_volume_attachment", dev.volumeID, volumeAddr)
+	case attached:
+		return false, fmt.Errorf("is attached by %v already, but its volume %v isn't managed by an aws_ebs_volume", attachmentAddr, dev.volumeID)
+	}
+
+	for _, resourceType := range []string{"aws_ebs_volume", "aws_volume_attachment"} {
+		addr := dev.resourceAddress(resourceType, opts)
+		if id, ok := e.addresses[addr]; ok {
+			return false, fmt.Errorf("would be converted to %v, which is already in the state with ID %v", addr, id)
+		}
+	}
+	return false, nil
+}
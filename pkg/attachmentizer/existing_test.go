@@ -0,0 +1,190 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// Convert a state and serialize the result.
+func convertAndMarshal(t *testing.T, state *stateFile) ([]byte, []BlockDevice, []BlockDevice) {
+	newState, newDevs, unchanged, _, err := state.convert(testEC2Source().instances, configOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := newState.marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, newDevs, unchanged
+}
+
+func TestRerunV4(t *testing.T) {
+	original, err := parseStateFile([]byte(testV4State), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, newDevs, _ := convertAndMarshal(t, original)
+	if len(newDevs) != 1 {
+		t.Fatalf("Expected a device to be converted, got %v", newDevs)
+	}
+
+	// Running again on the result changes nothing, not even the serial.
+	state, err := parseStateFile(converted, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, newDevs, _ := convertAndMarshal(t, state)
+	if len(newDevs) != 0 || !bytes.Equal(again, converted) {
+		t.Errorf("Expected running again to change nothing, got %v and:\n%s", newDevs, again)
+	}
+
+	// Nor does it once a refresh has put the `ebs_block_device` back on the
+	// instance, which now has a volume with two owners.
+	for _, res := range state.v4.Resources {
+		if res.Type == "aws_instance" {
+			res.Instances[0].Attributes = original.v4.Resources[0].Instances[0].Attributes
+		}
+	}
+	refreshed, err := state.v4.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = parseStateFile(refreshed, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, newDevs, unchanged := convertAndMarshal(t, state)
+	if len(newDevs) != 0 || len(unchanged) != 1 || unchanged[0].volumeID != "v-abcd" {
+		t.Errorf("Expected the device to be left alone as already converted, got %v and %v", newDevs, unchanged)
+	}
+	if !bytes.Equal(again, refreshed) {
+		t.Errorf("Expected the refreshed state to be left as it was, got:\n%s", again)
+	}
+}
+
+func TestRerunLegacy(t *testing.T) {
+	instanceAttrs := map[string]string{
+		"id":                 "i-1d7683bd",
+		"ebs_block_device.#": "1",
+		"ebs_block_device.2576023345.delete_on_termination": "false",
+		"ebs_block_device.2576023345.device_name":           "/dev/xvdb",
+		"ebs_block_device.2576023345.encrypted":             "false",
+		"ebs_block_device.2576023345.iops":                  "300",
+		"ebs_block_device.2576023345.snapshot_id":           "",
+		"ebs_block_device.2576023345.volume_size":           "100",
+		"ebs_block_device.2576023345.volume_type":           "gp2",
+	}
+	state := &stateFile{legacy: &tf.State{
+		Version: 3,
+		Serial:  4,
+		Lineage: "3f1a8d0e-8c1b-4d1f-9c1e-7d2b8f0a1c2d",
+		Modules: []*tf.ModuleState{{
+			Path: []string{"root"},
+			Resources: map[string]*tf.ResourceState{
+				"aws_instance.web.0": {
+					Type:    "aws_instance",
+					Primary: &tf.InstanceState{ID: "i-1d7683bd", Attributes: instanceAttrs},
+				},
+			},
+		}},
+	}}
+	converted, newDevs, _ := convertAndMarshal(t, state)
+	if len(newDevs) != 1 {
+		t.Fatalf("Expected a device to be converted, got %v", newDevs)
+	}
+
+	// Running again on the result changes nothing, not even the serial.
+	state, err := parseStateFile(converted, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, newDevs, _ := convertAndMarshal(t, state)
+	if len(newDevs) != 0 || !bytes.Equal(again, converted) {
+		t.Errorf("Expected running again to change nothing, got %v and:\n%s", newDevs, again)
+	}
+
+	// Nor does it without the count, which older versions removed too.
+	attrs := state.legacy.Modules[0].Resources["aws_instance.web.0"].Primary.Attributes
+	delete(attrs, "ebs_block_device.#")
+	if _, newDevs, _ := convertAndMarshal(t, state); len(newDevs) != 0 {
+		t.Errorf("Expected no devices to convert, got %v", newDevs)
+	}
+
+	// Refreshed, with the `ebs_block_device` back on the instance.
+	for k, v := range instanceAttrs {
+		attrs[k] = v
+	}
+	var refreshed bytes.Buffer
+	if err := tf.WriteState(state.legacy, &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	state, err = parseStateFile(refreshed.Bytes(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, newDevs, unchanged := convertAndMarshal(t, state)
+	if len(newDevs) != 0 || len(unchanged) != 1 {
+		t.Errorf("Expected the device to be left alone as already converted, got %v and %v", newDevs, unchanged)
+	}
+	if !bytes.Equal(again, refreshed.Bytes()) {
+		t.Errorf("Expected the state to be left as it was, got:\n%s", again)
+	}
+}
+
+func TestExistingResourceConflicts(t *testing.T) {
+	var testCases = []struct {
+		res     *resourceV4
+		problem string
+	}{
+		// Someone already made a resource for the volume, but not its attachment.
+		{
+			&resourceV4{Mode: "managed", Type: "aws_ebs_volume", Name: "data"},
+			"has its volume v-abcd managed by aws_ebs_volume.data already",
+		},
+		// Or just the attachment.
+		{
+			&resourceV4{Mode: "managed", Type: "aws_volume_attachment", Name: "data"},
+			"is attached by aws_volume_attachment.data already",
+		},
+		// Or something else has the name the new volume would get.
+		{
+			&resourceV4{Module: "module.web", Mode: "managed", Type: "aws_ebs_volume", Name: "web-xvdb", Each: "list"},
+			"would be converted to module.web.aws_ebs_volume.web-xvdb[0], which is already in the state with ID v-other",
+		},
+	}
+
+	dev := testEC2Source().instances["i-1d7683bd"].BlockDevices[NewDeviceName("xvdb")]
+	ids := map[string]string{
+		"data":     "v-abcd",
+		"web-xvdb": "v-other",
+	}
+	for i, tt := range testCases {
+		state, err := parseV4State([]byte(testV4State))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := ids[tt.res.Name]
+		if tt.res.Type == "aws_volume_attachment" {
+			id = dev.volumeAttachmentID()
+		}
+		attrs, _ := json.Marshal(map[string]string{"id": id})
+		tt.res.Instances = []*instanceV4{{IndexKey: json.Number("0"), Attributes: attrs}}
+		if tt.res.Each == "" {
+			tt.res.Instances[0].IndexKey = nil
+		}
+		state.Resources = append(state.Resources, tt.res)
+
+		_, newDevs, _, errs, err := generateNewV4State(state, testEC2Source().instances, configOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(newDevs) != 0 || len(errs) != 1 || !strings.Contains(errs[0].Problem, tt.problem) {
+			t.Errorf("[%d] Expected a conflict with %q, got %v and %v", i, tt.problem, newDevs, errs)
+		}
+	}
+}
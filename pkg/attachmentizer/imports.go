@@ -0,0 +1,97 @@
+package attachmentizer
+
+// This file handles migrating through Terraform itself rather than by editing
+// the state: either a script of `terraform import` commands for the new
+// resources, and a manifest of the same for tooling, or Terraform 1.5+
+// `import` blocks in the config.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// The imports that adopt the converted devices' volumes and attachments.
+type ImportManifest struct {
+	Imports []*ResourceImport `json:"imports"`
+}
+
+type ResourceImport struct {
+	Address string `json:"address"`
+	ID      string `json:"id"`
+	// The instance and device the resource was split out of.
+	Instance string `json:"instance"`
+	Device   string `json:"device"`
+}
+
+// Make the imports for the converted devices, ordered by address.
+func makeImportManifest(devs []BlockDevice, opts configOptions) *ImportManifest {
+	manifest := &ImportManifest{Imports: []*ResourceImport{}}
+	for _, dev := range devs {
+		instance := dev.InstanceAddress()
+
+		manifest.Imports = append(manifest.Imports,
+			&ResourceImport{
+				Address:  dev.resourceAddress("aws_ebs_volume", opts),
+				ID:       dev.volumeID,
+				Instance: instance,
+				Device:   dev.deviceName.LongName(),
+			},
+			&ResourceImport{
+				Address:  dev.resourceAddress("aws_volume_attachment", opts),
+				ID:       dev.volumeAttachmentImportID(),
+				Instance: instance,
+				Device:   dev.deviceName.LongName(),
+			})
+	}
+
+	sort.SliceStable(manifest.Imports, func(i, j int) bool {
+		return manifest.Imports[i].Address < manifest.Imports[j].Address
+	})
+	return manifest
+}
+
+// Quote a string for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Render the manifest as a shell script. Run with `rollback`, it removes the
+// imported resources from the state again.
+func (m *ImportManifest) script(stateFilePath string) string {
+	var buf bytes.Buffer
+	buf.WriteString("#!/bin/sh\n")
+	buf.WriteString(fmt.Sprintf("# Generated by terraform-ebs-attachmentizer from %s.\n", stateFilePath))
+	buf.WriteString("#\n")
+	buf.WriteString("# Imports the EBS volumes and attachments split out of ebs_block_device\n")
+	buf.WriteString("# blocks. Put the generated config in place before running this. Run it\n")
+	buf.WriteString("# with `rollback` to remove them from the state again.\n")
+	buf.WriteString("set -e\n\n")
+
+	buf.WriteString("if [ \"$1\" = \"rollback\" ]; then\n")
+	for _, imp := range m.Imports {
+		buf.WriteString(fmt.Sprintf("  terraform state rm %s\n", shellQuote(imp.Address)))
+	}
+	buf.WriteString("  exit 0\nfi\n\n")
+
+	for _, imp := range m.Imports {
+		buf.WriteString(fmt.Sprintf("terraform import %s %s\n", shellQuote(imp.Address), shellQuote(imp.ID)))
+	}
+	return buf.String()
+}
+
+// Write the script of imports, and the manifest of them next to it with
+// `.json` added.
+func (m *ImportManifest) write(scriptPath string, stateFilePath string) error {
+	if err := ioutil.WriteFile(scriptPath, []byte(m.script(stateFilePath)), 0755); err != nil {
+		return err
+	}
+	manifestJSON, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(scriptPath+".json", append(manifestJSON, '\n'), 0644)
+}
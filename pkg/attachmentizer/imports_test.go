@@ -0,0 +1,41 @@
+package attachmentizer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMakeImportManifest(t *testing.T) {
+	devs := []BlockDevice{
+		{
+			volumeID:        "vol-abcd",
+			deviceName:      NewDeviceName("xvdb"),
+			instanceID:      "i-1d7683bd",
+			instanceResName: &TerraformName{"aws_instance", "web", 1, ""},
+			modulePath:      []string{"root", "web"},
+		},
+	}
+
+	expected := []*ResourceImport{
+		{"module.web.aws_ebs_volume.web-xvdb[1]", "vol-abcd", "module.web.aws_instance.web[1]", "/dev/xvdb"},
+		{"module.web.aws_volume_attachment.web-xvdb[1]", "/dev/xvdb:vol-abcd:i-1d7683bd", "module.web.aws_instance.web[1]", "/dev/xvdb"},
+	}
+	manifest := makeImportManifest(devs, configOptions{})
+	if !reflect.DeepEqual(manifest.Imports, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, manifest.Imports)
+	}
+
+	// With `for_each`, the addresses have keys, which need quoting.
+	manifest = makeImportManifest(devs, configOptions{hcl2: true, forEach: true})
+	script := manifest.script("terraform.tfstate")
+	for _, line := range []string{
+		`terraform import 'module.web.aws_ebs_volume.web-xvdb["1"]' 'vol-abcd'`,
+		`terraform import 'module.web.aws_volume_attachment.web-xvdb["1"]' '/dev/xvdb:vol-abcd:i-1d7683bd'`,
+		`  terraform state rm 'module.web.aws_ebs_volume.web-xvdb["1"]'`,
+	} {
+		if !strings.Contains(script, line+"\n") {
+			t.Errorf("Expected the script to contain %q, got:\n%s", line, script)
+		}
+	}
+}
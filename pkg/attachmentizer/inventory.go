@@ -0,0 +1,172 @@
+package attachmentizer
+
+// This file handles reading EC2 data from files saved from the AWS CLI, so the
+// conversion can be run (and reproduced) without access to AWS.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	ec2 "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// An `EC2Interface` backed by the output of `aws ec2 describe-instances`, and
+// optionally `aws ec2 describe-volumes`.
+type EC2Inventory struct {
+	reservations []*ec2.Reservation
+	// Keyed by volume ID. Empty if no `describe-volumes` output was given.
+	volumes map[string]*ec2.Volume
+	extras  map[string]volumeExtras
+}
+
+// Load an inventory from the JSON output of the AWS CLI. `volumesPath` may be
+// empty.
+func LoadEC2Inventory(instancesPath string, volumesPath string) (*EC2Inventory, error) {
+	data, err := ioutil.ReadFile(instancesPath)
+	if err != nil {
+		return nil, err
+	}
+	// The CLI output uses the same field names as the SDK's types.
+	var instances ec2.DescribeInstancesOutput
+	if err := json.Unmarshal(data, &instances); err != nil {
+		return nil, err
+	}
+
+	inv := &EC2Inventory{
+		reservations: instances.Reservations,
+		volumes:      make(map[string]*ec2.Volume),
+		extras:       make(map[string]volumeExtras),
+	}
+	if volumesPath == "" {
+		return inv, nil
+	}
+
+	data, err = ioutil.ReadFile(volumesPath)
+	if err != nil {
+		return nil, err
+	}
+	var volumes ec2.DescribeVolumesOutput
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return nil, err
+	}
+	for _, vol := range volumes.Volumes {
+		inv.volumes[*vol.VolumeId] = vol
+	}
+	// And again for what the SDK's types don't have.
+	var extras struct {
+		Volumes []struct {
+			VolumeId string
+			volumeExtras
+		}
+	}
+	if err := json.Unmarshal(data, &extras); err != nil {
+		return nil, err
+	}
+	for _, vol := range extras.Volumes {
+		inv.extras[vol.VolumeId] = vol.volumeExtras
+	}
+	return inv, nil
+}
+
+// Build a regexp matching what an EC2 filter value matches: `*` is any number
+// of characters, and `?` is exactly one.
+func filterPatternRegexp(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.Replace(quoted, `\*`, ".*", -1)
+	quoted = strings.Replace(quoted, `\?`, ".", -1)
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+// Get the value of an instance's tag, if it has one.
+func instanceTag(instance *ec2.Instance, key string) (string, bool) {
+	for _, tag := range instance.Tags {
+		if tag.Key != nil && *tag.Key == key && tag.Value != nil {
+			return *tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// Check whether an instance matches the query, the same way the filters do for
+// a live query.
+func (q InstanceQuery) matches(instance *ec2.Instance) bool {
+	found := false
+	for _, id := range q.InstanceIDs {
+		if instance.InstanceId != nil && *instance.InstanceId == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	if len(q.NamePatterns) > 0 && !tagMatchesAny(instance, "Name", q.NamePatterns) {
+		return false
+	}
+	for key, pattern := range q.Tags {
+		if !tagMatchesAny(instance, key, []string{pattern}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether an instance has the tag with a value matching any of the
+// patterns.
+func tagMatchesAny(instance *ec2.Instance, key string, patterns []string) bool {
+	value, ok := instanceTag(instance, key)
+	if !ok {
+		return false
+	}
+	for _, pattern := range patterns {
+		if filterPatternRegexp(pattern).MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the instances matching the query.
+func (c *EC2Inventory) GetInstances(query InstanceQuery) (map[string]Instance, error) {
+	var matching []*ec2.Reservation
+	for _, resv := range c.reservations {
+		var instances []*ec2.Instance
+		for _, instance := range resv.Instances {
+			if query.matches(instance) {
+				instances = append(instances, instance)
+			}
+		}
+		matching = append(matching, &ec2.Reservation{Instances: instances})
+	}
+
+	return instancesFromReservations(matching), nil
+}
+
+// Get the volumes with the given IDs from the `describe-volumes` output.
+func (c *EC2Inventory) GetVolumes(volumeIDs []string) (map[string]*ec2.Volume, error) {
+	volumes := make(map[string]*ec2.Volume)
+	for _, id := range volumeIDs {
+		if vol, ok := c.volumes[id]; ok {
+			volumes[id] = vol
+		}
+	}
+	return volumes, nil
+}
+
+func (c *EC2Inventory) volumeExtras(volumeID string) (volumeExtras, bool) {
+	extras, ok := c.extras[volumeID]
+	return extras, ok
+}
+
+// Get the `InstanceDeviceMap` for instances matching the query from saved
+// `describe-instances` and `describe-volumes` output.
+func GetEC2InventoryState(query InstanceQuery, instancesPath string, volumesPath string) (map[string]Instance, error) {
+	inv, err := LoadEC2Inventory(instancesPath, volumesPath)
+	if err != nil {
+		return nil, err
+	}
+	return getInstancesWithVolumes(inv, query)
+}
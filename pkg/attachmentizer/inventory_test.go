@@ -0,0 +1,147 @@
+package attachmentizer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ec2 "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const testDescribeInstances = `{
+    "Reservations": [
+        {
+            "Instances": [
+                {
+                    "InstanceId": "i-1d7683bd",
+                    "LaunchTime": "2017-06-01T12:00:00+00:00",
+                    "Placement": {"AvailabilityZone": "us-east-1a"},
+                    "BlockDeviceMappings": [
+                        {
+                            "DeviceName": "/dev/xvdb",
+                            "Ebs": {"DeleteOnTermination": false, "Status": "attached", "VolumeId": "v-abcd"}
+                        }
+                    ],
+                    "Tags": [{"Key": "Name", "Value": "web-1"}]
+                },
+                {
+                    "InstanceId": "i-2e8794ce",
+                    "Placement": {"AvailabilityZone": "us-east-1b"},
+                    "Tags": [{"Key": "Name", "Value": "db-1"}]
+                }
+            ]
+        }
+    ]
+}`
+
+const testDescribeVolumes = `{
+    "Volumes": [
+        {
+            "VolumeId": "v-abcd",
+            "Size": 100,
+            "VolumeType": "gp2",
+            "Iops": 300,
+            "Encrypted": true,
+            "KmsKeyId": "arn:aws:kms:us-east-1:123456789012:key/abcd",
+            "SnapshotId": "",
+            "AvailabilityZone": "us-east-1a",
+            "Throughput": 125,
+            "MultiAttachEnabled": false,
+            "Tags": [{"Key": "Name", "Value": "web-1-data"}]
+        }
+    ]
+}`
+
+func TestFilterPatternRegexp(t *testing.T) {
+	var testCases = []struct {
+		pattern, name string
+		out           bool
+	}{
+		{"web-*", "web-1", true},
+		{"web-*", "db-1", false},
+		{"web-?", "web-12", false},
+		{"web.1", "webx1", false},
+		{"web-1", "web-1", true},
+	}
+
+	for _, tt := range testCases {
+		actual := filterPatternRegexp(tt.pattern).MatchString(tt.name)
+		if actual != tt.out {
+			t.Errorf("Expected %q matching %q to be %t, got %t", tt.pattern, tt.name, tt.out, actual)
+		}
+	}
+}
+
+func TestEC2InventoryGetInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	instancesPath := filepath.Join(dir, "instances.json")
+	volumesPath := filepath.Join(dir, "volumes.json")
+	ioutil.WriteFile(instancesPath, []byte(testDescribeInstances), 0644)
+	ioutil.WriteFile(volumesPath, []byte(testDescribeVolumes), 0644)
+
+	query := InstanceQuery{
+		InstanceIDs:  []string{"i-1d7683bd", "i-2e8794ce"},
+		NamePatterns: []string{"web-*"},
+	}
+	instMap, err := GetEC2InventoryState(query, instancesPath, volumesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instMap) != 1 {
+		t.Fatalf("Expected 1 instance, got %v", instMap)
+	}
+
+	dev := instMap["i-1d7683bd"].BlockDevices[NewDeviceName("xvdb")]
+	expected := BlockDevice{
+		volumeID:            "v-abcd",
+		size:                100,
+		volumeType:          "gp2",
+		deleteOnTermination: "false",
+		deviceName:          NewDeviceName("xvdb"),
+		encrypted:           "true",
+		iops:                300,
+		kmsKeyID:            "arn:aws:kms:us-east-1:123456789012:key/abcd",
+		tags:                map[string]string{"Name": "web-1-data"},
+		throughput:          125,
+		multiAttachEnabled:  "false",
+		instanceID:          "i-1d7683bd",
+		availabilityZone:    "us-east-1a",
+	}
+	if !reflect.DeepEqual(dev, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, dev)
+	}
+}
+
+func TestInstanceQueryMatches(t *testing.T) {
+	var instances ec2.DescribeInstancesOutput
+	if err := json.Unmarshal([]byte(testDescribeInstances), &instances); err != nil {
+		t.Fatal(err)
+	}
+	web := instances.Reservations[0].Instances[0]
+
+	var testCases = []struct {
+		query InstanceQuery
+		out   bool
+	}{
+		{InstanceQuery{InstanceIDs: []string{"i-1d7683bd"}}, true},
+		{InstanceQuery{InstanceIDs: []string{"i-2e8794ce"}}, false},
+		{InstanceQuery{InstanceIDs: []string{"i-1d7683bd"}, NamePatterns: []string{"db-*"}}, false},
+		{InstanceQuery{InstanceIDs: []string{"i-1d7683bd"}, NamePatterns: []string{"db-*", "web-*"}}, true},
+		{InstanceQuery{InstanceIDs: []string{"i-1d7683bd"}, Tags: map[string]string{"Name": "web-?"}}, true},
+		{InstanceQuery{InstanceIDs: []string{"i-1d7683bd"}, Tags: map[string]string{"Env": "*"}}, false},
+	}
+
+	for i, tt := range testCases {
+		if actual := tt.query.matches(web); actual != tt.out {
+			t.Errorf("[%d] Expected match %t, got %t", i, tt.out, actual)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package attachmentizer
+
+// This file handles naming the new resources from a `--name-template`.
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// The fields a name template can use, e.g. `{{.Instance}}_{{.Device}}`.
+type NameTemplateData struct {
+	// The name of the instance's resource, e.g. `web`.
+	Instance string
+	// The device name without and with `/dev/`, e.g. `xvdb` and `/dev/xvdb`.
+	Device     string
+	DeviceLong string
+	VolumeID   string
+	// The instance's `count` index, or -1 if it has none.
+	Index int
+	// The instance's `for_each` key, if it has one.
+	Key string
+	// The path of the instance's module, e.g. `root.web`.
+	Module string
+	// The instance's EC2 tags.
+	Tags map[string]string
+}
+
+// Parse a name template. Referring to a tag the instance doesn't have is an
+// error; use `{{index .Tags "Role"}}` to get an empty string instead.
+func ParseNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=error").Parse(text)
+}
+
+// Render the name of the new resources for a device.
+func renderResourceName(tmpl *template.Template, dev BlockDevice, instanceTags map[string]string) (string, error) {
+	data := NameTemplateData{
+		Instance:   dev.instanceResName.name,
+		Device:     dev.deviceName.ShortName(),
+		DeviceLong: dev.deviceName.LongName(),
+		VolumeID:   dev.volumeID,
+		Index:      dev.instanceResName.index,
+		Key:        dev.instanceResName.key,
+		Module:     modulePathString(dev.modulePath),
+		Tags:       instanceTags,
+	}
+	if data.Tags == nil {
+		data.Tags = make(map[string]string)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("Could not name the resources for %v %v: %v", dev.instanceResName.Address(), dev.deviceName, err)
+	}
+	name := buf.String()
+	if !identifierRegexp.MatchString(name) {
+		return "", fmt.Errorf("Invalid resource name %q for %v %v", name, dev.instanceResName.Address(), dev.deviceName)
+	}
+	return name, nil
+}
+
+// Check that each device's resources have a name of their own, and that the
+// devices of instances with a `count` or `for_each` share the same name, since
+// they're one resource with the same count or keys. With `forEach`, the names
+// checked are the `for_each` ones, which devices of the same instance can share
+// as long as their keys differ. Devices taken out of their `count` group have
+// names of their own.
+func validateResourceNames(devs []BlockDevice, forEach bool) error {
+	type source struct {
+		module, instance string
+		device           DeviceName
+		index            int
+	}
+	nameBySource := make(map[source]string)
+	sourceByName := make(map[string]source)
+	sourceByKey := make(map[string]source)
+
+	for _, dev := range devs {
+		src := source{modulePathString(dev.modulePath), dev.instanceResName.name, dev.deviceName, -1}
+		if dev.ungrouped {
+			src.index = dev.instanceResName.index
+		}
+		name := dev.NameWithoutCount()
+		if forEach {
+			name = dev.ForEachName()
+		}
+
+		if other, ok := nameBySource[src]; ok && other != name {
+			return fmt.Errorf("The devices %v of %v in %v are named both %q and %q; names can't vary with the index or key",
+				src.device, src.instance, src.module, other, name)
+		}
+		nameBySource[src] = name
+
+		// With `for_each`, the devices of an instance can share a resource.
+		other, ok := sourceByName[src.module+"."+name]
+		if ok && other != src && !(forEach && other.instance == src.instance) {
+			return fmt.Errorf("The devices %v of %v and %v of %v in %v are both named %q",
+				other.device, other.instance, src.device, src.instance, src.module, name)
+		}
+		if !ok {
+			sourceByName[src.module+"."+name] = src
+		}
+
+		if forEach {
+			key := fmt.Sprintf("%s.%s[%q]", src.module, name, dev.ForEachKey())
+			if other, ok := sourceByKey[key]; ok && other != src {
+				return fmt.Errorf("The devices %v and %v of %v in %v are both named %q with the key %q",
+					other.device, src.device, src.instance, src.module, name, dev.ForEachKey())
+			}
+			sourceByKey[key] = src
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package attachmentizer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderResourceName(t *testing.T) {
+	dev := testConfigDevs()[0]
+	tags := map[string]string{"Role": "web"}
+
+	cases := []struct {
+		text     string
+		expected string
+		err      string
+	}{
+		{"{{.Instance}}-{{.Device}}", "web-xvdb", ""},
+		{"{{.Tags.Role}}_{{.Device}}_data", "web_xvdb_data", ""},
+		{"{{.Instance}}{{.DeviceLong}}", "", "Invalid resource name"},
+		{"{{.Tags.Team}}", "", "Could not name"},
+		{"{{.Instance}}-{{.Index}}", "web-0", ""},
+	}
+	for _, c := range cases {
+		tmpl, err := ParseNameTemplate(c.text)
+		if err != nil {
+			t.Fatalf("%v: %v", c.text, err)
+		}
+		name, err := renderResourceName(tmpl, dev, tags)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: expected error %q, got %v", c.text, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", c.text, err)
+		}
+		if name != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.text, c.expected, name)
+		}
+	}
+}
+
+func TestValidateResourceNames(t *testing.T) {
+	devs := testConfigDevs()
+	if err := validateResourceNames(devs, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The instances of a `count` must share a name.
+	devs[1].resourceName = "web-xvdb-1"
+	if err := validateResourceNames(devs, false); err == nil {
+		t.Error("Expected an error for names varying with the index")
+	}
+
+	// Devices in different modules can share a name, but not in the same one.
+	devs = testConfigDevs()
+	devs[2].resourceName = "web-xvdb"
+	if err := validateResourceNames(devs, false); err != nil {
+		t.Error(err)
+	}
+	devs[2].modulePath = []string{"root"}
+	if err := validateResourceNames(devs, false); err == nil {
+		t.Error("Expected an error for a name used twice")
+	}
+}
+
+func TestValidateResourceNamesForEach(t *testing.T) {
+	// The devices of an instance without a `count` share a resource, keyed by
+	// device.
+	devs := testConfigDevs()[2:]
+	second := devs[0]
+	second.deviceName = NewDeviceName("xvdd")
+	devs = append(devs, second)
+	if err := validateResourceNames(devs, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a template, the names checked are the ones written.
+	devs[0].resourceName = "db_data"
+	devs[1].resourceName = "db_data"
+	if err := validateResourceNames(devs, true); err != nil {
+		t.Error(err)
+	}
+	if err := validateResourceNames(devs, false); err == nil {
+		t.Error("Expected an error for a name used twice with `count`")
+	}
+
+	// The devices of an instance with a `count` are keyed by index, so they
+	// can't share a name.
+	devs = testConfigDevs()[:1]
+	second = devs[0]
+	second.deviceName = NewDeviceName("xvdd")
+	devs = append(devs, second)
+	devs[0].resourceName = "web"
+	devs[1].resourceName = "web"
+	if err := validateResourceNames(devs, true); err == nil {
+		t.Error("Expected an error for a key used twice")
+	}
+}
+
+func TestForEachNameTemplate(t *testing.T) {
+	tmpl, err := ParseNameTemplate("{{.Instance}}_{{.Device}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := testConfigDevs()[2]
+	if name := dev.ForEachName(); name != "db" {
+		t.Errorf("Expected db without a template, got %v", name)
+	}
+	if dev.resourceName, err = renderResourceName(tmpl, dev, nil); err != nil {
+		t.Fatal(err)
+	}
+	if name := dev.ForEachName(); name != "db_xvdc" {
+		t.Errorf("Expected db_xvdc with a template, got %v", name)
+	}
+
+	out := mustGenConfig(t, []BlockDevice{dev}, configOptions{hcl2: true, forEach: true, nameTemplate: tmpl})
+	for _, expected := range []string{
+		`resource "aws_ebs_volume" "db_xvdc"`,
+		`for_each    = aws_ebs_volume.db_xvdc`,
+		`device_name = "/dev/${each.key}"`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %v in:\n%v", expected, out)
+		}
+	}
+}
+
+func TestGenConfigNameTemplate(t *testing.T) {
+	tmpl, err := ParseNameTemplate("{{.Instance}}_{{.Device}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devs := testConfigDevs()[:2]
+	for i := range devs {
+		devs[i].resourceName, err = renderResourceName(tmpl, devs[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := mustGenConfig(t, devs, configOptions{nameTemplate: tmpl})
+	for _, expected := range []string{
+		`resource "aws_ebs_volume" "web_xvdb"`,
+		`resource "aws_volume_attachment" "web_xvdb"`,
+		`volume_id   = "${element(aws_ebs_volume.web_xvdb.*.id, count.index)}"`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %v in:\n%v", expected, out)
+		}
+	}
+}
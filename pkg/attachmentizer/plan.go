@@ -0,0 +1,264 @@
+package attachmentizer
+
+// This file handles the dry run: working out what a conversion would change in
+// the state, and reporting it without writing anything.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform/flatmap"
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// The changes a conversion makes to the state, grouped by instance.
+type StatePlan struct {
+	Instances []*InstancePlan `json:"instances"`
+}
+
+type InstancePlan struct {
+	Address string `json:"address"`
+	ID      string `json:"id"`
+	// Flatmap keys removed from and added to the instance's attributes.
+	RemovedKeys []string `json:"removed_keys,omitempty"`
+	AddedKeys   []string `json:"added_keys,omitempty"`
+	// Resources added or removed for the instance's volumes.
+	AddedResources   []*ResourcePlan `json:"added_resources,omitempty"`
+	RemovedResources []*ResourcePlan `json:"removed_resources,omitempty"`
+}
+
+type ResourcePlan struct {
+	Address    string            `json:"address"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// A resource instance with flatmapped attributes, so that the legacy and
+// version 4 state formats can be compared the same way.
+type flatResource struct {
+	address      string
+	resourceType string
+	attrs        map[string]string
+}
+
+// Format a legacy module path and resource key, like `["root", "web"]` and
+// `aws_instance.web.0`, as an address like `module.web.aws_instance.web[0]`.
+func legacyAddress(modulePath []string, key string) string {
+	name, err := ParseTerraformName(key)
+	if err != nil {
+		return moduleAddressPrefix(modulePath) + key
+	}
+	return moduleAddressPrefix(modulePath) + name.Address()
+}
+
+func legacyFlatResources(state *tf.State) []flatResource {
+	var resources []flatResource
+	for _, module := range state.Modules {
+		for key, res := range module.Resources {
+			if res.Primary == nil {
+				continue
+			}
+			resources = append(resources, flatResource{
+				address:      legacyAddress(module.Path, key),
+				resourceType: res.Type,
+				attrs:        res.Primary.Attributes,
+			})
+		}
+	}
+	return resources
+}
+
+// Drop `null`s, which flatmap can't represent, from decoded attributes.
+func pruneNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range v {
+			if elem == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = pruneNulls(elem)
+		}
+	case []interface{}:
+		var kept []interface{}
+		for _, elem := range v {
+			if elem != nil {
+				kept = append(kept, pruneNulls(elem))
+			}
+		}
+		return kept
+	}
+	return v
+}
+
+func v4FlatResources(state *stateV4) ([]flatResource, error) {
+	var resources []flatResource
+	for _, res := range state.Resources {
+		if res.Mode != "managed" {
+			continue
+		}
+		for _, inst := range res.Instances {
+			if inst.Deposed != "" {
+				continue
+			}
+			attrs, err := decodeV4Attrs(inst.Attributes)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read attributes of %v: %v", v4ResourceAddr(res.Module, res.Type, res.Name), err)
+			}
+
+			address := v4ResourceAddr(res.Module, res.Type, res.Name)
+			switch key := inst.IndexKey.(type) {
+			case string:
+				address = fmt.Sprintf("%s[%q]", address, key)
+			case nil:
+			default:
+				address = fmt.Sprintf("%s[%v]", address, key)
+			}
+
+			resources = append(resources, flatResource{
+				address:      address,
+				resourceType: res.Type,
+				attrs:        flatmap.Flatten(pruneNulls(attrs).(map[string]interface{})),
+			})
+		}
+	}
+	return resources, nil
+}
+
+func (s *stateFile) flatResources() ([]flatResource, error) {
+	if s.v4 != nil {
+		return v4FlatResources(s.v4)
+	}
+	return legacyFlatResources(s.legacy), nil
+}
+
+// Work out what changed between two states. Added and removed volumes and
+// attachments are grouped under the instance they're attached to.
+func diffStates(before []flatResource, after []flatResource) *StatePlan {
+	beforeByAddr := make(map[string]flatResource)
+	for _, res := range before {
+		beforeByAddr[res.address] = res
+	}
+	afterByAddr := make(map[string]flatResource)
+	for _, res := range after {
+		afterByAddr[res.address] = res
+	}
+
+	plans := make(map[string]*InstancePlan)
+	instanceAddrByID := make(map[string]string)
+	for _, res := range append(before, after...) {
+		if res.resourceType != "aws_instance" {
+			continue
+		}
+		instanceAddrByID[res.attrs["id"]] = res.address
+		if _, ok := plans[res.address]; !ok {
+			plans[res.address] = &InstancePlan{Address: res.address, ID: res.attrs["id"]}
+		}
+	}
+
+	for addr, plan := range plans {
+		beforeAttrs := beforeByAddr[addr].attrs
+		afterAttrs := afterByAddr[addr].attrs
+		for k := range beforeAttrs {
+			if _, ok := afterAttrs[k]; !ok {
+				plan.RemovedKeys = append(plan.RemovedKeys, k)
+			}
+		}
+		for k := range afterAttrs {
+			if _, ok := beforeAttrs[k]; !ok {
+				plan.AddedKeys = append(plan.AddedKeys, k)
+			}
+		}
+		sort.Strings(plan.RemovedKeys)
+		sort.Strings(plan.AddedKeys)
+	}
+
+	// Find the instance a volume or attachment belongs to.
+	instanceFor := func(resources []flatResource, res flatResource) *InstancePlan {
+		instanceID := res.attrs["instance_id"]
+		if res.resourceType == "aws_ebs_volume" {
+			for _, other := range resources {
+				if other.resourceType == "aws_volume_attachment" && other.attrs["volume_id"] == res.attrs["id"] {
+					instanceID = other.attrs["instance_id"]
+				}
+			}
+		}
+		return plans[instanceAddrByID[instanceID]]
+	}
+
+	for _, res := range after {
+		if _, ok := beforeByAddr[res.address]; ok {
+			continue
+		}
+		if plan := instanceFor(after, res); plan != nil {
+			plan.AddedResources = append(plan.AddedResources, &ResourcePlan{res.address, res.attrs})
+		}
+	}
+	for _, res := range before {
+		if _, ok := afterByAddr[res.address]; ok {
+			continue
+		}
+		if plan := instanceFor(before, res); plan != nil {
+			plan.RemovedResources = append(plan.RemovedResources, &ResourcePlan{res.address, res.attrs})
+		}
+	}
+
+	statePlan := &StatePlan{}
+	for _, plan := range plans {
+		if len(plan.RemovedKeys)+len(plan.AddedKeys)+len(plan.AddedResources)+len(plan.RemovedResources) == 0 {
+			continue
+		}
+		sortResourcePlans(plan.AddedResources)
+		sortResourcePlans(plan.RemovedResources)
+		statePlan.Instances = append(statePlan.Instances, plan)
+	}
+	sort.Slice(statePlan.Instances, func(i, j int) bool {
+		return statePlan.Instances[i].Address < statePlan.Instances[j].Address
+	})
+	return statePlan
+}
+
+func sortResourcePlans(plans []*ResourcePlan) {
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].Address < plans[j].Address
+	})
+}
+
+// Render the plan for people, in the style of `terraform plan`.
+func (p *StatePlan) String() string {
+	var buf bytes.Buffer
+	if len(p.Instances) == 0 {
+		buf.WriteString("No changes.\n")
+		return buf.String()
+	}
+
+	writeResources := func(sign string, resources []*ResourcePlan) {
+		for _, res := range resources {
+			buf.WriteString(fmt.Sprintf("  %s %s\n", sign, res.Address))
+
+			var keys []string
+			for k := range res.Attributes {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				buf.WriteString(fmt.Sprintf("      %s = %q\n", k, res.Attributes[k]))
+			}
+		}
+	}
+
+	for _, inst := range p.Instances {
+		buf.WriteString(fmt.Sprintf("%s (%s)\n", inst.Address, inst.ID))
+		for _, k := range inst.RemovedKeys {
+			buf.WriteString(fmt.Sprintf("  - %s\n", k))
+		}
+		for _, k := range inst.AddedKeys {
+			buf.WriteString(fmt.Sprintf("  + %s\n", k))
+		}
+		writeResources("-", inst.RemovedResources)
+		writeResources("+", inst.AddedResources)
+		buf.WriteString("\n")
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,281 @@
+package attachmentizer
+
+// This file handles saving a plan to apply later: everything The Conversion
+// needs from EC2 goes in the file, so it can be reviewed, and applied without
+// access to AWS as long as the state hasn't changed since.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	ec2 "github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The version of the plan file format. Files of other versions aren't read.
+const PlanFileVersion = 1
+
+type PlanFile struct {
+	FormatVersion int `json:"format_version"`
+	// The state the plan was made for, which has to be the same to apply it.
+	State   PlanFileState   `json:"state"`
+	Options PlanFileOptions `json:"options"`
+	// The instances converted, with their devices as merged from the state
+	// and EC2.
+	Instances []*PlanFileInstance `json:"instances"`
+	Skipped   ValidationErrors    `json:"skipped,omitempty"`
+	// The resources and attributes to add to and remove from the state.
+	Changes *StatePlan `json:"changes"`
+}
+
+type PlanFileState struct {
+	Path string `json:"path,omitempty"`
+	// The backend the state is in instead, without its credentials.
+	Backend *BackendConfig `json:"backend,omitempty"`
+	Lineage string         `json:"lineage"`
+	Serial  uint64         `json:"serial"`
+}
+
+// The `Options` that aren't about finding the instances in EC2.
+type PlanFileOptions struct {
+	Revert           bool       `json:"revert,omitempty"`
+	HCL2             bool       `json:"hcl2,omitempty"`
+	NameTemplate     string     `json:"name_template"`
+	SkipInvalid      bool       `json:"skip_invalid,omitempty"`
+	Output           OutputMode `json:"output"`
+	StateOutPath     string     `json:"state_out_path,omitempty"`
+	ConfigOutPath    string     `json:"config_out_path,omitempty"`
+	ConfigDir        string     `json:"config_dir,omitempty"`
+	ImportScriptPath string     `json:"import_script_path,omitempty"`
+	AWSProvider      string     `json:"aws_provider,omitempty"`
+}
+
+type PlanFileInstance struct {
+	ID      string            `json:"id"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Devices []*PlanFileDevice `json:"devices"`
+}
+
+type PlanFileDevice struct {
+	// The address of the instance in the state.
+	Instance            string            `json:"instance"`
+	DeviceName          string            `json:"device_name"`
+	VolumeID            string            `json:"volume_id"`
+	AvailabilityZone    string            `json:"availability_zone"`
+	DeleteOnTermination string            `json:"delete_on_termination"`
+	Size                int               `json:"size"`
+	VolumeType          string            `json:"volume_type"`
+	IOPS                int               `json:"iops,omitempty"`
+	Encrypted           string            `json:"encrypted"`
+	SnapshotID          string            `json:"snapshot_id,omitempty"`
+	KMSKeyID            string            `json:"kms_key_id,omitempty"`
+	Tags                map[string]string `json:"tags,omitempty"`
+	Throughput          int               `json:"throughput,omitempty"`
+	MultiAttachEnabled  string            `json:"multi_attach_enabled,omitempty"`
+	OutpostARN          string            `json:"outpost_arn,omitempty"`
+	// If the state has the device by another name than EC2, that name and
+	// the rule by which they were matched. For review only: applying the plan
+	// matches them again.
+	StateDeviceName string `json:"state_device_name,omitempty"`
+	AliasRule       string `json:"alias_rule,omitempty"`
+}
+
+// Make the file for a plan made by this converter.
+func (c *Converter) PlanFile(plan *Plan) *PlanFile {
+	lineage, serial := plan.from.lineage()
+	pf := &PlanFile{
+		FormatVersion: PlanFileVersion,
+		State: PlanFileState{
+			Path:    c.opts.StatePath,
+			Backend: c.opts.Backend.withoutSecrets(),
+			Lineage: lineage,
+			Serial:  serial,
+		},
+		Options: PlanFileOptions{
+			Revert:           c.opts.Revert,
+			HCL2:             c.opts.HCL2,
+			NameTemplate:     c.opts.NameTemplate,
+			SkipInvalid:      c.opts.SkipInvalid,
+			Output:           c.opts.Output,
+			StateOutPath:     c.opts.StateOutPath,
+			ConfigOutPath:    c.opts.ConfigOutPath,
+			ConfigDir:        c.opts.ConfigDir,
+			ImportScriptPath: c.opts.ImportScriptPath,
+			AWSProvider:      c.opts.AWSProvider,
+		},
+		Instances: []*PlanFileInstance{},
+		Skipped:   plan.Skipped,
+		Changes:   plan.State,
+	}
+
+	// The devices already converted are needed to see they still are.
+	byID := make(map[string]*PlanFileInstance)
+	for _, dev := range append(append([]BlockDevice(nil), plan.Devices...), plan.Unchanged...) {
+		inst, ok := byID[dev.instanceID]
+		if !ok {
+			inst = &PlanFileInstance{ID: dev.instanceID, Tags: plan.instances[dev.instanceID].Tags}
+			byID[dev.instanceID] = inst
+			pf.Instances = append(pf.Instances, inst)
+		}
+		pfDev := &PlanFileDevice{
+			Instance:            dev.InstanceAddress(),
+			DeviceName:          dev.deviceName.LongName(),
+			VolumeID:            dev.volumeID,
+			AvailabilityZone:    dev.availabilityZone,
+			DeleteOnTermination: dev.deleteOnTermination,
+			Size:                dev.size,
+			VolumeType:          dev.volumeType,
+			IOPS:                dev.iops,
+			Encrypted:           dev.encrypted,
+			SnapshotID:          dev.snapshotId,
+			KMSKeyID:            dev.kmsKeyID,
+			Tags:                dev.tags,
+			Throughput:          dev.throughput,
+			MultiAttachEnabled:  dev.multiAttachEnabled,
+			OutpostARN:          dev.outpostArn,
+			AliasRule:           dev.aliasRule,
+		}
+		if dev.aliasRule != "" {
+			pfDev.StateDeviceName = dev.stateDeviceName.LongName()
+		}
+		inst.Devices = append(inst.Devices, pfDev)
+	}
+	sort.Slice(pf.Instances, func(i, j int) bool {
+		return pf.Instances[i].ID < pf.Instances[j].ID
+	})
+	for _, inst := range pf.Instances {
+		sort.Slice(inst.Devices, func(i, j int) bool {
+			return inst.Devices[i].DeviceName < inst.Devices[j].DeviceName
+		})
+	}
+	return pf
+}
+
+func (pf *PlanFile) Write(path string) error {
+	data, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func ReadPlanFile(path string) (*PlanFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pf PlanFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("Could not read plan from %v: %v", path, err)
+	}
+	if pf.FormatVersion != PlanFileVersion {
+		return nil, fmt.Errorf("Unsupported plan format version %d in %v", pf.FormatVersion, path)
+	}
+	return &pf, nil
+}
+
+// Get the instances in the plan the way EC2 gave them, to convert again.
+func (pf *PlanFile) instances() map[string]Instance {
+	instMap := make(map[string]Instance)
+	for _, inst := range pf.Instances {
+		devMap := make(map[DeviceName]BlockDevice)
+		for _, dev := range inst.Devices {
+			devMap[NewDeviceName(dev.DeviceName)] = BlockDevice{
+				volumeID:            dev.VolumeID,
+				size:                dev.Size,
+				volumeType:          dev.VolumeType,
+				deleteOnTermination: dev.DeleteOnTermination,
+				deviceName:          NewDeviceName(dev.DeviceName),
+				encrypted:           dev.Encrypted,
+				iops:                dev.IOPS,
+				snapshotId:          dev.SnapshotID,
+				kmsKeyID:            dev.KMSKeyID,
+				tags:                dev.Tags,
+				throughput:          dev.Throughput,
+				multiAttachEnabled:  dev.MultiAttachEnabled,
+				outpostArn:          dev.OutpostARN,
+				instanceID:          inst.ID,
+				availabilityZone:    dev.AvailabilityZone,
+			}
+		}
+		instMap[inst.ID] = Instance{ID: inst.ID, BlockDevices: devMap, Tags: inst.Tags}
+	}
+	return instMap
+}
+
+// The instances of a plan file, as an `EC2Interface` that doesn't need AWS.
+type planFileEC2 struct {
+	instances map[string]Instance
+}
+
+func (p *planFileEC2) GetInstances(query InstanceQuery) (map[string]Instance, error) {
+	instMap := make(map[string]Instance)
+	for _, id := range query.InstanceIDs {
+		if inst, ok := p.instances[id]; ok {
+			instMap[id] = inst
+		}
+	}
+	return instMap, nil
+}
+
+// The volumes' attributes are already on the devices.
+func (p *planFileEC2) GetVolumes(volumeIDs []string) (map[string]*ec2.Volume, error) {
+	return nil, nil
+}
+
+// Make a converter that does what the plan file says, without AWS.
+func (pf *PlanFile) Converter() (*Converter, error) {
+	return NewConverter(Options{
+		StatePath:        pf.State.Path,
+		Backend:          pf.State.Backend,
+		EC2:              &planFileEC2{pf.instances()},
+		Revert:           pf.Options.Revert,
+		HCL2:             pf.Options.HCL2,
+		NameTemplate:     pf.Options.NameTemplate,
+		SkipInvalid:      pf.Options.SkipInvalid,
+		Output:           pf.Options.Output,
+		StateOutPath:     pf.Options.StateOutPath,
+		ConfigOutPath:    pf.Options.ConfigOutPath,
+		ConfigDir:        pf.Options.ConfigDir,
+		ImportScriptPath: pf.Options.ImportScriptPath,
+		AWSProvider:      pf.Options.AWSProvider,
+	})
+}
+
+// Apply the plan, if the state is the one it was made for and The Conversion
+// still makes exactly the changes in it.
+func (pf *PlanFile) Apply() (*Result, error) {
+	converter, err := pf.Converter()
+	if err != nil {
+		return nil, err
+	}
+	state, err := converter.readState()
+	if err != nil {
+		return nil, err
+	}
+	if lineage, serial := state.lineage(); lineage != pf.State.Lineage || serial != pf.State.Serial {
+		return nil, fmt.Errorf("The state in %v has changed since the plan was made: it has lineage %q and serial %d, not %q and %d",
+			converter.stateName(), lineage, serial, pf.State.Lineage, pf.State.Serial)
+	}
+
+	plan, err := converter.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	planned, err := json.Marshal(pf.Changes)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := json.Marshal(plan.State)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(planned, actual) {
+		return nil, fmt.Errorf("Applying the plan would change the state differently than it says; make a new plan")
+	}
+
+	return converter.Apply(plan)
+}
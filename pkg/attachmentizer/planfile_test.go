@@ -0,0 +1,72 @@
+package attachmentizer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanFileApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "planfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "in.tfstate")
+	if err := ioutil.WriteFile(statePath, []byte(testV4State), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	converter, err := NewConverter(Options{
+		StatePath:     statePath,
+		EC2:           testEC2Source(),
+		StateOutPath:  filepath.Join(dir, "out.tfstate"),
+		ConfigOutPath: filepath.Join(dir, "config.tf"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := converter.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planPath := filepath.Join(dir, "plan.json")
+	if err := converter.PlanFile(plan).Write(planPath); err != nil {
+		t.Fatal(err)
+	}
+	planFile, err := ReadPlanFile(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if planFile.State.Serial != 7 || len(planFile.Instances) != 1 || planFile.Instances[0].Devices[0].Size != 100 {
+		t.Errorf("Expected the plan to have serial 7 and the volume's size, got %+v", planFile)
+	}
+
+	// Apply to a copy of the state with a different serial first.
+	changedPath := filepath.Join(dir, "changed.tfstate")
+	changed := strings.Replace(testV4State, `"serial": 7`, `"serial": 8`, 1)
+	if err := ioutil.WriteFile(changedPath, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	planFile.State.Path = changedPath
+	if _, err := planFile.Apply(); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("Expected the changed state to be refused, got %v", err)
+	}
+
+	planFile.State.Path = statePath
+	result, err := planFile.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newState, err := readV4State(result.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newState.Serial != 8 || len(newState.Resources) != 3 {
+		t.Errorf("Expected the volume and attachment to be added at serial 8, got %+v", newState)
+	}
+}
@@ -0,0 +1,172 @@
+package attachmentizer
+
+// This file has the versions of the AWS provider the conversion can write
+// resources for. Each has its own schemas for the `ebs_block_device` block and
+// the resources it's converted to, which decide which of a device's fields
+// are read from the state, and which are written to the new resources in the
+// state and config.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// A version of the AWS provider, as far as the conversion is concerned.
+type providerProfile struct {
+	name             string
+	ebsBlockDevice   *schema.Resource
+	ebsVolume        *schema.Resource
+	volumeAttachment *schema.Resource
+	// Whether `aws_volume_attachment`s can be imported, by
+	// `DEVICE_NAME:VOLUME_ID:INSTANCE_ID`. The vendored provider has no
+	// importer for them.
+	importsAttachments bool
+}
+
+// The oldest profile that can import attachments, for messages.
+const minImportScriptAWSProvider = "3.x"
+
+// The profile used if none is given: the vendored provider's.
+const DefaultAWSProvider = "0.9"
+
+// The profiles by name. `0.9` is the vendored provider's, which the others
+// extend with the attributes later versions added that matter here; of those,
+// only the ones the conversion can fill in are written.
+var providerProfiles = map[string]*providerProfile{
+	"0.9": {
+		name:             "0.9",
+		ebsBlockDevice:   awsInstanceEbsBlockDeviceSchema,
+		ebsVolume:        awsEbsVolumeSchema,
+		volumeAttachment: awsVolumeAttachmentSchema,
+	},
+	// Version 3 of the provider added gp3's `throughput`, Multi-Attach and
+	// Outposts to volumes, and `kms_key_id`, `throughput` and `tags` to
+	// `ebs_block_device`.
+	"3.x": {
+		name: "3.x",
+		ebsBlockDevice: extendSchema(awsInstanceEbsBlockDeviceSchema, map[string]*schema.Schema{
+			"kms_key_id": {Type: schema.TypeString, Optional: true, Computed: true},
+			"tags":       {Type: schema.TypeMap, Optional: true},
+			"throughput": {Type: schema.TypeInt, Optional: true, Computed: true},
+			"volume_id":  {Type: schema.TypeString, Computed: true},
+		}),
+		ebsVolume: extendSchema(awsEbsVolumeSchema, map[string]*schema.Schema{
+			"arn":                  {Type: schema.TypeString, Computed: true},
+			"multi_attach_enabled": {Type: schema.TypeBool, Optional: true},
+			"outpost_arn":          {Type: schema.TypeString, Optional: true},
+			"throughput":           {Type: schema.TypeInt, Optional: true, Computed: true},
+		}),
+		volumeAttachment:   awsVolumeAttachmentSchema,
+		importsAttachments: true,
+	},
+	// Version 5 also has the `tags_all` that default tags are merged into,
+	// and more ways to detach and delete.
+	"5.x": {
+		name: "5.x",
+		ebsBlockDevice: extendSchema(awsInstanceEbsBlockDeviceSchema, map[string]*schema.Schema{
+			"kms_key_id": {Type: schema.TypeString, Optional: true, Computed: true},
+			"tags":       {Type: schema.TypeMap, Optional: true},
+			"throughput": {Type: schema.TypeInt, Optional: true, Computed: true},
+			"volume_id":  {Type: schema.TypeString, Computed: true},
+		}),
+		ebsVolume: extendSchema(awsEbsVolumeSchema, map[string]*schema.Schema{
+			"arn":                  {Type: schema.TypeString, Computed: true},
+			"final_snapshot":       {Type: schema.TypeBool, Optional: true},
+			"multi_attach_enabled": {Type: schema.TypeBool, Optional: true},
+			"outpost_arn":          {Type: schema.TypeString, Optional: true},
+			"tags_all":             {Type: schema.TypeMap, Computed: true},
+			"throughput":           {Type: schema.TypeInt, Optional: true, Computed: true},
+		}),
+		volumeAttachment: extendSchema(awsVolumeAttachmentSchema, map[string]*schema.Schema{
+			"stop_instance_before_detaching": {Type: schema.TypeBool, Optional: true},
+		}),
+		importsAttachments: true,
+	},
+}
+
+// The names of the profiles, for `Options.AWSProvider`.
+var AWSProviders = []string{"0.9", "3.x", "5.x"}
+
+// Get a profile by name, or the default one for "".
+func lookupProviderProfile(name string) (*providerProfile, error) {
+	if name == "" {
+		name = DefaultAWSProvider
+	}
+	p, ok := providerProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown AWS provider version %q; it must be one of %v", name, strings.Join(AWSProviders, ", "))
+	}
+	return p, nil
+}
+
+// Make a schema with more attributes than another.
+func extendSchema(base *schema.Resource, attrs map[string]*schema.Schema) *schema.Resource {
+	res := &schema.Resource{Schema: make(map[string]*schema.Schema)}
+	for name, s := range base.Schema {
+		res.Schema[name] = s
+	}
+	for name, s := range attrs {
+		res.Schema[name] = s
+	}
+	return res
+}
+
+func (p *providerProfile) resourceSchema(resourceType string) (*schema.Resource, bool) {
+	switch resourceType {
+	case "aws_ebs_volume":
+		return p.ebsVolume, true
+	case "aws_volume_attachment":
+		return p.volumeAttachment, true
+	}
+	return nil, false
+}
+
+// Whether the profile's `aws_ebs_volume` has an attribute.
+func (p *providerProfile) volumeHas(attr string) bool {
+	_, ok := p.ebsVolume.Schema[attr]
+	return ok
+}
+
+// Whether an attribute of a resource can be set in the config, rather than
+// only being computed by the provider.
+func (p *providerProfile) configurable(resourceType string, attr string) bool {
+	res, ok := p.resourceSchema(resourceType)
+	if !ok {
+		return false
+	}
+	s, ok := res.Schema[attr]
+	return ok && (s.Required || s.Optional)
+}
+
+// Clear the fields of a device the profile's `aws_ebs_volume` doesn't have,
+// and make the device use the profile from then on.
+func (p *providerProfile) trimBlockDevice(dev BlockDevice) BlockDevice {
+	if !p.volumeHas("throughput") {
+		dev.throughput = 0
+	}
+	if !p.volumeHas("multi_attach_enabled") {
+		dev.multiAttachEnabled = ""
+	}
+	if !p.volumeHas("outpost_arn") {
+		dev.outpostArn = ""
+	}
+	dev.provider = p
+	return dev
+}
+
+// Get the names of the attributes of a type in any of the profiles' schemas.
+func schemaAttrsOfType(valueType schema.ValueType) map[string]struct{} {
+	attrs := make(map[string]struct{})
+	for _, p := range providerProfiles {
+		for _, res := range []*schema.Resource{p.ebsBlockDevice, p.ebsVolume, p.volumeAttachment} {
+			for attr, s := range res.Schema {
+				if s.Type == valueType {
+					attrs[attr] = struct{}{}
+				}
+			}
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,143 @@
+package attachmentizer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProviderProfiles(t *testing.T) {
+	var testCases = []struct {
+		provider string
+		// Attributes the volume should and shouldn't have in the state.
+		has, hasNot []string
+		// Lines the config should and shouldn't have.
+		config, notConfig []string
+	}{
+		{
+			"0.9",
+			[]string{"iops", "tags"},
+			[]string{"throughput", "multi_attach_enabled", "outpost_arn", "tags_all"},
+			[]string{"iops "},
+			[]string{"throughput", "multi_attach_enabled"},
+		},
+		{
+			"3.x",
+			[]string{"throughput", "multi_attach_enabled", "outpost_arn", "tags"},
+			[]string{"tags_all"},
+			[]string{"throughput = 250", "multi_attach_enabled = true"},
+			[]string{"outpost_arn", "tags_all"},
+		},
+		{
+			"5.x",
+			[]string{"throughput", "multi_attach_enabled", "tags", "tags_all"},
+			nil,
+			[]string{"throughput = 250"},
+			[]string{"tags_all", "arn"},
+		},
+	}
+
+	for _, tt := range testCases {
+		p, err := lookupProviderProfile(tt.provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := parseV4State([]byte(testV4State))
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := testEC2Source()
+		dev := source.instances["i-1d7683bd"].BlockDevices[NewDeviceName("xvdb")]
+		dev.size, dev.volumeType, dev.iops = 100, "gp3", 3000
+		dev.throughput, dev.multiAttachEnabled = 250, "true"
+		dev.tags = map[string]string{"Name": "web-data"}
+		source.instances["i-1d7683bd"].BlockDevices[NewDeviceName("xvdb")] = dev
+
+		opts := configOptions{hcl2: true, provider: p}
+		newState, newDevs, _, errs, err := generateNewV4State(state, source.instances, opts)
+		if err != nil || len(errs) != 0 {
+			t.Fatalf("[%v] %v %v", tt.provider, err, errs)
+		}
+
+		var attrs map[string]interface{}
+		for _, res := range newState.Resources {
+			if res.Type == "aws_ebs_volume" {
+				if attrs, err = decodeV4Attrs(res.Instances[0].Attributes); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, attr := range tt.has {
+			if _, ok := attrs[attr]; !ok {
+				t.Errorf("[%v] Expected the volume to have %v, got %v", tt.provider, attr, attrs)
+			}
+		}
+		for _, attr := range tt.hasNot {
+			if _, ok := attrs[attr]; ok {
+				t.Errorf("[%v] Expected the volume not to have %v, got %v", tt.provider, attr, attrs)
+			}
+		}
+
+		config := mustGenConfig(t, newDevs, opts)
+		for _, line := range tt.config {
+			if !strings.Contains(config, line) {
+				t.Errorf("[%v] Expected the config to have %q, got:\n%v", tt.provider, line, config)
+			}
+		}
+		for _, line := range tt.notConfig {
+			if strings.Contains(config, line) {
+				t.Errorf("[%v] Expected the config not to have %q, got:\n%v", tt.provider, line, config)
+			}
+		}
+	}
+}
+
+// Newer providers' `ebs_block_device`s have more to read.
+func TestProviderProfileBlockDevice(t *testing.T) {
+	block := map[string]interface{}{
+		"delete_on_termination": false,
+		"device_name":           "/dev/xvdb",
+		"kms_key_id":            "arn:aws:kms:us-east-1:123456789012:key/abcd",
+		"tags":                  map[string]interface{}{"Name": "web-data"},
+		"throughput":            "250",
+		"volume_id":             "v-abcd",
+		"volume_size":           "100",
+		"volume_type":           "gp3",
+	}
+	devices, ok := mapify([]interface{}{block})
+	if !ok {
+		t.Fatal("Could not mapify")
+	}
+	name := &TerraformName{"aws_instance", "web", 0, ""}
+
+	devMap, err := createDeviceMap(name, devices, providerProfiles["3.x"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := devMap[NewDeviceName("xvdb")]
+	if dev.throughput != 250 || dev.kmsKeyID == "" || dev.tags["Name"] != "web-data" || dev.volumeType != "gp3" {
+		t.Errorf("Expected the 3.x attributes to be read, got %+v", dev)
+	}
+
+	devMap, err = createDeviceMap(name, devices, providerProfiles["0.9"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev = devMap[NewDeviceName("xvdb")]
+	if dev.throughput != 0 || dev.kmsKeyID != "" || dev.tags != nil || dev.size != 100 {
+		t.Errorf("Expected only the 0.9 attributes to be read, got %+v", dev)
+	}
+}
+
+func TestLookupProviderProfile(t *testing.T) {
+	for _, name := range AWSProviders {
+		if p, err := lookupProviderProfile(name); err != nil || p.name != name {
+			t.Errorf("Expected profile %v, got %v, %v", name, p, err)
+		}
+	}
+	if p, err := lookupProviderProfile(""); err != nil || p.name != DefaultAWSProvider {
+		t.Errorf("Expected the default profile, got %v, %v", p, err)
+	}
+	if _, err := lookupProviderProfile("4.x"); err == nil || !strings.Contains(err.Error(), "Unknown AWS provider version") {
+		t.Errorf("Expected an error for an unknown version, got %v", err)
+	}
+}
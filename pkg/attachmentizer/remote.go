@@ -0,0 +1,406 @@
+package attachmentizer
+
+// This file handles states kept in a remote backend rather than a local file.
+// Terraform's `state/remote` package (which its backends build on) can't be
+// vendored on its own: it builds the clients of every backend Terraform
+// supports, and some of their SDKs, like Manta's, can no longer be fetched.
+// So the clients here use the same libraries as Terraform's where they can,
+// the Consul API and the AWS SDK, and store the state the same way. The http
+// backend is Terraform's own protocol over `net/http`, and etcd's v2 client
+// can't be used since its generated codec panics with current Go, so those
+// two are small clients here.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform/state"
+)
+
+// A remote backend: its type, and the settings of a Terraform `backend` block
+// (or `-backend-config` flags) for it.
+type BackendConfig struct {
+	Type   string            `json:"type"`
+	Config map[string]string `json:"config"`
+}
+
+// The backends supported.
+var BackendTypes = []string{"consul", "etcd", "http", "s3"}
+
+// Settings that are credentials, which aren't saved in plan files.
+var backendSecrets = map[string]bool{
+	"access_key":   true,
+	"access_token": true,
+	"password":     true,
+	"secret_key":   true,
+	"token":        true,
+}
+
+// Parse backend settings given as `key=value`.
+func ParseBackendConfig(settings []string) (map[string]string, error) {
+	config := make(map[string]string)
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid backend setting %q, expected key=value", setting)
+		}
+		config[parts[0]] = parts[1]
+	}
+	return config, nil
+}
+
+// A copy of the backend with the credentials left out.
+func (b *BackendConfig) withoutSecrets() *BackendConfig {
+	if b == nil {
+		return nil
+	}
+	config := make(map[string]string)
+	for k, v := range b.Config {
+		if !backendSecrets[k] {
+			config[k] = v
+		}
+	}
+	return &BackendConfig{Type: b.Type, Config: config}
+}
+
+func (b *BackendConfig) String() string {
+	return fmt.Sprintf("the %v backend", b.Type)
+}
+
+// A client for the state in a remote backend, like Terraform's
+// `remote.Client`. `Get` returns nil if there's no state yet. Clients for
+// backends that support locking are also `state.Locker`s.
+type remoteClient interface {
+	Get() ([]byte, error)
+	Put(data []byte) error
+}
+
+func newRemoteClient(backend *BackendConfig) (remoteClient, error) {
+	switch backend.Type {
+	case "consul":
+		return newConsulClient(backend.Config)
+	case "etcd":
+		return newEtcdClient(backend.Config)
+	case "http":
+		return newHTTPClient(backend.Config)
+	case "s3":
+		return newS3Client(backend.Config)
+	default:
+		return nil, fmt.Errorf("Unsupported backend %q, expected one of %v", backend.Type, strings.Join(BackendTypes, ", "))
+	}
+}
+
+// Check the settings are all known for a backend, and the required ones set.
+func checkBackendConfig(config map[string]string, required []string, optional []string) error {
+	known := make(map[string]bool)
+	for _, k := range append(required, optional...) {
+		known[k] = true
+	}
+	var unknown []string
+	for k := range config {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("Unknown settings %v", strings.Join(unknown, ", "))
+	}
+	for _, k := range required {
+		if config[k] == "" {
+			return fmt.Errorf("Missing setting %v", k)
+		}
+	}
+	return nil
+}
+
+// Parse a boolean setting, false if it isn't set.
+func backendBool(config map[string]string, key string) (bool, error) {
+	if config[key] == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(config[key])
+	if err != nil {
+		return false, fmt.Errorf("%v must be a boolean", key)
+	}
+	return b, nil
+}
+
+// The `http` backend: the state is fetched with GET and stored with POST (or
+// `update_method`), and locked by sending the lock info to `lock_address`
+// with LOCK (or `lock_method`), the same protocol as Terraform's.
+type httpClient struct {
+	client        *http.Client
+	address       *url.URL
+	updateMethod  string
+	lockAddress   *url.URL
+	lockMethod    string
+	unlockAddress *url.URL
+	unlockMethod  string
+	username      string
+	password      string
+
+	// The ID of the lock held, sent with updates.
+	lockID string
+}
+
+func newHTTPClient(config map[string]string) (*httpClient, error) {
+	err := checkBackendConfig(config, []string{"address"}, []string{
+		"update_method", "lock_address", "lock_method", "unlock_address", "unlock_method",
+		"username", "password", "skip_cert_verification",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &httpClient{
+		client:       &http.Client{},
+		updateMethod: "POST",
+		lockMethod:   "LOCK",
+		unlockMethod: "UNLOCK",
+		username:     config["username"],
+		password:     config["password"],
+	}
+	if c.address, err = parseHTTPAddress(config["address"]); err != nil {
+		return nil, err
+	}
+	if config["lock_address"] != "" {
+		if c.lockAddress, err = parseHTTPAddress(config["lock_address"]); err != nil {
+			return nil, err
+		}
+	}
+	if config["unlock_address"] != "" {
+		if c.unlockAddress, err = parseHTTPAddress(config["unlock_address"]); err != nil {
+			return nil, err
+		}
+	}
+	for k, method := range map[string]*string{"update_method": &c.updateMethod, "lock_method": &c.lockMethod, "unlock_method": &c.unlockMethod} {
+		if config[k] != "" {
+			*method = config[k]
+		}
+	}
+
+	skip, err := backendBool(config, "skip_cert_verification")
+	if err != nil {
+		return nil, err
+	}
+	if skip {
+		c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return c, nil
+}
+
+func parseHTTPAddress(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address %q: %v", address, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Address %q must be HTTP or HTTPS", address)
+	}
+	return u, nil
+}
+
+func (c *httpClient) do(method string, u *url.URL, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+func (c *httpClient) Get() ([]byte, error) {
+	resp, body, err := c.do("GET", c.address, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if len(body) == 0 {
+			return nil, nil
+		}
+		return body, nil
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unexpected HTTP status %v getting the state", resp.Status)
+	}
+}
+
+func (c *httpClient) Put(data []byte) error {
+	u := *c.address
+	if c.lockID != "" {
+		query := u.Query()
+		query.Set("ID", c.lockID)
+		u.RawQuery = query.Encode()
+	}
+	resp, _, err := c.do(c.updateMethod, &u, data)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected HTTP status %v pushing the state", resp.Status)
+	}
+}
+
+// Without a `lock_address` the state isn't locked, as with Terraform.
+func (c *httpClient) Lock(info *state.LockInfo) (string, error) {
+	if c.lockAddress == nil {
+		return "", nil
+	}
+	info.Path = c.address.String()
+	resp, body, err := c.do(c.lockMethod, c.lockAddress, info.Marshal())
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		c.lockID = info.ID
+		return info.ID, nil
+	case http.StatusLocked, http.StatusConflict:
+		lockErr := &state.LockError{Err: fmt.Errorf("The state is already locked")}
+		var existing state.LockInfo
+		if json.Unmarshal(body, &existing) == nil {
+			lockErr.Info = &existing
+		}
+		return "", lockErr
+	default:
+		return "", fmt.Errorf("Unexpected HTTP status %v locking the state", resp.Status)
+	}
+}
+
+func (c *httpClient) Unlock(id string) error {
+	if c.unlockAddress == nil {
+		return nil
+	}
+	info := &state.LockInfo{ID: id}
+	resp, _, err := c.do(c.unlockMethod, c.unlockAddress, info.Marshal())
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected HTTP status %v unlocking the state", resp.Status)
+	}
+	c.lockID = ""
+	return nil
+}
+
+// The `etcd` backend, using etcd's v2 keys API like Terraform's. It can't be
+// locked.
+type etcdClient struct {
+	client    *http.Client
+	endpoints []string
+	path      string
+	username  string
+	password  string
+}
+
+func newEtcdClient(config map[string]string) (*etcdClient, error) {
+	if err := checkBackendConfig(config, []string{"endpoints", "path"}, []string{"username", "password"}); err != nil {
+		return nil, err
+	}
+	return &etcdClient{
+		client:    &http.Client{},
+		endpoints: strings.Fields(config["endpoints"]),
+		path:      strings.TrimPrefix(config["path"], "/"),
+		username:  config["username"],
+		password:  config["password"],
+	}, nil
+}
+
+// Make a request to the first endpoint that answers.
+func (c *etcdClient) do(method string, query url.Values, form url.Values) (*http.Response, []byte, error) {
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		u := fmt.Sprintf("%s/v2/keys/%s", strings.TrimSuffix(endpoint, "/"), c.path)
+		if query != nil {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequest(method, u, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, nil, err
+		}
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if c.username != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp, body, err
+	}
+	return nil, nil, lastErr
+}
+
+func (c *etcdClient) Get() ([]byte, error) {
+	resp, body, err := c.do("GET", url.Values{"quorum": {"true"}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected HTTP status %v getting the state", resp.Status)
+	}
+
+	var result struct {
+		Node struct {
+			Value string `json:"value"`
+			Dir   bool   `json:"dir"`
+		} `json:"node"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if result.Node.Dir {
+		return nil, fmt.Errorf("%v is a directory", c.path)
+	}
+	if result.Node.Value == "" {
+		return nil, nil
+	}
+	return []byte(result.Node.Value), nil
+}
+
+func (c *etcdClient) Put(data []byte) error {
+	resp, _, err := c.do("PUT", nil, url.Values{"value": {string(data)}})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Unexpected HTTP status %v pushing the state", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/terraform/state"
+)
+
+// The `consul` backend, using the Consul API client the way Terraform's
+// Consul client does. It's locked with a Consul lock on `<path>/.lock`, with
+// the lock info in `<path>/.lockinfo`.
+//
+// The lock isn't reacquired if it's lost, since it's only held while the
+// state is checked and pushed. Pushing is a check-and-set against the state
+// read, so it can't overwrite a change made if the lock was lost anyway.
+type consulClient struct {
+	client      *consulapi.Client
+	path        string
+	gzip        bool
+	lockEnabled bool
+
+	// The index of the state last read, to check-and-set against.
+	modifyIndex uint64
+	lock        *consulapi.Lock
+	lockCh      <-chan struct{}
+}
+
+const (
+	consulLockSuffix     = "/.lock"
+	consulLockInfoSuffix = "/.lockinfo"
+)
+
+func newConsulClient(config map[string]string) (*consulClient, error) {
+	err := checkBackendConfig(config, []string{"path"}, []string{
+		"address", "scheme", "datacenter", "access_token", "http_auth", "gzip", "lock",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	apiConfig := consulapi.DefaultConfig()
+	for k, setting := range map[string]*string{
+		"address": &apiConfig.Address, "scheme": &apiConfig.Scheme,
+		"datacenter": &apiConfig.Datacenter, "access_token": &apiConfig.Token,
+	} {
+		if config[k] != "" {
+			*setting = config[k]
+		}
+	}
+	if auth := config["http_auth"]; auth != "" {
+		parts := strings.SplitN(auth, ":", 2)
+		apiConfig.HttpAuth = &consulapi.HttpBasicAuth{Username: parts[0]}
+		if len(parts) == 2 {
+			apiConfig.HttpAuth.Password = parts[1]
+		}
+	}
+	client, err := consulapi.NewClient(apiConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &consulClient{client: client, path: strings.Trim(config["path"], "/"), lockEnabled: true}
+	if c.gzip, err = backendBool(config, "gzip"); err != nil {
+		return nil, err
+	}
+	if config["lock"] != "" {
+		if c.lockEnabled, err = backendBool(config, "lock"); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *consulClient) Get() ([]byte, error) {
+	pair, _, err := c.client.KV().Get(c.path, nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	c.modifyIndex = pair.ModifyIndex
+
+	data := pair.Value
+	// Gzipped by the `gzip` setting, by us or Terraform.
+	if len(data) != 0 && data[0] == '\x1f' {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data, nil
+}
+
+func (c *consulClient) Put(data []byte) error {
+	if c.gzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	// With a ModifyIndex of 0 it's only written if there's no state yet.
+	ok, _, err := c.client.KV().CAS(&consulapi.KVPair{Key: c.path, Value: data, ModifyIndex: c.modifyIndex}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("The state in Consul changed while it was being pushed")
+	}
+	return nil
+}
+
+// With `lock` set to false the state isn't locked, as with Terraform.
+func (c *consulClient) Lock(info *state.LockInfo) (string, error) {
+	if !c.lockEnabled {
+		return "", nil
+	}
+
+	lock, err := c.client.LockOpts(&consulapi.LockOptions{
+		Key:         c.path + consulLockSuffix,
+		SessionName: lockOperation,
+		// Only wait briefly, like Terraform, rather than until it's free.
+		LockWaitTime: time.Second,
+		LockTryOnce:  true,
+	})
+	if err != nil {
+		return "", err
+	}
+	lockCh, err := lock.Lock(nil)
+	if err != nil {
+		return "", &state.LockError{Err: err}
+	}
+	if lockCh == nil {
+		lockErr := &state.LockError{Err: fmt.Errorf("The state is already locked")}
+		if pair, _, err := c.client.KV().Get(c.path+consulLockInfoSuffix, nil); err == nil && pair != nil {
+			var existing state.LockInfo
+			if json.Unmarshal(pair.Value, &existing) == nil {
+				lockErr.Info = &existing
+			}
+		}
+		return "", lockErr
+	}
+	c.lock, c.lockCh = lock, lockCh
+
+	info.Path = c.path
+	if _, err := c.client.KV().Put(&consulapi.KVPair{Key: c.path + consulLockInfoSuffix, Value: info.Marshal()}, nil); err != nil {
+		c.Unlock(info.ID)
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// The lock belongs to the client rather than the ID.
+func (c *consulClient) Unlock(id string) error {
+	if c.lock == nil {
+		return nil
+	}
+	lock := c.lock
+	c.lock = nil
+
+	select {
+	case <-c.lockCh:
+		// Someone else's lock info may be there by now. Unlocking stops the
+		// session being renewed.
+		lock.Unlock()
+		return fmt.Errorf("The Consul lock on the state was lost")
+	default:
+	}
+	_, err := c.client.KV().Delete(c.path+consulLockInfoSuffix, nil)
+	if unlockErr := lock.Unlock(); err == nil {
+		err = unlockErr
+	}
+	// Only cleanup, which fails if another client took the lock straight away.
+	lock.Destroy()
+	return err
+}
@@ -0,0 +1,255 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/hashicorp/terraform/state"
+)
+
+// The `s3` backend. With a `dynamodb_table` it's locked with an item keyed
+// by `<bucket>/<key>`, and the MD5 of the state is kept in another with `-md5`
+// added, which Terraform checks when it reads the state; this keeps both the
+// same way Terraform's S3 client does.
+type s3Client struct {
+	s3        s3iface.S3API
+	dynamoDB  dynamodbiface.DynamoDBAPI
+	bucket    string
+	key       string
+	encrypt   bool
+	acl       string
+	kmsKeyID  string
+	lockTable string
+}
+
+// What Terraform adds to the lock's key for the item with the state's MD5.
+const s3DigestSuffix = "-md5"
+
+func newS3Client(config map[string]string) (*s3Client, error) {
+	err := checkBackendConfig(config, []string{"bucket", "key", "region"}, []string{
+		"endpoint", "dynamodb_endpoint", "dynamodb_table", "lock_table", "encrypt", "acl", "kms_key_id",
+		"access_key", "secret_key", "token", "profile", "force_path_style",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt, err := backendBool(config, "encrypt")
+	if err != nil {
+		return nil, err
+	}
+	forcePathStyle, err := backendBool(config, "force_path_style")
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           config["profile"],
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	awsConfig := &aws.Config{Region: aws.String(config["region"])}
+	if config["access_key"] != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config["access_key"], config["secret_key"], config["token"])
+	}
+
+	s3Config := awsConfig.Copy().WithS3ForcePathStyle(forcePathStyle)
+	if config["endpoint"] != "" {
+		s3Config.Endpoint = aws.String(config["endpoint"])
+	}
+	dynamoDBConfig := awsConfig.Copy()
+	if config["dynamodb_endpoint"] != "" {
+		dynamoDBConfig.Endpoint = aws.String(config["dynamodb_endpoint"])
+	}
+
+	lockTable := config["dynamodb_table"]
+	if lockTable == "" {
+		// The setting's old name.
+		lockTable = config["lock_table"]
+	}
+	return &s3Client{
+		s3:        s3.New(sess, s3Config),
+		dynamoDB:  dynamodb.New(sess, dynamoDBConfig),
+		bucket:    config["bucket"],
+		key:       config["key"],
+		encrypt:   encrypt,
+		acl:       config["acl"],
+		kmsKeyID:  config["kms_key_id"],
+		lockTable: lockTable,
+	}, nil
+}
+
+func (c *s3Client) lockPath() string {
+	return c.bucket + "/" + c.key
+}
+
+func (c *s3Client) Get() ([]byte, error) {
+	output, err := c.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.key),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	// S3 is eventually consistent, so check this is the state last pushed.
+	expected, err := c.getDigest()
+	if err != nil {
+		return nil, err
+	}
+	if sum := md5.Sum(data); expected != "" && expected != hex.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("The state in S3 doesn't have the MD5 %v in DynamoDB; it may not have been updated yet, so try again in a minute", expected)
+	}
+	return data, nil
+}
+
+func (c *s3Client) Put(data []byte) error {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(c.bucket),
+		Key:           aws.String(c.key),
+		Body:          bytes.NewReader(data),
+		ContentType:   aws.String("application/json"),
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+	if c.encrypt {
+		if c.kmsKeyID != "" {
+			input.SSEKMSKeyId = aws.String(c.kmsKeyID)
+			input.ServerSideEncryption = aws.String("aws:kms")
+		} else {
+			input.ServerSideEncryption = aws.String("AES256")
+		}
+	}
+	if c.acl != "" {
+		input.ACL = aws.String(c.acl)
+	}
+	if _, err := c.s3.PutObject(input); err != nil {
+		return err
+	}
+
+	if c.lockTable == "" {
+		return nil
+	}
+	sum := md5.Sum(data)
+	_, err := c.dynamoDB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(c.lockTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(c.lockPath() + s3DigestSuffix)},
+			"Digest": {S: aws.String(hex.EncodeToString(sum[:]))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Pushed the state, but could not store its MD5, so Terraform will refuse to read it until the Digest of %v in %v is set to %x: %v",
+			c.lockPath()+s3DigestSuffix, c.lockTable, sum, err)
+	}
+	return nil
+}
+
+// Get the MD5 of the state last pushed, or "" if there isn't one.
+func (c *s3Client) getDigest() (string, error) {
+	if c.lockTable == "" {
+		return "", nil
+	}
+	output, err := c.dynamoDB.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(c.lockTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(c.lockPath() + s3DigestSuffix)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if v, ok := output.Item["Digest"]; ok && v.S != nil {
+		return *v.S, nil
+	}
+	return "", nil
+}
+
+// Without a `dynamodb_table` the state isn't locked, as with Terraform.
+func (c *s3Client) Lock(info *state.LockInfo) (string, error) {
+	if c.lockTable == "" {
+		return "", nil
+	}
+	info.Path = c.lockPath()
+	_, err := c.dynamoDB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(c.lockTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(c.lockPath())},
+			"Info":   {S: aws.String(string(info.Marshal()))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+	})
+	if err != nil {
+		lockErr := &state.LockError{Err: err}
+		lockErr.Info, _ = c.getLockInfo()
+		return "", lockErr
+	}
+	return info.ID, nil
+}
+
+func (c *s3Client) getLockInfo() (*state.LockInfo, error) {
+	output, err := c.dynamoDB.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(c.lockTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(c.lockPath())},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	v, ok := output.Item["Info"]
+	if !ok || v.S == nil {
+		return nil, fmt.Errorf("No lock on %v", c.lockPath())
+	}
+	var info state.LockInfo
+	if err := json.Unmarshal([]byte(*v.S), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *s3Client) Unlock(id string) error {
+	if c.lockTable == "" {
+		return nil
+	}
+	info, err := c.getLockInfo()
+	if err != nil {
+		return &state.LockError{Err: err}
+	}
+	if info.ID != id {
+		return &state.LockError{Err: fmt.Errorf("The lock has ID %q, not %q", info.ID, id), Info: info}
+	}
+	_, err = c.dynamoDB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(c.lockTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(c.lockPath())},
+		},
+	})
+	return err
+}
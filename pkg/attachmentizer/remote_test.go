@@ -0,0 +1,483 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/hashicorp/terraform/state"
+)
+
+// A state server for the `http` backend, like the one in Terraform's tests.
+type fakeHTTPStateServer struct {
+	mu    sync.Mutex
+	data  []byte
+	lock  []byte
+	posts int
+}
+
+func (s *fakeHTTPStateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.Method {
+	case "GET":
+		if s.data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(s.data)
+	case "POST":
+		s.data = body
+		s.posts++
+	case "LOCK":
+		if s.lock != nil {
+			w.WriteHeader(http.StatusLocked)
+			w.Write(s.lock)
+			return
+		}
+		s.lock = body
+	case "UNLOCK":
+		s.lock = nil
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Run the conversion of `testV4State` in a backend, in a temporary working
+// directory for the backup.
+func applyInBackend(t *testing.T, backend *BackendConfig) (*Result, error) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	converter, err := NewConverter(Options{
+		Backend:       backend,
+		EC2:           testEC2Source(),
+		ConfigOutPath: "config.tf",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := converter.Plan()
+	if err != nil {
+		return nil, err
+	}
+	result, err := converter.Apply(plan)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := ioutil.ReadFile(result.BackupPath)
+	if err != nil || string(backup) != testV4State {
+		t.Errorf("Expected the state to be backed up to %v, got %v", result.BackupPath, err)
+	}
+	return result, nil
+}
+
+func checkPushedState(t *testing.T, data []byte) {
+	pushed, err := parseV4State(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Serial != 8 || len(pushed.Resources) != 3 {
+		t.Errorf("Expected the volume and attachment to be pushed at serial 8, got %+v", pushed)
+	}
+}
+
+func TestHTTPBackend(t *testing.T) {
+	stateServer := &fakeHTTPStateServer{data: []byte(testV4State)}
+	server := httptest.NewServer(stateServer)
+	defer server.Close()
+	backend := &BackendConfig{Type: "http", Config: map[string]string{
+		"address":        server.URL + "/state",
+		"lock_address":   server.URL + "/state",
+		"unlock_address": server.URL + "/state",
+	}}
+
+	stateServer.lock = state.NewLockInfo().Marshal()
+	if _, err := applyInBackend(t, backend); err == nil || !strings.Contains(err.Error(), "Could not lock") {
+		t.Errorf("Expected the locked state to be refused, got %v", err)
+	}
+	if stateServer.posts != 0 {
+		t.Errorf("Expected nothing to be pushed while locked")
+	}
+
+	stateServer.lock = nil
+	result, err := applyInBackend(t, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Backend != "http" || result.StatePath != "" {
+		t.Errorf("Expected the state to be pushed to the backend, got %+v", result)
+	}
+	checkPushedState(t, stateServer.data)
+	if stateServer.lock != nil {
+		t.Errorf("Expected the state to be unlocked")
+	}
+}
+
+// Consul's KV store and sessions, as much as the client uses.
+type fakeConsul struct {
+	mu       sync.Mutex
+	keys     map[string]*fakeConsulKey
+	index    uint64
+	sessions int
+	// Closed when a key is written, for blocking queries.
+	changed chan struct{}
+}
+
+type fakeConsulKey struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+	Flags       uint64
+	Session     string
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{keys: map[string]*fakeConsulKey{}, changed: make(chan struct{})}
+}
+
+func (c *fakeConsul) set(key string, value []byte) {
+	c.keys[key] = &fakeConsulKey{Key: key, Value: value}
+	c.touch(key)
+}
+
+func (c *fakeConsul) touch(key string) {
+	c.index++
+	if k := c.keys[key]; k != nil {
+		k.ModifyIndex = c.index
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	query := r.URL.Query()
+
+	// A blocking query waits for a write after its index, or its wait time.
+	if index, _ := strconv.ParseUint(query.Get("index"), 10, 64); index != 0 && index >= c.index {
+		wait, err := time.ParseDuration(query.Get("wait"))
+		if err != nil || wait > time.Second {
+			wait = time.Second
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+		c.mu.Lock()
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		c.sessions++
+		fmt.Fprintf(w, `{"ID": "session-%d"}`, c.sessions)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		fmt.Fprintf(w, `[{"ID": %q}]`, strings.TrimPrefix(r.URL.Path, "/v1/session/renew/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		fmt.Fprint(w, "true")
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		existing := c.keys[key]
+		var index uint64
+		if existing != nil {
+			index = existing.ModifyIndex
+		}
+		cas, casErr := strconv.ParseUint(query.Get("cas"), 10, 64)
+		if casErr == nil && cas != index {
+			fmt.Fprint(w, "false")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if existing == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode([]interface{}{existing})
+		case "DELETE":
+			delete(c.keys, key)
+			c.touch(key)
+			fmt.Fprint(w, "true")
+		case "PUT":
+			k := &fakeConsulKey{Key: key, Value: body}
+			if existing != nil {
+				k.Session = existing.Session
+			}
+			k.Flags, _ = strconv.ParseUint(query.Get("flags"), 10, 64)
+			switch {
+			case query.Get("acquire") != "":
+				if k.Session != "" && k.Session != query.Get("acquire") {
+					fmt.Fprint(w, "false")
+					return
+				}
+				k.Session = query.Get("acquire")
+			case query.Get("release") != "":
+				if k.Session == query.Get("release") {
+					k.Session = ""
+				}
+			}
+			c.keys[key] = k
+			c.touch(key)
+			fmt.Fprint(w, "true")
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestConsulBackend(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("tf/state", []byte(testV4State))
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	backend := &BackendConfig{Type: "consul", Config: map[string]string{
+		"address": strings.TrimPrefix(server.URL, "http://"),
+		"path":    "tf/state",
+	}}
+
+	// Hold the lock with another client.
+	other, err := newConsulClient(backend.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := state.NewLockInfo()
+	id, err := other.Lock(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyInBackend(t, backend); err == nil || !strings.Contains(err.Error(), info.ID) {
+		t.Errorf("Expected the locked state to be refused with the lock's ID, got %v", err)
+	}
+	if err := other.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := applyInBackend(t, backend); err != nil {
+		t.Fatal(err)
+	}
+	checkPushedState(t, consul.keys["tf/state"].Value)
+	if lock, ok := consul.keys["tf/state/.lock"]; ok {
+		t.Errorf("Expected the lock to be released and removed, got %+v", lock)
+	}
+	if _, ok := consul.keys["tf/state/.lockinfo"]; ok {
+		t.Errorf("Expected the lock info to be removed")
+	}
+}
+
+func TestConsulBackendGzipAndCAS(t *testing.T) {
+	consul := newFakeConsul()
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	client, err := newConsulClient(map[string]string{"address": server.URL, "path": "tf/state", "gzip": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := client.Get(); err != nil || data != nil {
+		t.Errorf("Expected no state, got %q and %v", data, err)
+	}
+	if err := client.Put([]byte(testV4State)); err != nil {
+		t.Fatal(err)
+	}
+	if consul.keys["tf/state"].Value[0] != '\x1f' {
+		t.Errorf("Expected the state to be stored gzipped")
+	}
+	data, err := client.Get()
+	if err != nil || string(data) != testV4State {
+		t.Errorf("Expected the state back, got %q and %v", data, err)
+	}
+
+	// Changed by someone else since it was read.
+	consul.set("tf/state", []byte(testV4State))
+	if err := client.Put([]byte(testV4State)); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("Expected the check-and-set to fail, got %v", err)
+	}
+}
+
+// S3 and DynamoDB in memory, as much as the client uses.
+type fakeS3 struct {
+	s3iface.S3API
+	dynamodbiface.DynamoDBAPI
+	objects map[string][]byte
+	items   map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, items: map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+func (f *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	f.objects[*input.Bucket+"/"+*input.Key] = data
+	return &s3.PutObjectOutput{}, err
+}
+
+func (f *fakeS3) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	key := *input.Item["LockID"].S
+	if _, ok := f.items[key]; ok && input.ConditionExpression != nil {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "exists", nil)
+	}
+	f.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeS3) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[*input.Key["LockID"].S]}, nil
+}
+
+func (f *fakeS3) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	delete(f.items, *input.Key["LockID"].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestS3Backend(t *testing.T) {
+	fake := newFakeS3()
+	newClient := func() *s3Client {
+		return &s3Client{s3: fake, dynamoDB: fake, bucket: "bucket", key: "env/terraform.tfstate", lockTable: "locks"}
+	}
+	client := newClient()
+	if err := client.Put([]byte(testV4State)); err != nil {
+		t.Fatal(err)
+	}
+	if fake.items["bucket/env/terraform.tfstate-md5"] == nil {
+		t.Errorf("Expected the state's MD5 to be stored")
+	}
+	if data, err := client.Get(); err != nil || string(data) != testV4State {
+		t.Errorf("Expected the state back, got %q and %v", data, err)
+	}
+
+	id, err := client.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newClient().Lock(state.NewLockInfo()); err == nil || !strings.Contains(err.Error(), id) {
+		t.Errorf("Expected the second lock to fail with the first's ID, got %v", err)
+	}
+	if err := newClient().Unlock("another"); err == nil {
+		t.Errorf("Expected unlocking with the wrong ID to fail")
+	}
+	if err := client.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.items["bucket/env/terraform.tfstate"]; ok {
+		t.Errorf("Expected the lock to be removed")
+	}
+
+	// Not yet consistent with the MD5 of the last push.
+	fake.objects["bucket/env/terraform.tfstate"] = []byte(`{"version": 4}`)
+	if _, err := client.Get(); err == nil || !strings.Contains(err.Error(), "MD5") {
+		t.Errorf("Expected the stale state to be refused, got %v", err)
+	}
+}
+
+func TestEtcdBackend(t *testing.T) {
+	var value string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/keys/tf/state" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if value == "" {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errorCode": 100}`)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"node": map[string]string{"value": value}})
+		case "PUT":
+			r.ParseForm()
+			value = r.PostForm.Get("value")
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	client, err := newEtcdClient(map[string]string{"endpoints": "http://127.0.0.1:1 " + server.URL, "path": "/tf/state"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := client.Get(); err != nil || data != nil {
+		t.Errorf("Expected no state, got %q and %v", data, err)
+	}
+	if err := client.Put([]byte(testV4State)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := client.Get(); err != nil || string(data) != testV4State {
+		t.Errorf("Expected the state back, got %q and %v", data, err)
+	}
+}
+
+func TestBackendConfig(t *testing.T) {
+	var testCases = []struct {
+		backend BackendConfig
+		err     string
+	}{
+		{BackendConfig{"http", map[string]string{"address": "https://example.com/state"}}, ""},
+		{BackendConfig{"http", map[string]string{"address": "ftp://example.com/state"}}, "HTTP or HTTPS"},
+		{BackendConfig{"http", map[string]string{}}, "Missing setting address"},
+		{BackendConfig{"consul", map[string]string{"path": "tf", "lock": "maybe"}}, "lock must be a boolean"},
+		{BackendConfig{"etcd", map[string]string{"path": "tf", "endpoints": "http://etcd", "bucket": "b"}}, "Unknown settings bucket"},
+		{BackendConfig{"s3", map[string]string{"bucket": "b", "key": "k", "region": "us-east-1", "dynamodb_table": "locks"}}, ""},
+		{BackendConfig{"gcs", map[string]string{}}, "Unsupported backend"},
+	}
+
+	for i, tt := range testCases {
+		_, err := newRemoteClient(&tt.backend)
+		if tt.err == "" && err != nil {
+			t.Errorf("[%d] Unexpected error: %v", i, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("[%d] Expected an error with %q, got %v", i, tt.err, err)
+		}
+	}
+
+	backend := &BackendConfig{"s3", map[string]string{"bucket": "b", "access_key": "AKIA", "secret_key": "secret"}}
+	if config := backend.withoutSecrets().Config; len(config) != 1 || config["bucket"] != "b" {
+		t.Errorf("Expected only the bucket to be kept, got %v", config)
+	}
+	if _, err := ParseBackendConfig([]string{"bucket=b", "key"}); err == nil {
+		t.Errorf("Expected a setting without a value to be refused")
+	}
+}
@@ -0,0 +1,297 @@
+package attachmentizer
+
+// This file handles going the other way: folding `aws_ebs_volume` and
+// `aws_volume_attachment` resources back into `ebs_block_device` blocks on the
+// instance they're attached to.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	tfhash "github.com/hashicorp/terraform/helper/hashcode"
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// Get the hash Terraform uses as the key of an `ebs_block_device` in the
+// instance's set of them.
+//
+// From
+//    https://github.com/hashicorp/terraform/blob/v0.9.8/builtin/providers/aws/resource_aws_instance.go#L311-L317
+func (dev *BlockDevice) ebsBlockDeviceHash() int {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%s-", dev.deviceName.LongName()))
+	buf.WriteString(fmt.Sprintf("%s-", dev.snapshotId))
+
+	return tfhash.String(buf.String())
+}
+
+// Make a map of the attributes of an `ebs_block_device` block, the reverse of
+// `makeVolumeAttrs` and `makeAttachmentAttrs`.
+func (dev *BlockDevice) makeEbsBlockDeviceAttrs() map[string]string {
+	attrs := make(map[string]string)
+
+	attrs["delete_on_termination"] = dev.deleteOnTermination
+	attrs["device_name"] = dev.deviceName.LongName()
+	attrs["encrypted"] = dev.encrypted
+	attrs["iops"] = strconv.Itoa(dev.iops)
+	attrs["snapshot_id"] = dev.snapshotId
+	attrs["volume_size"] = strconv.Itoa(dev.size)
+	attrs["volume_type"] = dev.volumeType
+
+	return attrs
+}
+
+// Rebuild a block device from the attributes of an `aws_ebs_volume` and the
+// `aws_volume_attachment` attaching it to an instance.
+func blockDeviceFromResources(instanceResName *TerraformName, volumeAttrs map[string]string, attachmentAttrs map[string]string) (BlockDevice, error) {
+	size, err := strconv.Atoi(volumeAttrs["size"])
+	if err != nil {
+		return BlockDevice{}, fmt.Errorf("Invalid size for volume %v: %v", volumeAttrs["id"], err)
+	}
+	iops := 0
+	if volumeAttrs["iops"] != "" {
+		iops, err = strconv.Atoi(volumeAttrs["iops"])
+		if err != nil {
+			return BlockDevice{}, fmt.Errorf("Invalid iops for volume %v: %v", volumeAttrs["id"], err)
+		}
+	}
+	encrypted := volumeAttrs["encrypted"]
+	if encrypted == "" {
+		encrypted = "false"
+	}
+
+	return BlockDevice{
+		volumeID:   volumeAttrs["id"],
+		size:       size,
+		volumeType: volumeAttrs["type"],
+		// Volumes attached with `aws_volume_attachment` aren't deleted with
+		// the instance, and the next refresh will pick up the real value.
+		deleteOnTermination: "false",
+		deviceName:          NewDeviceName(attachmentAttrs["device_name"]),
+		encrypted:           encrypted,
+		iops:                iops,
+		snapshotId:          volumeAttrs["snapshot_id"],
+
+		instanceID:       attachmentAttrs["instance_id"],
+		availabilityZone: volumeAttrs["availability_zone"],
+		instanceResName:  instanceResName,
+	}, nil
+}
+
+// Where a resource lives in a legacy state.
+type resourceLocation struct {
+	module *tf.ModuleState
+	name   string
+	res    *tf.ResourceState
+}
+
+// Index the resources of the given type in every module by their ID.
+func indexResourcesByID(state *tf.State, resourceType string) map[string]resourceLocation {
+	index := make(map[string]resourceLocation)
+	for _, module := range state.Modules {
+		for name, res := range module.Resources {
+			if res.Type == resourceType && res.Primary != nil {
+				index[res.Primary.ID] = resourceLocation{module, name, res}
+			}
+		}
+	}
+	return index
+}
+
+// Undo The Conversion on the Terraform state file. Returns the new terraform
+// state, and the `ebs_block_device` blocks to add to the instances' config.
+func generateRevertedTFState(stateToModify *tf.State) (*tf.State, string, error) {
+	outState := stateToModify.DeepCopy()
+	instances := indexResourcesByID(outState, "aws_instance")
+	volumes := indexResourcesByID(outState, "aws_ebs_volume")
+	attachments := indexResourcesByID(outState, "aws_volume_attachment")
+
+	var revertedDevs []BlockDevice
+	for _, attachment := range attachments {
+		attachmentAttrs := attachment.res.Primary.Attributes
+		instance, ok := instances[attachmentAttrs["instance_id"]]
+		if !ok {
+			// Only fold volumes into instances we know about.
+			continue
+		}
+		volume, ok := volumes[attachmentAttrs["volume_id"]]
+		if !ok {
+			return nil, "", fmt.Errorf("Could not find aws_ebs_volume for %v in %v", attachment.name, modulePathString(attachment.module.Path))
+		}
+
+		instanceResName, err := ParseTerraformName(instance.name)
+		if err != nil {
+			return nil, "", err
+		}
+		dev, err := blockDeviceFromResources(instanceResName, volume.res.Primary.Attributes, attachmentAttrs)
+		if err != nil {
+			return nil, "", err
+		}
+		dev.modulePath = instance.module.Path
+
+		addEbsBlockDevice(instance.res.Primary.Attributes, dev)
+		delete(volume.module.Resources, volume.name)
+		delete(attachment.module.Resources, attachment.name)
+
+		revertedDevs = append(revertedDevs, dev)
+	}
+
+	config, err := genRevertConfig(revertedDevs)
+	if err != nil {
+		return nil, "", err
+	}
+	return outState, config, nil
+}
+
+// Add the flatmapped attributes of an `ebs_block_device` to an instance's
+// attributes, and bump the count.
+func addEbsBlockDevice(attrs map[string]string, dev BlockDevice) {
+	count, _ := strconv.Atoi(attrs["ebs_block_device.#"])
+	prefix := fmt.Sprintf("ebs_block_device.%d", dev.ebsBlockDeviceHash())
+	if _, ok := attrs[prefix+".device_name"]; !ok {
+		count++
+	}
+	for k, v := range dev.makeEbsBlockDeviceAttrs() {
+		attrs[fmt.Sprintf("%s.%s", prefix, k)] = v
+	}
+	attrs["ebs_block_device.#"] = strconv.Itoa(count)
+}
+
+// The version 4 equivalent of `generateRevertedTFState`.
+func generateRevertedV4State(stateToModify *stateV4) (*stateV4, string, error) {
+	outState, err := stateToModify.deepCopy()
+	if err != nil {
+		return nil, "", err
+	}
+
+	type v4Location struct {
+		res  *resourceV4
+		inst *instanceV4
+	}
+	byID := func(resourceType string) (map[string]v4Location, error) {
+		index := make(map[string]v4Location)
+		for _, res := range outState.Resources {
+			if res.Mode != "managed" || res.Type != resourceType {
+				continue
+			}
+			for _, inst := range res.Instances {
+				attrs, err := v4StringAttrs(inst.Attributes)
+				if err != nil {
+					return nil, fmt.Errorf("Could not read attributes of %v: %v", v4ResourceAddr(res.Module, res.Type, res.Name), err)
+				}
+				if inst.Deposed == "" {
+					index[attrs["id"]] = v4Location{res, inst}
+				}
+			}
+		}
+		return index, nil
+	}
+	instances, err := byID("aws_instance")
+	if err != nil {
+		return nil, "", err
+	}
+	volumes, err := byID("aws_ebs_volume")
+	if err != nil {
+		return nil, "", err
+	}
+	attachments, err := byID("aws_volume_attachment")
+	if err != nil {
+		return nil, "", err
+	}
+
+	removed := make(map[*instanceV4]struct{})
+	var revertedDevs []BlockDevice
+	for _, attachment := range attachments {
+		attachmentAttrs, _ := v4StringAttrs(attachment.inst.Attributes)
+		instance, ok := instances[attachmentAttrs["instance_id"]]
+		if !ok {
+			continue
+		}
+		volume, ok := volumes[attachmentAttrs["volume_id"]]
+		if !ok {
+			return nil, "", fmt.Errorf("Could not find aws_ebs_volume for %v", v4ResourceAddr(attachment.res.Module, attachment.res.Type, attachment.res.Name))
+		}
+		volumeAttrs, _ := v4StringAttrs(volume.inst.Attributes)
+
+		instanceResName, err := v4TerraformName(instance.res, instance.inst)
+		if err != nil {
+			return nil, "", err
+		}
+		dev, err := blockDeviceFromResources(instanceResName, volumeAttrs, attachmentAttrs)
+		if err != nil {
+			return nil, "", err
+		}
+		dev.modulePath = v4ModulePath(instance.res.Module)
+
+		instance.inst.Attributes, err = v4AddEbsBlockDevice(instance.inst.Attributes, dev)
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not add ebs_block_device to %v: %v", v4ResourceAddr(instance.res.Module, instance.res.Type, instance.res.Name), err)
+		}
+		removed[volume.inst] = struct{}{}
+		removed[attachment.inst] = struct{}{}
+
+		revertedDevs = append(revertedDevs, dev)
+	}
+
+	// Drop the folded instances, and any resources left without instances.
+	var resources []*resourceV4
+	for _, res := range outState.Resources {
+		var kept []*instanceV4
+		for _, inst := range res.Instances {
+			if _, ok := removed[inst]; !ok {
+				kept = append(kept, inst)
+			}
+		}
+		if len(kept) == 0 && len(res.Instances) != 0 {
+			continue
+		}
+		res.Instances = kept
+		resources = append(resources, res)
+	}
+	outState.Resources = resources
+	// Bumped only for a change, like the conversion.
+	if len(revertedDevs) != 0 {
+		outState.Serial++
+	}
+
+	config, err := genRevertConfig(revertedDevs)
+	if err != nil {
+		return nil, "", err
+	}
+	return outState, config, nil
+}
+
+// Read version 4 attributes as strings, like the legacy format has them.
+func v4StringAttrs(attrsJSON json.RawMessage) (map[string]string, error) {
+	attrs, err := decodeV4Attrs(attrsJSON)
+	if err != nil {
+		return nil, err
+	}
+	stringAttrs, ok := mapify([]interface{}{attrs})
+	if !ok {
+		return nil, fmt.Errorf("Could not mapify")
+	}
+	return stringAttrs[0], nil
+}
+
+// Append an `ebs_block_device` to a version 4 instance's attributes.
+func v4AddEbsBlockDevice(attrsJSON json.RawMessage, dev BlockDevice) (json.RawMessage, error) {
+	attrs, err := decodeV4Attrs(attrsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	devJSON, err := v4TypedAttrs(dev.makeEbsBlockDeviceAttrs())
+	if err != nil {
+		return nil, err
+	}
+	var devices []interface{}
+	if existing, ok := attrs["ebs_block_device"].([]interface{}); ok {
+		devices = existing
+	}
+	attrs["ebs_block_device"] = append(devices, devJSON)
+
+	return json.Marshal(attrs)
+}
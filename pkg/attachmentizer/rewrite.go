@@ -0,0 +1,375 @@
+package attachmentizer
+
+// This file handles rewriting the existing config in place, rather than
+// suggesting a config to copy from: the converted `ebs_block_device` blocks are
+// removed from their `aws_instance` resources, and the new resources are added
+// right after them. Everything else in the files is left as it was.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/parser"
+	"github.com/hashicorp/hcl/hcl/token"
+	"github.com/hashicorp/terraform/config"
+)
+
+// Find the config directory of each module, keyed by module path, following
+// local module sources from the root module's directory. Modules from
+// anywhere else can't be rewritten, so they're left out, with a warning in
+// `warns`.
+func moduleConfigDirs(rootDir string, warns *warnings) (map[string]string, error) {
+	dirs := make(map[string]string)
+
+	var walk func(path []string, dir string) error
+	walk = func(path []string, dir string) error {
+		cfg, err := config.LoadDir(dir)
+		if err != nil {
+			return err
+		}
+		dirs[modulePathString(path)] = dir
+
+		for _, module := range cfg.Modules {
+			modulePath := append(append([]string(nil), path...), module.Name)
+			if !isLocalSource(module.Source) {
+				warns.addf("Not rewriting the config of %v: only local module sources are supported, not %q",
+					modulePathString(modulePath), module.Source)
+				continue
+			}
+			if err := walk(modulePath, filepath.Join(dir, module.Source)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk([]string{"root"}, rootDir); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+func isLocalSource(source string) bool {
+	return strings.HasPrefix(source, "./") || strings.HasPrefix(source, "../") || filepath.IsAbs(source)
+}
+
+// Get the text of an object key, without quotes.
+func objectKeyText(key *ast.ObjectKey) string {
+	if key.Token.Type == token.STRING {
+		if text, err := strconv.Unquote(key.Token.Text); err == nil {
+			return text
+		}
+	}
+	return key.Token.Text
+}
+
+// Find the `resource "aws_instance" "name"` block in a parsed file.
+func findInstanceItem(file *ast.File, name string) *ast.ObjectItem {
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil
+	}
+	for _, item := range list.Items {
+		if len(item.Keys) != 3 {
+			continue
+		}
+		if objectKeyText(item.Keys[0]) == "resource" && objectKeyText(item.Keys[1]) == "aws_instance" && objectKeyText(item.Keys[2]) == name {
+			return item
+		}
+	}
+	return nil
+}
+
+// Get the `device_name` of an `ebs_block_device` block, if it's a plain string.
+func blockDeviceItemName(item *ast.ObjectItem) (DeviceName, bool) {
+	obj, ok := item.Val.(*ast.ObjectType)
+	if !ok {
+		return DeviceName{}, false
+	}
+	for _, attr := range obj.List.Items {
+		if len(attr.Keys) != 1 || objectKeyText(attr.Keys[0]) != "device_name" {
+			continue
+		}
+		lit, ok := attr.Val.(*ast.LiteralType)
+		if !ok || lit.Token.Type != token.STRING {
+			return DeviceName{}, false
+		}
+		name, err := strconv.Unquote(lit.Token.Text)
+		if err != nil || strings.Contains(name, "${") {
+			return DeviceName{}, false
+		}
+		return NewDeviceName(name), true
+	}
+	return DeviceName{}, false
+}
+
+// A replacement of the bytes `[start, end)` of a file.
+type textEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+// Apply edits that don't overlap, from the end so the offsets stay valid.
+func applyEdits(src []byte, edits []textEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+
+	out := append([]byte(nil), src...)
+	for _, edit := range edits {
+		out = append(out[:edit.start], append([]byte(edit.text), out[edit.end:]...)...)
+	}
+	return out
+}
+
+// Get the range of whole lines an item takes up, including its lead comment.
+// If that would leave two blank lines together, or a blank line at the start
+// or end of a block, one of them is included too.
+func itemLineRange(src []byte, item *ast.ObjectItem) (int, int) {
+	start := item.Pos().Offset
+	if item.LeadComment != nil {
+		start = item.LeadComment.Pos().Offset
+	}
+	end := item.Val.(*ast.ObjectType).Rbrace.Offset + 1
+
+	for start > 0 && (src[start-1] == ' ' || src[start-1] == '\t') {
+		start--
+	}
+	if i := bytes.IndexByte(src[end:], '\n'); i != -1 && len(bytes.TrimSpace(src[end:end+i])) == 0 {
+		end += i + 1
+	}
+
+	before := string(src[:start])
+	nextLine := string(src[end:])
+	if i := strings.IndexByte(nextLine, '\n'); i != -1 {
+		nextLine = nextLine[:i]
+	}
+	nextLine = strings.TrimSpace(nextLine)
+
+	switch {
+	case (strings.HasSuffix(before, "\n\n") || strings.HasSuffix(before, "{\n")) && nextLine == "":
+		end += strings.IndexByte(string(src[end:]), '\n') + 1
+	case strings.HasSuffix(before, "\n\n") && strings.HasPrefix(nextLine, "}"):
+		start--
+	}
+	return start, end
+}
+
+// A config file rewritten in memory, to be written once the state is.
+type rewrittenFile struct {
+	path string
+	data []byte
+	mode os.FileMode
+}
+
+func (f rewrittenFile) write() error {
+	return ioutil.WriteFile(f.path, f.data, f.mode)
+}
+
+// Rewrite a single config file: remove the `ebs_block_device` blocks of the
+// converted devices from their instances, and add the config for the devices
+// after them. Returns the devices that were placed, and the file's new
+// contents if any were.
+func rewriteConfigFile(path string, instanceDevs map[string][]BlockDevice, opts configOptions) ([]BlockDevice, *rewrittenFile, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := parser.Parse(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not parse %v: %v", path, err)
+	}
+
+	var edits []textEdit
+	var placed []BlockDevice
+	for _, name := range sortedKeys(instanceDevs) {
+		item := findInstanceItem(file, name)
+		if item == nil {
+			continue
+		}
+		obj, ok := item.Val.(*ast.ObjectType)
+		if !ok {
+			continue
+		}
+
+		devs := instanceDevs[name]
+		converted := make(map[DeviceName]bool)
+		for _, dev := range devs {
+			converted[dev.StateDeviceName()] = true
+		}
+
+		for _, blockItem := range obj.List.Items {
+			if len(blockItem.Keys) != 1 || objectKeyText(blockItem.Keys[0]) != "ebs_block_device" {
+				continue
+			}
+			deviceName, ok := blockDeviceItemName(blockItem)
+			if !ok {
+				opts.warnings.addf("Leaving an ebs_block_device of aws_instance.%v in %v: its device_name isn't a plain string", name, path)
+				continue
+			}
+			if !converted[deviceName] {
+				opts.warnings.addf("Leaving the ebs_block_device %v of aws_instance.%v in %v: it wasn't converted", deviceName, name, path)
+				continue
+			}
+			start, end := itemLineRange(src, blockItem)
+			edits = append(edits, textEdit{start, end, ""})
+		}
+
+		b := &configBuilder{opts: opts}
+		devConfig, err := printConfig(genModuleConfig(b, devs, opts))
+		if err != nil {
+			return nil, nil, err
+		}
+		devConfig = strings.TrimRight(devConfig, "\n")
+		end := obj.Rbrace.Offset + 1
+		edits = append(edits, textEdit{end, end, "\n\n" + devConfig})
+		placed = append(placed, devs...)
+	}
+
+	if len(edits) == 0 {
+		return nil, nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return placed, &rewrittenFile{path, applyEdits(src, edits), info.Mode()}, nil
+}
+
+// Rewrite the files of a single module's config directory for its devices.
+// Returns the devices whose instances couldn't be found, and the rewritten
+// files.
+func rewriteModuleDir(dir string, devs []BlockDevice, opts configOptions) ([]BlockDevice, []rewrittenFile, error) {
+	instanceDevs := make(map[string][]BlockDevice)
+	for _, dev := range devs {
+		name := dev.instanceResName.name
+		instanceDevs[name] = append(instanceDevs[name], dev)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.tf"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(files)
+	var rewritten []rewrittenFile
+	for _, file := range files {
+		base := filepath.Base(file)
+		if base == "override.tf" || strings.HasSuffix(base, "_override.tf") {
+			continue
+		}
+		placed, rewrittenFile, err := rewriteConfigFile(file, instanceDevs, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rewrittenFile != nil {
+			rewritten = append(rewritten, *rewrittenFile)
+		}
+		for _, dev := range placed {
+			delete(instanceDevs, dev.instanceResName.name)
+		}
+	}
+
+	var unplaced []BlockDevice
+	for _, name := range sortedKeys(instanceDevs) {
+		opts.warnings.addf("Could not find aws_instance.%v in %v", name, dir)
+		unplaced = append(unplaced, instanceDevs[name]...)
+	}
+	return unplaced, rewritten, nil
+}
+
+func sameRewrittenFiles(a, b []rewrittenFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].path != b[i].path || !bytes.Equal(a[i].data, b[i].data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rewrite the config in and under `rootDir` for the converted devices, in
+// memory. Returns the devices whose instances couldn't be found, whose config
+// still needs to go somewhere, and the rewritten files.
+//
+// A directory used as the source of several modules is only rewritten if
+// every one of them comes out the same, since they all share its files.
+// Otherwise the config for all their devices is left to go somewhere else.
+func rewriteConfigDir(rootDir string, devs []BlockDevice, opts configOptions) ([]BlockDevice, []rewrittenFile, error) {
+	dirs, err := moduleConfigDirs(rootDir, opts.warnings)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirPaths := make(map[string][]string)
+	for path, dir := range dirs {
+		dirPaths[dir] = append(dirPaths[dir], path)
+	}
+
+	var unplaced []BlockDevice
+	var rewritten []rewrittenFile
+	moduleMapping := getModuleMapping(devs)
+	done := make(map[string]bool)
+	for _, path := range sortedKeys(moduleMapping) {
+		dir, ok := dirs[path]
+		if !ok {
+			unplaced = append(unplaced, moduleMapping[path]...)
+			continue
+		}
+		if done[dir] {
+			continue
+		}
+		done[dir] = true
+
+		paths := dirPaths[dir]
+		sort.Strings(paths)
+		var dirUnplaced []BlockDevice
+		var dirRewritten []rewrittenFile
+		numWarnings := opts.warnings.len()
+		same := true
+		for i, sharedPath := range paths {
+			if len(moduleMapping[sharedPath]) == 0 {
+				same = false
+				break
+			}
+			// Only warn once about the files they share.
+			pathOpts := opts
+			if i != 0 {
+				pathOpts.warnings = nil
+			}
+			pathUnplaced, pathRewritten, err := rewriteModuleDir(dir, moduleMapping[sharedPath], pathOpts)
+			if err != nil {
+				return nil, nil, err
+			}
+			if i != 0 && !sameRewrittenFiles(dirRewritten, pathRewritten) {
+				same = false
+				break
+			}
+			dirUnplaced = append(dirUnplaced, pathUnplaced...)
+			dirRewritten = pathRewritten
+		}
+
+		if !same {
+			opts.warnings.truncate(numWarnings)
+			opts.warnings.addf("Not rewriting the config in %v: it's shared by %v, which weren't all converted the same way",
+				dir, strings.Join(paths, ", "))
+			for _, sharedPath := range paths {
+				unplaced = append(unplaced, moduleMapping[sharedPath]...)
+			}
+			continue
+		}
+		unplaced = append(unplaced, dirUnplaced...)
+		rewritten = append(rewritten, dirRewritten...)
+	}
+
+	return unplaced, rewritten, nil
+}
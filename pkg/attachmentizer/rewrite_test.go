@@ -0,0 +1,251 @@
+package attachmentizer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRewriteConfig = `# The web servers.
+resource "aws_instance" "web" {
+  ami           = "ami-123456"
+  instance_type = "m4.large"
+
+  # Data.
+  ebs_block_device {
+    device_name = "/dev/xvdb"
+    volume_size = 100
+  }
+
+  ebs_block_device {
+    device_name = "xvdc"
+    volume_size = 10
+  }
+}
+
+module "db" {
+  source = "./db"
+}
+`
+
+const testRewriteModuleConfig = `resource "aws_instance" "db" {
+  ami = "ami-123456" # Pinned.
+
+  # EC2 reports it as /dev/xvdf.
+  ebs_block_device {
+    device_name = "/dev/sdf"
+    volume_size = 500
+  }
+}
+`
+
+func TestRewriteConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "db"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte(testRewriteConfig), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "db", "main.tf"), []byte(testRewriteModuleConfig), 0644)
+
+	devs := []BlockDevice{
+		{
+			volumeID:            "v-abcd",
+			size:                100,
+			volumeType:          "gp2",
+			deleteOnTermination: "false",
+			deviceName:          NewDeviceName("xvdb"),
+			encrypted:           "false",
+			instanceID:          "i-1d7683bd",
+			availabilityZone:    "us-east-1a",
+			instanceResName:     &TerraformName{"aws_instance", "web", -1, ""},
+			modulePath:          []string{"root"},
+		},
+		{
+			volumeID:            "v-1234",
+			size:                500,
+			volumeType:          "gp2",
+			deleteOnTermination: "false",
+			deviceName:          NewDeviceName("xvdf"),
+			stateDeviceName:     NewDeviceName("sdf"),
+			aliasRule:           aliasSdXvd,
+			encrypted:           "false",
+			instanceID:          "i-2e8794ce",
+			availabilityZone:    "us-east-1a",
+			instanceResName:     &TerraformName{"aws_instance", "db", -1, ""},
+			modulePath:          []string{"root", "db"},
+		},
+		{
+			volumeID:            "v-5678",
+			size:                10,
+			volumeType:          "gp2",
+			deleteOnTermination: "false",
+			deviceName:          NewDeviceName("xvdg"),
+			encrypted:           "false",
+			instanceID:          "i-3f98a5df",
+			availabilityZone:    "us-east-1a",
+			instanceResName:     &TerraformName{"aws_instance", "cache", -1, ""},
+			modulePath:          []string{"root"},
+		},
+	}
+
+	unplaced, rewritten, err := rewriteConfigDir(dir, devs, configOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unplaced) != 1 || unplaced[0].volumeID != "v-5678" {
+		t.Errorf("Expected only the device of the missing instance to be left, got %+v", unplaced)
+	}
+	// Nothing's written until the state is.
+	if actual, _ := ioutil.ReadFile(filepath.Join(dir, "main.tf")); string(actual) != testRewriteConfig {
+		t.Errorf("Expected the config to be left alone until written, got:\n%s", actual)
+	}
+	for _, f := range rewritten {
+		if err := f.write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := `# The web servers.
+resource "aws_instance" "web" {
+  ami           = "ami-123456"
+  instance_type = "m4.large"
+
+  ebs_block_device {
+    device_name = "xvdc"
+    volume_size = 10
+  }
+}
+
+resource "aws_ebs_volume" "web-xvdb" {
+  availability_zone = "us-east-1a"
+  encrypted         = false
+  size              = 100
+  type              = "gp2"
+}
+
+resource "aws_volume_attachment" "web-xvdb" {
+  device_name = "/dev/xvdb"
+  instance_id = "${aws_instance.web.id}"
+  volume_id   = "${aws_ebs_volume.web-xvdb.id}"
+}
+
+module "db" {
+  source = "./db"
+}
+`
+	actual, _ := ioutil.ReadFile(filepath.Join(dir, "main.tf"))
+	if string(actual) != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, actual)
+	}
+
+	expected = `resource "aws_instance" "db" {
+  ami = "ami-123456" # Pinned.
+}
+
+resource "aws_ebs_volume" "db-xvdf" {
+  availability_zone = "us-east-1a"
+  encrypted         = false
+  size              = 500
+  type              = "gp2"
+}
+
+resource "aws_volume_attachment" "db-xvdf" {
+  device_name = "/dev/xvdf"
+  instance_id = "${aws_instance.db.id}"
+  volume_id   = "${aws_ebs_volume.db-xvdf.id}"
+}
+`
+	actual, _ = ioutil.ReadFile(filepath.Join(dir, "db", "main.tf"))
+	if string(actual) != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, actual)
+	}
+}
+
+// A config that can't be rewritten leaves the state alone too.
+func TestApplyUnparsableConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte(`resource "aws_instance" "web" {`), 0644)
+
+	converter := testConverterInDir(t, dir, filepath.Join(dir, "out.tfstate"))
+	converter.opts.ConfigDir = dir
+	plan, err := converter.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := converter.Apply(plan); err == nil || !strings.Contains(err.Error(), "Error parsing") {
+		t.Errorf("Expected the config not to parse, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.tfstate")); !os.IsNotExist(err) {
+		t.Errorf("Expected no state to be written, got %v", err)
+	}
+}
+
+// A module source shared by several modules is rewritten once, and only if
+// they were all converted the same way.
+func TestRewriteConfigDirSharedModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "db"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte(`module "a" {
+  source = "./db"
+}
+
+module "b" {
+  source = "./db"
+}
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "db", "main.tf"), []byte(testRewriteModuleConfig), 0644)
+
+	dev := func(volumeID string, module string) BlockDevice {
+		return BlockDevice{
+			volumeID:            volumeID,
+			size:                500,
+			volumeType:          "gp2",
+			deleteOnTermination: "false",
+			deviceName:          NewDeviceName("xvdf"),
+			stateDeviceName:     NewDeviceName("sdf"),
+			aliasRule:           aliasSdXvd,
+			encrypted:           "false",
+			availabilityZone:    "us-east-1a",
+			instanceResName:     &TerraformName{"aws_instance", "db", -1, ""},
+			modulePath:          []string{"root", module},
+		}
+	}
+
+	var testCases = []struct {
+		devs      []BlockDevice
+		rewritten int
+		unplaced  int
+	}{
+		{[]BlockDevice{dev("v-1234", "a"), dev("v-5678", "b")}, 1, 0},
+		{[]BlockDevice{dev("v-1234", "a")}, 0, 1},
+	}
+
+	for i, tt := range testCases {
+		var warns warnings
+		unplaced, rewritten, err := rewriteConfigDir(dir, tt.devs, configOptions{warnings: &warns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rewritten) != tt.rewritten || len(unplaced) != tt.unplaced {
+			t.Errorf("[%d] Expected %d files rewritten and %d devices left, got %d and %d",
+				i, tt.rewritten, tt.unplaced, len(rewritten), len(unplaced))
+		}
+		if tt.unplaced != 0 && (len(warns) != 1 || !strings.Contains(warns[0], "shared by root.a, root.b")) {
+			t.Errorf("[%d] Expected a warning about the shared config, got %v", i, warns)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package attachmentizer
+
+// This file handles version 4 of the state format, used by Terraform 0.12 and
+// later (and OpenTofu). The vendored Terraform only understands version 3 and
+// earlier, so this is a minimal reimplementation of the parts we need:
+// https://github.com/hashicorp/terraform/blob/v1.5.7/internal/states/statefile/version4.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform/flatmap"
+)
+
+type stateV4 struct {
+	Version          int             `json:"version"`
+	TerraformVersion string          `json:"terraform_version"`
+	Serial           uint64          `json:"serial"`
+	Lineage          string          `json:"lineage"`
+	Outputs          json.RawMessage `json:"outputs"`
+	Resources        []*resourceV4   `json:"resources"`
+	CheckResults     json.RawMessage `json:"check_results,omitempty"`
+}
+
+type resourceV4 struct {
+	Module    string        `json:"module,omitempty"`
+	Mode      string        `json:"mode"`
+	Type      string        `json:"type"`
+	Name      string        `json:"name"`
+	Each      string        `json:"each,omitempty"`
+	Provider  string        `json:"provider"`
+	Instances []*instanceV4 `json:"instances"`
+}
+
+type instanceV4 struct {
+	// A number for `count`, a string for `for_each`, or nil for neither.
+	IndexKey interface{} `json:"index_key,omitempty"`
+	Status   string      `json:"status,omitempty"`
+	Deposed  string      `json:"deposed,omitempty"`
+
+	SchemaVersion       uint64            `json:"schema_version"`
+	Attributes          json.RawMessage   `json:"attributes,omitempty"`
+	AttributesFlat      map[string]string `json:"attributes_flat,omitempty"`
+	SensitiveAttributes json.RawMessage   `json:"sensitive_attributes,omitempty"`
+
+	IdentitySchemaVersion *uint64         `json:"identity_schema_version,omitempty"`
+	Identity              json.RawMessage `json:"identity,omitempty"`
+
+	Private             string   `json:"private,omitempty"`
+	Dependencies        []string `json:"dependencies,omitempty"`
+	CreateBeforeDestroy bool     `json:"create_before_destroy,omitempty"`
+}
+
+// Read just the `version` field of a state file, which all formats share.
+func detectStateVersion(data []byte) (int, error) {
+	var versionOnly struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &versionOnly); err != nil {
+		return 0, err
+	}
+	return versionOnly.Version, nil
+}
+
+func readV4State(stateFilePath string) (*stateV4, error) {
+	data, err := ioutil.ReadFile(stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return parseV4State(data)
+}
+
+func parseV4State(data []byte) (*stateV4, error) {
+	var state stateV4
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep `index_key`s as written rather than turning them into floats.
+	dec.UseNumber()
+	if err := dec.Decode(&state); err != nil {
+		return nil, err
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("Expected state version 4, got %d", state.Version)
+	}
+	return &state, nil
+}
+
+// Serialize the state the same way Terraform does: indented with two spaces
+// and a trailing newline.
+func (s *stateV4) marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (s *stateV4) deepCopy() (*stateV4, error) {
+	data, err := s.marshal()
+	if err != nil {
+		return nil, fmt.Errorf("Could not copy state: %v", err)
+	}
+	cp, err := parseV4State(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not copy state: %v", err)
+	}
+	return cp, nil
+}
+
+// Convert a version 4 module address like `module.web.module.db` to the module
+// path used by the legacy format, `["root", "web", "db"]`.
+func v4ModulePath(moduleAddr string) []string {
+	path := []string{"root"}
+	if moduleAddr == "" {
+		return path
+	}
+	names := strings.Split(strings.TrimPrefix(moduleAddr, "module."), ".module.")
+	return append(path, names...)
+}
+
+// The inverse of `v4ModulePath`.
+func v4ModuleAddr(modulePath []string) string {
+	if len(modulePath) <= 1 {
+		return ""
+	}
+	return "module." + strings.Join(modulePath[1:], ".module.")
+}
+
+// The address of a resource as used in `dependencies`, e.g.
+// `module.web.aws_instance.web`.
+func v4ResourceAddr(moduleAddr string, resourceType string, name string) string {
+	if moduleAddr == "" {
+		return fmt.Sprintf("%s.%s", resourceType, name)
+	}
+	return fmt.Sprintf("%s.%s.%s", moduleAddr, resourceType, name)
+}
+
+// Decode the attributes of a resource instance, keeping numbers as written
+// rather than turning them into floats.
+func decodeV4Attrs(attrsJSON json.RawMessage) (map[string]interface{}, error) {
+	var attrs map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(attrsJSON))
+	dec.UseNumber()
+	if err := dec.Decode(&attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// Build the TerraformName for an instance of a resource, carrying over its
+// `count` index or `for_each` key.
+func v4TerraformName(res *resourceV4, inst *instanceV4) (*TerraformName, error) {
+	name := &TerraformName{resourceType: res.Type, name: res.Name, index: -1}
+
+	switch key := inst.IndexKey.(type) {
+	case nil:
+	case json.Number:
+		index, err := key.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid index key for %v.%v: %v", res.Type, res.Name, err)
+		}
+		name.index = int(index)
+	case string:
+		name.key = key
+	default:
+		return nil, fmt.Errorf("Invalid index key for %v.%v: %v", res.Type, res.Name, key)
+	}
+	return name, nil
+}
+
+// The `index_key` of the new resources for a device, matching the instance's.
+func v4IndexKey(name *TerraformName) interface{} {
+	if name.key != "" {
+		return name.key
+	}
+	if name.index != -1 {
+		return name.index
+	}
+	return nil
+}
+
+// The `each` mode of the new resources for a device, matching the instance's.
+func v4EachMode(name *TerraformName) string {
+	if name.key != "" {
+		return "map"
+	}
+	if name.index != -1 {
+		return "list"
+	}
+	return ""
+}
+
+// Convert string attributes as built by `makeVolumeAttrs` and
+// `makeAttachmentAttrs` to the JSON types version 4 state uses. Flatmapped
+// maps like `tags.%` are expanded.
+func v4TypedAttrs(attrs map[string]string) (json.RawMessage, error) {
+	typed := make(map[string]interface{})
+	for k, v := range attrs {
+		if i := strings.Index(k, "."); i != -1 {
+			prefix := k[:i]
+			if _, ok := typed[prefix]; !ok {
+				typed[prefix] = flatmap.Expand(attrs, prefix)
+			}
+			continue
+		}
+		if _, ok := numberAttrs[k]; ok {
+			typed[k] = json.Number(v)
+			continue
+		}
+		if _, ok := boolAttrs[k]; ok {
+			typed[k] = v == "true"
+			continue
+		}
+		typed[k] = v
+	}
+	return json.Marshal(typed)
+}
+
+// Read the `ebs_block_device`s of a version 4 instance's attributes.
+func v4BlockDevices(attrsJSON json.RawMessage) ([]map[string]string, error) {
+	attrs, err := decodeV4Attrs(attrsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []map[string]string
+	if rawDevices, ok := attrs["ebs_block_device"]; ok && rawDevices != nil {
+		interfaceDevices, ok := rawDevices.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("ebs_block_device is not a list")
+		}
+		devices, ok = mapify(interfaceDevices)
+		if !ok {
+			return nil, fmt.Errorf("Could not mapify")
+		}
+	}
+	return devices, nil
+}
+
+// Return a version 4 instance's attributes without the `ebs_block_device`s of
+// the converted devices. The others, like those converted already, are kept.
+func v4RemoveBlockDevices(attrsJSON json.RawMessage, devs []BlockDevice) (json.RawMessage, error) {
+	attrs, err := decodeV4Attrs(attrsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := stateDeviceNames(devs)
+	rawDevices, _ := attrs["ebs_block_device"].([]interface{})
+	kept := []interface{}{}
+	for _, rawDevice := range rawDevices {
+		if device, ok := rawDevice.(map[string]interface{}); ok {
+			if name, ok := device["device_name"].(string); ok && converted[NewDeviceName(name)] {
+				continue
+			}
+		}
+		kept = append(kept, rawDevice)
+	}
+	attrs["ebs_block_device"] = kept
+	return json.Marshal(attrs)
+}
+
+// The managed resources in a state keyed by address, so that new resource
+// instances can be added to existing resources.
+type v4ResourceIndex struct {
+	state     *stateV4
+	resources map[string]*resourceV4
+}
+
+func newV4ResourceIndex(state *stateV4) *v4ResourceIndex {
+	idx := &v4ResourceIndex{state: state, resources: make(map[string]*resourceV4)}
+	for _, res := range state.Resources {
+		if res.Mode == "managed" {
+			idx.resources[v4ResourceAddr(res.Module, res.Type, res.Name)] = res
+		}
+	}
+	return idx
+}
+
+// Get (or create) the resource with the given address in the state.
+func (idx *v4ResourceIndex) get(moduleAddr, resourceType, name, each, provider string) *resourceV4 {
+	addr := v4ResourceAddr(moduleAddr, resourceType, name)
+	if res, ok := idx.resources[addr]; ok {
+		return res
+	}
+	res := &resourceV4{
+		Module:   moduleAddr,
+		Mode:     "managed",
+		Type:     resourceType,
+		Name:     name,
+		Each:     each,
+		Provider: provider,
+	}
+	idx.resources[addr] = res
+	idx.state.Resources = append(idx.state.Resources, res)
+	return res
+}
+
+// Make the version 4 resource instances for a converted device, for the
+// resources with the given name and with the given index key.
+func (dev *BlockDevice) makeV4Instances(instanceAddr string, name string, indexKey interface{}) (*instanceV4, *instanceV4, error) {
+	moduleAddr := v4ModuleAddr(dev.modulePath)
+	volumeAddr := v4ResourceAddr(moduleAddr, "aws_ebs_volume", name)
+
+	volumeAttrs, err := v4TypedAttrs(dev.makeVolumeAttrs())
+	if err != nil {
+		return nil, nil, err
+	}
+	attachmentAttrs, err := v4TypedAttrs(dev.makeAttachmentAttrs())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	volume := &instanceV4{
+		IndexKey:            indexKey,
+		Attributes:          volumeAttrs,
+		SensitiveAttributes: json.RawMessage("[]"),
+		Dependencies:        []string{instanceAddr},
+	}
+	attachment := &instanceV4{
+		IndexKey:            indexKey,
+		Attributes:          attachmentAttrs,
+		SensitiveAttributes: json.RawMessage("[]"),
+		Dependencies:        []string{volumeAddr, instanceAddr},
+	}
+	return volume, attachment, nil
+}
+
+// Sort resources and their instances the way Terraform writes them, so the
+// output diffs cleanly against the input.
+func (s *stateV4) sort() {
+	sort.SliceStable(s.Resources, func(i, j int) bool {
+		a, b := s.Resources[i], s.Resources[j]
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		if a.Mode != b.Mode {
+			return a.Mode < b.Mode
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Name < b.Name
+	})
+	for _, res := range s.Resources {
+		sort.SliceStable(res.Instances, func(i, j int) bool {
+			return v4IndexKeyLess(res.Instances[i].IndexKey, res.Instances[j].IndexKey)
+		})
+	}
+}
+
+// Order `count` indexes numerically, and everything else by its string form.
+func v4IndexKeyLess(a, b interface{}) bool {
+	aNum, aErr := strconv.Atoi(fmt.Sprint(a))
+	bNum, bErr := strconv.Atoi(fmt.Sprint(b))
+	if aErr == nil && bErr == nil {
+		return aNum < bNum
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
+
+// The version 4 equivalent of `generateNewTFState`. Returns the new state, with
+// its serial bumped if anything changed and lineage kept, the block devices
+// converted, those already converted, and the problems with the instances
+// that weren't. With `opts.forEach`, the new resources are keyed the way
+// `getForEachConfigForDevGroup` has them.
+func generateNewV4State(stateToModify *stateV4, instMap map[string]Instance, opts configOptions) (*stateV4, []BlockDevice, []BlockDevice, ValidationErrors, error) {
+	outState, err := stateToModify.deepCopy()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	index := newV4ResourceIndex(outState)
+	existing, err := v4ExistingResources(stateToModify)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	var newDevs, unchanged []BlockDevice
+	var errs ValidationErrors
+
+	// The instances with devices to convert, which are only changed once
+	// the devices' `count` groups are known.
+	type convertedInstance struct {
+		res  *resourceV4
+		inst *instanceV4
+	}
+	var converted []convertedInstance
+	var instDevs [][]BlockDevice
+
+	// Copy the list since we add to it later.
+	resources := append([]*resourceV4(nil), outState.Resources...)
+	for _, res := range resources {
+		if res.Mode != "managed" || res.Type != "aws_instance" {
+			continue
+		}
+		instanceAddr := v4ResourceAddr(res.Module, res.Type, res.Name)
+
+		for _, inst := range res.Instances {
+			if inst.Deposed != "" {
+				continue
+			}
+			var id struct {
+				ID               string `json:"id"`
+				AvailabilityZone string `json:"availability_zone"`
+			}
+			if err := json.Unmarshal(inst.Attributes, &id); err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("Could not read attributes of %v: %v", instanceAddr, err)
+			}
+			ec2Inst, ok := instMap[id.ID]
+			if !ok {
+				// Do nothing if the instance wasn't one of the ones that the EC2
+				// query returned.
+				continue
+			}
+
+			instanceResName, err := v4TerraformName(res, inst)
+			if err != nil {
+				errs = append(errs, &ValidationError{Instance: instanceAddr, Problem: err.Error()})
+				continue
+			}
+
+			devices, err := v4BlockDevices(inst.Attributes)
+			if err != nil {
+				errs = append(errs, &ValidationError{
+					Instance: moduleAddressPrefix(v4ModulePath(res.Module)) + instanceResName.Address(),
+					Problem:  fmt.Sprintf("Could not expand its ebs_block_devices: %v", err),
+				})
+				continue
+			}
+
+			devs, instUnchanged, instErrs := convertInstance(instanceResName, v4ModulePath(res.Module), devices, id.AvailabilityZone, ec2Inst, existing, opts)
+			if len(instErrs) != 0 {
+				errs = append(errs, instErrs...)
+				continue
+			}
+			unchanged = append(unchanged, instUnchanged...)
+			if len(devs) == 0 {
+				// Leave the instance alone if it's already converted.
+				continue
+			}
+			converted = append(converted, convertedInstance{res, inst})
+			instDevs = append(instDevs, devs)
+		}
+	}
+
+	splitCountGroups(instDevs, opts)
+	for i, c := range converted {
+		if instErrs := checkUngroupedAddresses(instDevs[i], existing, opts); len(instErrs) != 0 {
+			errs = append(errs, instErrs...)
+			continue
+		}
+		instanceAddr := v4ResourceAddr(c.res.Module, c.res.Type, c.res.Name)
+		if c.inst.Attributes, err = v4RemoveBlockDevices(c.inst.Attributes, instDevs[i]); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("Could not update the attributes of %v: %v", instanceAddr, err)
+		}
+
+		for _, dev := range instDevs[i] {
+			name, indexKey, each := dev.NameWithoutCount(), v4IndexKey(dev.instanceResName), v4EachMode(dev.instanceResName)
+			switch {
+			case opts.forEach:
+				name, indexKey, each = dev.ForEachName(), dev.ForEachKey(), "map"
+			case dev.ungrouped:
+				indexKey, each = nil, ""
+			}
+
+			volume, attachment, err := dev.makeV4Instances(instanceAddr, name, indexKey)
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("Could not make resources for %v: %v", dev.UniqueName(), err)
+			}
+
+			volumeRes := index.get(c.res.Module, "aws_ebs_volume", name, each, c.res.Provider)
+			volumeRes.Instances = append(volumeRes.Instances, volume)
+			attachmentRes := index.get(c.res.Module, "aws_volume_attachment", name, each, c.res.Provider)
+			attachmentRes.Instances = append(attachmentRes.Instances, attachment)
+
+			newDevs = append(newDevs, dev)
+		}
+	}
+
+	if err := validateResourceNames(newDevs, opts.forEach); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// Bumped only for a change, so running again on the result gives the same.
+	if len(newDevs) != 0 {
+		outState.sort()
+		outState.Serial++
+	}
+
+	errs.sort()
+	return outState, newDevs, unchanged, errs, nil
+}
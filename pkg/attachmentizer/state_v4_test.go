@@ -0,0 +1,256 @@
+package attachmentizer
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testV4State = `{
+  "version": 4,
+  "terraform_version": "1.5.7",
+  "serial": 7,
+  "lineage": "3f1a8d0e-8c1b-4d1f-9c1e-7d2b8f0a1c2d",
+  "outputs": {},
+  "resources": [
+    {
+      "module": "module.web",
+      "mode": "managed",
+      "type": "aws_instance",
+      "name": "web",
+      "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]",
+      "instances": [
+        {
+          "index_key": 0,
+          "schema_version": 1,
+          "attributes": {
+            "id": "i-1d7683bd",
+            "ebs_block_device": [
+              {
+                "delete_on_termination": false,
+                "device_name": "/dev/xvdb",
+                "encrypted": false,
+                "iops": 300,
+                "kms_key_id": "",
+                "snapshot_id": "",
+                "tags": null,
+                "throughput": 0,
+                "volume_id": "v-abcd",
+                "volume_size": 100,
+                "volume_type": "gp2"
+              }
+            ]
+          },
+          "sensitive_attributes": []
+        }
+      ]
+    }
+  ],
+  "check_results": null
+}
+`
+
+func TestV4ModulePath(t *testing.T) {
+	var testCases = []struct {
+		addr string
+		path []string
+	}{
+		{"", []string{"root"}},
+		{"module.web", []string{"root", "web"}},
+		{"module.web.module.db[0]", []string{"root", "web", "db[0]"}},
+	}
+
+	for _, tt := range testCases {
+		path := v4ModulePath(tt.addr)
+		if !reflect.DeepEqual(path, tt.path) {
+			t.Errorf("Expected %v for %q, got %v", tt.path, tt.addr, path)
+		}
+		if addr := v4ModuleAddr(path); addr != tt.addr {
+			t.Errorf("Expected %q for %v, got %q", tt.addr, path, addr)
+		}
+	}
+}
+
+func TestGenerateNewV4State(t *testing.T) {
+	state, err := parseV4State([]byte(testV4State))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instMap := map[string]Instance{
+		"i-1d7683bd": {
+			ID: "i-1d7683bd",
+			BlockDevices: map[DeviceName]BlockDevice{
+				NewDeviceName("xvdb"): {
+					volumeID:            "v-abcd",
+					deviceName:          NewDeviceName("xvdb"),
+					deleteOnTermination: "false",
+					instanceID:          "i-1d7683bd",
+					availabilityZone:    "us-east-1a",
+				},
+			},
+		},
+	}
+
+	newState, _, _, _, err := generateNewV4State(state, instMap, configOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if newState.Serial != 8 || newState.Lineage != state.Lineage {
+		t.Errorf("Expected serial 8 and lineage %v, got %v and %v", state.Lineage, newState.Serial, newState.Lineage)
+	}
+	if len(newState.Resources) != 3 {
+		t.Fatalf("Expected 3 resources, got %d", len(newState.Resources))
+	}
+
+	volume := newState.Resources[0]
+	// The instance is the only one in its `count`, so the volume has no
+	// `count` of its own, and is named with the instance's index.
+	if volume.Type != "aws_ebs_volume" || volume.Name != "web-xvdb-0" || volume.Module != "module.web" || volume.Each != "" {
+		t.Errorf("Unexpected volume resource: %+v", volume)
+	}
+	var volumeAttrs map[string]interface{}
+	if err := json.Unmarshal(volume.Instances[0].Attributes, &volumeAttrs); err != nil {
+		t.Fatal(err)
+	}
+	expectedAttrs := map[string]interface{}{
+		"id":                "v-abcd",
+		"size":              float64(100),
+		"encrypted":         false,
+		"availability_zone": "us-east-1a",
+		"snapshot_id":       "",
+	}
+	for k, v := range expectedAttrs {
+		if volumeAttrs[k] != v {
+			t.Errorf("Expected volume attribute %v to be %v, got %v", k, v, volumeAttrs[k])
+		}
+	}
+
+	attachment := newState.Resources[2]
+	if attachment.Type != "aws_volume_attachment" || attachment.Instances[0].IndexKey != nil {
+		t.Errorf("Unexpected attachment resource: %+v", attachment)
+	}
+
+	var instanceAttrs map[string]interface{}
+	if err := json.Unmarshal(newState.Resources[1].Instances[0].Attributes, &instanceAttrs); err != nil {
+		t.Fatal(err)
+	}
+	if devs := instanceAttrs["ebs_block_device"].([]interface{}); len(devs) != 0 {
+		t.Errorf("Expected ebs_block_device to be emptied, got %v", devs)
+	}
+}
+
+func TestGenerateNewV4StateForEach(t *testing.T) {
+	state, err := parseV4State([]byte(testV4State))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instMap := map[string]Instance{
+		"i-1d7683bd": {
+			ID: "i-1d7683bd",
+			BlockDevices: map[DeviceName]BlockDevice{
+				NewDeviceName("xvdb"): {
+					volumeID:            "v-abcd",
+					deviceName:          NewDeviceName("xvdb"),
+					deleteOnTermination: "false",
+					instanceID:          "i-1d7683bd",
+					availabilityZone:    "us-east-1a",
+				},
+			},
+		},
+	}
+
+	opts := configOptions{hcl2: true, forEach: true}
+	newState, newDevs, _, _, err := generateNewV4State(state, instMap, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := mustGenConfig(t, newDevs, opts)
+
+	// The instance has a `count`, so the volumes are keyed by its index.
+	for _, i := range []int{0, 2} {
+		res := newState.Resources[i]
+		if res.Name != "web-xvdb" || res.Each != "map" || res.Instances[0].IndexKey != "0" {
+			t.Errorf("Unexpected resource: %+v", res)
+		}
+	}
+	if !strings.Contains(config, "instance_id = aws_instance.web[each.key].id") {
+		t.Errorf("Expected the attachment to reference the instance by key, got:\n%v", config)
+	}
+}
+
+// The config refers to the instance's availability zone where the state has
+// the same one for the instance and the volume.
+func TestGenerateNewV4StateInstanceAZ(t *testing.T) {
+	var testCases = []struct {
+		instanceAZ string
+		expected   string
+	}{
+		{"us-east-1a", "availability_zone = aws_instance.web[each.key].availability_zone"},
+		{"us-east-1b", `availability_zone = "us-east-1a"`},
+		{"", `availability_zone = "us-east-1a"`},
+	}
+
+	for _, tt := range testCases {
+		data := testV4State
+		if tt.instanceAZ != "" {
+			data = strings.Replace(data, `"id": "i-1d7683bd",`, `"id": "i-1d7683bd", "availability_zone": "`+tt.instanceAZ+`",`, 1)
+		}
+		state, err := parseV4State([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := configOptions{hcl2: true, forEach: true}
+		newState, newDevs, _, errs, err := generateNewV4State(state, testEC2Source().instances, opts)
+		if err != nil || len(errs) != 0 {
+			t.Fatalf("[%v] %v %v", tt.instanceAZ, err, errs)
+		}
+		if len(newDevs) != 1 || newDevs[0].instanceAvailabilityZone != tt.instanceAZ {
+			t.Fatalf("[%v] Expected the instance's availability zone on the device, got %+v", tt.instanceAZ, newDevs)
+		}
+
+		// Either way, the config evaluates to what the state has.
+		attrs, err := decodeV4Attrs(newState.Resources[0].Instances[0].Attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs["availability_zone"] != "us-east-1a" {
+			t.Errorf("[%v] Expected the volume to be in us-east-1a, got %v", tt.instanceAZ, attrs["availability_zone"])
+		}
+		if config := mustGenConfig(t, newDevs, opts); !strings.Contains(config, tt.expected) {
+			t.Errorf("[%v] Expected the config to have %q, got:\n%v", tt.instanceAZ, tt.expected, config)
+		}
+	}
+}
+
+// Nothing to fold back leaves the serial alone.
+func TestGenerateRevertedV4StateUnchanged(t *testing.T) {
+	state, err := parseV4State([]byte(testV4State))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newState, _, err := generateRevertedV4State(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newState.Serial != state.Serial {
+		t.Errorf("Expected serial %v, got %v", state.Serial, newState.Serial)
+	}
+}
+
+// Only the converted devices' `ebs_block_device`s are removed.
+func TestV4RemoveBlockDevices(t *testing.T) {
+	attrs := json.RawMessage(`{"id": "i-1d7683bd", "ebs_block_device": [{"device_name": "/dev/xvdb"}, {"device_name": "/dev/sdc"}]}`)
+	newAttrs, err := v4RemoveBlockDevices(attrs, []BlockDevice{{deviceName: NewDeviceName("xvdb")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := v4BlockDevices(newAttrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0]["device_name"] != "/dev/sdc" {
+		t.Errorf("Expected only /dev/sdc to be left, got %v", devices)
+	}
+}
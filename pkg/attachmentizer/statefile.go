@@ -0,0 +1,204 @@
+package attachmentizer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/template"
+
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// A state file in either the format understood by the vendored Terraform
+// (version 3 and earlier) or version 4. Exactly one of these is set.
+type stateFile struct {
+	legacy *tf.State
+	v4     *stateV4
+
+	// The state as it was read, to back it up and check it hasn't changed
+	// once it's locked, and for one read from a file, the file's info.
+	data []byte
+	info os.FileInfo
+}
+
+// Read a state file. It's only opened once, since opening the file again
+// while it's locked would drop the lock; see `lockState`.
+func readStateFile(stateFilePath string) (*stateFile, error) {
+	info, err := os.Stat(stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	state, err := parseStateFile(data, stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	state.info = info
+	return state, nil
+}
+
+// Parse a state in any format. `name` says where it's from, for errors.
+func parseStateFile(data []byte, name string) (*stateFile, error) {
+	version, err := detectStateVersion(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read state version from %v: %v", name, err)
+	}
+
+	switch {
+	case version == 4:
+		state, err := parseV4State(data)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read state from %v: %v", name, err)
+		}
+		return &stateFile{v4: state, data: data}, nil
+	case version <= tf.StateVersion:
+		state, err := tf.ReadState(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("Could not read state from %v: %v", name, err)
+		}
+		return &stateFile{legacy: state, data: data}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported state version %d in %v", version, name)
+	}
+}
+
+// Get the options for the config to go with the state. With `hcl2` the config
+// is for Terraform 0.12 and later, and uses `for_each` if the state format can
+// hold its keys. With `skipInvalid`, instances with problems are skipped.
+// Warnings go to `warns`.
+func (s *stateFile) configOptions(hcl2 bool, nameTemplate *template.Template, skipInvalid bool, warns *warnings) configOptions {
+	if hcl2 && s.v4 == nil {
+		warns.addf("The state is in the legacy format, which can't hold for_each keys, so the config will use count")
+	}
+	return configOptions{nameTemplate: nameTemplate, skipInvalid: skipInvalid, hcl2: hcl2, forEach: hcl2 && s.v4 != nil, warnings: warns}
+}
+
+// Do The Conversion in memory. Returns the new state, the block devices
+// converted, those already converted, which are left alone, and the instances
+// skipped with `opts.skipInvalid`, which are left as they were along with the
+// other instances of their `count`, since they share resources. Without it,
+// any problems are returned as the error.
+func (s *stateFile) convert(instMap map[string]Instance, opts configOptions) (*stateFile, []BlockDevice, []BlockDevice, ValidationErrors, error) {
+	numWarnings := opts.warnings.len()
+	newState, newDevs, unchanged, errs, err := s.convertInstances(instMap, opts)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if len(errs) == 0 {
+		return newState, newDevs, unchanged, nil, nil
+	}
+	if !opts.skipInvalid {
+		return nil, nil, nil, nil, errs
+	}
+
+	if remaining, siblingErrs := skipInvalidGroups(instMap, newDevs, errs); len(siblingErrs) != 0 {
+		// The first go warned about the instances skipped too.
+		opts.warnings.truncate(numWarnings)
+		newState, newDevs, unchanged, errs, err = s.convertInstances(remaining, opts)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		errs = append(errs, siblingErrs...)
+		errs.sort()
+	}
+	return newState, newDevs, unchanged, errs, nil
+}
+
+func (s *stateFile) convertInstances(instMap map[string]Instance, opts configOptions) (*stateFile, []BlockDevice, []BlockDevice, ValidationErrors, error) {
+	if s.v4 != nil {
+		newState, newDevs, unchanged, errs, err := generateNewV4State(s.v4, instMap, opts)
+		return &stateFile{v4: newState}, newDevs, unchanged, errs, err
+	}
+	newState, newDevs, unchanged, errs, err := generateNewTFState(s.legacy, instMap, opts)
+	return &stateFile{legacy: newState}, newDevs, unchanged, errs, err
+}
+
+// Undo The Conversion in memory. Returns the new state and the suggested config.
+func (s *stateFile) revert() (*stateFile, string, error) {
+	if s.v4 != nil {
+		newState, config, err := generateRevertedV4State(s.v4)
+		return &stateFile{v4: newState}, config, err
+	}
+	newState, config, err := generateRevertedTFState(s.legacy)
+	return &stateFile{legacy: newState}, config, err
+}
+
+// Serialize the state in the format it was read in. For the legacy format
+// the serial is bumped if it differs from `from`, the same way Terraform does;
+// version 4 states have it bumped when they're generated.
+func (s *stateFile) marshal(from *stateFile) ([]byte, error) {
+	if s.v4 != nil {
+		return s.v4.marshal()
+	}
+
+	s.legacy.IncrementSerialMaybe(from.legacy)
+	var buf bytes.Buffer
+	if err := tf.WriteState(s.legacy, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write the state out, replacing `stateOutPath` atomically.
+func (s *stateFile) write(stateOutPath string, from *stateFile) error {
+	data, err := s.marshal(from)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(stateOutPath, data, 0644)
+}
+
+// Get the lineage and serial that identify this version of the state.
+func (s *stateFile) lineage() (string, uint64) {
+	if s.v4 != nil {
+		return s.v4.Lineage, s.v4.Serial
+	}
+	return s.legacy.Lineage, uint64(s.legacy.Serial)
+}
+
+// Get the IDs of all the `aws_instance`s in the state, in every module.
+func (s *stateFile) instanceIDs() []string {
+	var ids []string
+	if s.v4 != nil {
+		for _, res := range s.v4.Resources {
+			if res.Mode != "managed" || res.Type != "aws_instance" {
+				continue
+			}
+			for _, inst := range res.Instances {
+				attrs, err := v4StringAttrs(inst.Attributes)
+				if err == nil && inst.Deposed == "" && attrs["id"] != "" {
+					ids = append(ids, attrs["id"])
+				}
+			}
+		}
+	} else {
+		for _, module := range s.legacy.Modules {
+			for _, res := range module.Resources {
+				if res.Type == "aws_instance" && res.Primary != nil && res.Primary.ID != "" {
+					ids = append(ids, res.Primary.ID)
+				}
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get the IDs of all the `aws_instance`s in a state file, to look up in EC2.
+func StateInstanceIDs(stateFilePath string) ([]string, error) {
+	state, err := readStateFile(stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return state.instanceIDs(), nil
+}
+
+// Write the suggested configuration out.
+func writeConfig(configOutPath string, config string) error {
+	return ioutil.WriteFile(configOutPath, []byte(config), 0644)
+}
@@ -0,0 +1,167 @@
+package attachmentizer
+
+// This file keeps writing the state safe: the input is locked the way
+// Terraform locks it while it's converted, backed up, and the output replaced
+// atomically, and never over a different state.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/terraform/state"
+)
+
+// The operation recorded in the lock info, shown by Terraform if it finds
+// the state locked.
+const lockOperation = "terraform-ebs-attachmentizer"
+
+// Take the lock Terraform takes on a local state, and write the
+// `.<name>.lock.info` file next to it. Fails straight away if the state is
+// already locked, by Terraform or another run. Returns a function to unlock it.
+//
+// The lock is an fcntl lock on the state file, which the OS drops as soon as
+// the process closes any descriptor for the file, so the state can't be read
+// again while it's locked. Instead it's checked to be the same size and
+// modification time as when `from` was read.
+func lockState(statePath string, from *stateFile) (func() error, error) {
+	locker := &state.LocalState{Path: statePath}
+	info := state.NewLockInfo()
+	info.Operation = lockOperation
+	id, err := locker.Lock(info)
+	if err != nil {
+		return nil, fmt.Errorf("Could not lock the state in %v: %v", statePath, err)
+	}
+	unlock := func() error {
+		return locker.Unlock(id)
+	}
+
+	current, err := os.Stat(statePath)
+	if err == nil && (current.Size() != from.info.Size() || !current.ModTime().Equal(from.info.ModTime())) {
+		err = fmt.Errorf("The state in %v changed after it was read; run again", statePath)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// Take the lock on the state in a remote backend, if it can be locked, and
+// check it's still `from`. Returns a function to unlock it. If it can't be
+// locked, that's a warning in `warns`.
+func lockRemoteState(client remoteClient, backend *BackendConfig, from *stateFile, warns *warnings) (func() error, error) {
+	unlock := func() error { return nil }
+	if locker, ok := client.(state.Locker); ok {
+		info := state.NewLockInfo()
+		info.Operation = lockOperation
+		id, err := locker.Lock(info)
+		if err != nil {
+			return nil, fmt.Errorf("Could not lock the state in %v: %v", backend, err)
+		}
+		unlock = func() error {
+			return locker.Unlock(id)
+		}
+	} else {
+		warns.addf("The state in %v can't be locked, so make sure nothing else is changing it", backend)
+	}
+
+	data, err := client.Get()
+	if err == nil && !bytes.Equal(data, from.data) {
+		err = fmt.Errorf("The state in %v changed after it was read; run again", backend)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// Write a copy of the state as it was read to `<statePath>.<unix time>.backup`,
+// the name `terraform state` subcommands use, and return its path. A backup
+// of the same state from a run in the same second is kept as it is.
+func backupState(statePath string, from *stateFile) (string, error) {
+	backupPath := fmt.Sprintf("%s.%d.backup", statePath, time.Now().Unix())
+	if existing, err := ioutil.ReadFile(backupPath); err == nil {
+		if !bytes.Equal(existing, from.data) {
+			return "", fmt.Errorf("The backup %v already exists with a different state", backupPath)
+		}
+		return backupPath, nil
+	}
+	if err := writeFileAtomic(backupPath, from.data, 0644); err != nil {
+		return "", fmt.Errorf("Could not back up the state to %v: %v", backupPath, err)
+	}
+	return backupPath, nil
+}
+
+// Refuse to overwrite a state at `stateOutPath` other than `from`, unless it
+// has the same lineage and so is a version of the same state. Missing and
+// empty files are fine to write.
+func checkOutputLineage(stateOutPath string, from *stateFile) error {
+	outInfo, err := os.Stat(stateOutPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Not read again if it's the input, since that would drop the lock.
+	if os.SameFile(outInfo, from.info) || outInfo.Size() == 0 {
+		return nil
+	}
+
+	existing, err := readStateFile(stateOutPath)
+	if err != nil {
+		return fmt.Errorf("Refusing to overwrite %v, which isn't a state file: %v", stateOutPath, err)
+	}
+	fromLineage, _ := from.lineage()
+	if lineage, _ := existing.lineage(); lineage != fromLineage {
+		return fmt.Errorf("Refusing to overwrite %v: it's a different state, with lineage %q rather than %q",
+			stateOutPath, lineage, fromLineage)
+	}
+	return nil
+}
+
+// Write a file so that it either has the new contents or, if anything goes
+// wrong, the old ones: through a temporary file in the same directory that's
+// synced and renamed over it.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable. Not every platform can sync a
+	// directory, so failing to is ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
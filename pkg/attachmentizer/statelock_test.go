@@ -0,0 +1,198 @@
+package attachmentizer
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/state"
+)
+
+// Not a real test: holds the lock on the state in the environment for
+// `TestApplyLockedState` until its stdin is closed, since a process can't
+// conflict with its own fcntl locks.
+func TestLockStateHelperProcess(t *testing.T) {
+	statePath := os.Getenv("ATTACHMENTIZER_LOCK_STATE")
+	if statePath == "" {
+		return
+	}
+	locker := &state.LocalState{Path: statePath}
+	info := state.NewLockInfo()
+	info.Operation = "test"
+	if _, err := locker.Lock(info); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	ioutil.ReadAll(os.Stdin)
+	os.Exit(0)
+}
+
+func testConverterInDir(t *testing.T, dir string, stateOutPath string) *Converter {
+	statePath := filepath.Join(dir, "in.tfstate")
+	if err := ioutil.WriteFile(statePath, []byte(testV4State), 0644); err != nil {
+		t.Fatal(err)
+	}
+	converter, err := NewConverter(Options{
+		StatePath:     statePath,
+		EC2:           testEC2Source(),
+		StateOutPath:  stateOutPath,
+		ConfigOutPath: filepath.Join(dir, "config.tf"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return converter
+}
+
+func TestApplyLockedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	converter := testConverterInDir(t, dir, filepath.Join(dir, "out.tfstate"))
+	plan, err := converter.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helper := exec.Command(os.Args[0], "-test.run=TestLockStateHelperProcess")
+	helper.Env = append(os.Environ(), "ATTACHMENTIZER_LOCK_STATE="+converter.opts.StatePath)
+	stdin, err := helper.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "locked\n" {
+		t.Fatalf("Expected the helper to lock the state, got %q", line)
+	}
+
+	if _, err := converter.Apply(plan); err == nil || !strings.Contains(err.Error(), "Could not lock") {
+		t.Errorf("Expected the locked state to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.tfstate")); !os.IsNotExist(err) {
+		t.Errorf("Expected no state to be written while locked, got %v", err)
+	}
+
+	stdin.Close()
+	if err := helper.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := converter.Apply(plan); err != nil {
+		t.Errorf("Expected the unlocked state to be written, got %v", err)
+	}
+}
+
+func TestApplyBacksUpAndUnlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Write over the input, the way Terraform's own commands do.
+	converter := testConverterInDir(t, dir, filepath.Join(dir, "in.tfstate"))
+	plan, err := converter.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := converter.Apply(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := ioutil.ReadFile(result.BackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != testV4State {
+		t.Errorf("Expected the backup to be the input state, got:\n%s", backup)
+	}
+	if !strings.HasPrefix(result.BackupPath, converter.opts.StatePath+".") || !strings.HasSuffix(result.BackupPath, ".backup") {
+		t.Errorf("Expected a timestamped backup next to the input, got %v", result.BackupPath)
+	}
+	newState, err := readV4State(result.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newState.Serial != 8 {
+		t.Errorf("Expected serial 8, got %v", newState.Serial)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".lock.info") || strings.HasPrefix(f.Name(), ".in.tfstate.") {
+			t.Errorf("Expected the lock info and temporary files to be gone, found %v", f.Name())
+		}
+	}
+
+	// The state changed since the plan was made, by applying it.
+	if _, err := converter.Apply(plan); err == nil || !strings.Contains(err.Error(), "changed after it was read") {
+		t.Errorf("Expected the changed state to be refused, got %v", err)
+	}
+}
+
+func TestCheckOutputLineage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "in.tfstate")
+	if err := ioutil.WriteFile(statePath, []byte(testV4State), 0644); err != nil {
+		t.Fatal(err)
+	}
+	from, err := readStateFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineage, _ := from.lineage()
+
+	var testCases = []struct {
+		contents string
+		err      string
+	}{
+		{"", ""},
+		{strings.Replace(testV4State, `"serial": 7`, `"serial": 3`, 1), ""},
+		{strings.Replace(testV4State, lineage, "another-lineage", 1), "different state"},
+		{"not a state", "isn't a state file"},
+	}
+
+	for i, tt := range testCases {
+		outPath := filepath.Join(dir, fmt.Sprintf("out%d.tfstate", i))
+		if err := ioutil.WriteFile(outPath, []byte(tt.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := checkOutputLineage(outPath, from)
+		if tt.err == "" && err != nil {
+			t.Errorf("[%d] Unexpected error: %v", i, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("[%d] Expected an error with %q, got %v", i, tt.err, err)
+		}
+	}
+
+	if err := checkOutputLineage(filepath.Join(dir, "missing.tfstate"), from); err != nil {
+		t.Errorf("Unexpected error for a missing output: %v", err)
+	}
+	if err := checkOutputLineage(statePath, from); err != nil {
+		t.Errorf("Unexpected error for writing over the input: %v", err)
+	}
+}
@@ -0,0 +1,691 @@
+package attachmentizer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	// "github.com/davecgh/go-spew/spew"
+	"github.com/hashicorp/terraform/flatmap"
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+// Type conversion for some []interface{} we know is actually a
+// []map[string]interface{}, and convert all the values to strings.
+// TODO: This must be easier with some kind of reflection thing.
+func mapify(slice []interface{}) ([]map[string]string, bool) {
+	var output []map[string]string
+	for _, input := range slice {
+		stringMap := make(map[string]string)
+		interfaceMap, ok := input.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		for k, v := range interfaceMap {
+			switch v := v.(type) {
+			case nil:
+				// Newer state formats use `null` for unset attributes.
+				stringMap[k] = ""
+			case map[string]interface{}:
+				// Maps like `tags` are flatmapped, as in legacy state.
+				stringMap[k+".%"] = strconv.Itoa(len(v))
+				for key, value := range v {
+					stringMap[k+"."+key] = fmt.Sprintf("%v", value)
+				}
+			default:
+				stringMap[k] = fmt.Sprintf("%v", v)
+			}
+		}
+
+		output = append(output, stringMap)
+	}
+	return output, true
+}
+
+type TerraformName struct {
+	resourceType, name string
+	// The index if any; -1 for none.
+	index int
+	// The `for_each` key if any. Only found in version 4 state.
+	key string
+}
+
+// Parse a Terraform name like `aws_instance.my_name.3` into its consituent parts.
+func ParseTerraformName(name string) (*TerraformName, error) {
+	var out TerraformName
+	parts := strings.Split(name, ".")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid resource name: %v", name)
+	}
+	out.resourceType = parts[0]
+	out.name = parts[1]
+	out.index = -1
+
+	if len(parts) == 3 {
+		index, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid resource name %v: %v", name, err)
+		}
+		out.index = index
+	}
+
+	return &out, nil
+}
+
+// The device names the state has for some devices, to find their
+// `ebs_block_device`s by.
+func stateDeviceNames(devs []BlockDevice) map[DeviceName]bool {
+	names := make(map[DeviceName]bool)
+	for _, dev := range devs {
+		names[dev.StateDeviceName()] = true
+	}
+	return names
+}
+
+// Delete the `ebs_block_device`s of the converted devices from an instance's
+// legacy attributes. The others, like those converted already, are kept, and
+// the count is left at 0 rather than removed if there are none.
+func removeLegacyBlockDevices(attrs map[string]string, devs []BlockDevice) {
+	converted := stateDeviceNames(devs)
+	const prefix = "ebs_block_device."
+	removed := make(map[string]bool)
+	for k, v := range attrs {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(k, prefix), ".", 2)
+		if len(parts) == 2 && parts[1] == "device_name" && converted[NewDeviceName(v)] {
+			removed[parts[0]] = true
+		}
+	}
+
+	kept := make(map[string]bool)
+	for k := range attrs {
+		if !strings.HasPrefix(k, prefix) || k == prefix+"#" {
+			continue
+		}
+		hash := strings.SplitN(strings.TrimPrefix(k, prefix), ".", 2)[0]
+		if removed[hash] {
+			delete(attrs, k)
+		} else {
+			kept[hash] = true
+		}
+	}
+	attrs[prefix+"#"] = strconv.Itoa(len(kept))
+}
+
+// Make the block devices of an instance from its `ebs_block_device`s, reading
+// the attributes the profile's block has.
+func createDeviceMap(instanceRes *TerraformName, slice []map[string]string, p *providerProfile) (map[DeviceName]BlockDevice, error) {
+	output := make(map[DeviceName]BlockDevice)
+	for _, dev := range slice {
+		volumeAttrs, _, err := p.translateBlockDevice(dev)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(volumeAttrs["size"])
+		if err != nil {
+			return nil, err
+		}
+		// Newer state formats leave `iops` unset for volume types without it.
+		iops := 0
+		if volumeAttrs["iops"] != "" {
+			iops, err = strconv.Atoi(volumeAttrs["iops"])
+			if err != nil {
+				return nil, err
+			}
+		}
+		throughput := 0
+		if volumeAttrs["throughput"] != "" {
+			throughput, err = strconv.Atoi(volumeAttrs["throughput"])
+			if err != nil {
+				return nil, err
+			}
+		}
+		var tags map[string]string
+		if volumeAttrs["tags.%"] != "" && volumeAttrs["tags.%"] != "0" {
+			tags = make(map[string]string)
+			for k, v := range volumeAttrs {
+				if strings.HasPrefix(k, "tags.") && k != "tags.%" {
+					tags[strings.TrimPrefix(k, "tags.")] = v
+				}
+			}
+		}
+		deviceName := NewDeviceName(dev["device_name"])
+		output[deviceName] = BlockDevice{
+			size:                size,
+			volumeType:          volumeAttrs["type"],
+			deleteOnTermination: dev["delete_on_termination"],
+			deviceName:          deviceName,
+			encrypted:           volumeAttrs["encrypted"],
+			iops:                iops,
+			snapshotId:          volumeAttrs["snapshot_id"],
+			kmsKeyID:            volumeAttrs["kms_key_id"],
+			tags:                tags,
+			throughput:          throughput,
+			instanceResName:     instanceRes,
+			// Whichever profile wrote the state, its volume ID is the best
+			// evidence of which device in EC2 it is.
+			volumeID: dev["volume_id"],
+		}
+	}
+	return output, nil
+}
+
+// Check if the fields we pulled from both EC2 and Terraform match. If there are
+// conflicts, something smells fishy and we shouldn't continue.
+func validateEC2andTFDevs(devFromTF BlockDevice, devFromEC2 BlockDevice) bool {
+	return len(ec2AndTFDevMismatches(devFromTF, devFromEC2)) == 0
+}
+
+// Get the fields that differ between the state and EC2. There are 2 fields we
+// obtain from both the Terraform state file and the EC2 lookup:
+// 1. device name
+// 2. delete on termination
+func ec2AndTFDevMismatches(devFromTF BlockDevice, devFromEC2 BlockDevice) []fieldMismatch {
+	var mismatches []fieldMismatch
+	if devFromTF.deviceName.ShortName() != devFromEC2.deviceName.ShortName() {
+		mismatches = append(mismatches, fieldMismatch{"device_name", devFromTF.deviceName.LongName(), devFromEC2.deviceName.LongName()})
+	}
+	if devFromTF.deleteOnTermination != devFromEC2.deleteOnTermination {
+		mismatches = append(mismatches, fieldMismatch{"delete_on_termination", devFromTF.deleteOnTermination, devFromEC2.deleteOnTermination})
+	}
+	return mismatches
+}
+
+// Sanity check of various fields on a block device.
+func validateBlockDev(dev BlockDevice) bool {
+	return len(missingBlockDevFields(dev)) == 0
+}
+
+// Get the fields a block device needs but doesn't have.
+func missingBlockDevFields(dev BlockDevice) []string {
+	var missing []string
+	// Short name because otherwise we get "/dev/".
+	if dev.deviceName.ShortName() == "" {
+		missing = append(missing, "device_name")
+	}
+	if dev.volumeID == "" {
+		missing = append(missing, "volume_id")
+	}
+	if dev.availabilityZone == "" {
+		missing = append(missing, "availability_zone")
+	}
+	if dev.size == 0 {
+		missing = append(missing, "volume_size")
+	}
+	if dev.instanceID == "" {
+		missing = append(missing, "instance_id")
+	}
+	return missing
+}
+
+// Do the following:
+// 1. Check that the relevant fields match between EC2 and TF
+// 2. Merge the block devices into one
+// 3. Validate relevant fields on the resulting block device
+// Problems are returned for `instanceAddr`.
+func mergeAndValidateBlockDevs(instanceAddr string, devFromTF BlockDevice, devFromEC2 BlockDevice) (BlockDevice, ValidationErrors) {
+	var errs ValidationErrors
+	for _, m := range ec2AndTFDevMismatches(devFromTF, devFromEC2) {
+		errs = append(errs, &ValidationError{
+			Instance: instanceAddr,
+			Device:   devFromTF.deviceName.LongName(),
+			Field:    m.field,
+			TFValue:  m.tfValue,
+			EC2Value: m.ec2Value,
+			Problem:  "differs between the state and EC2",
+		})
+	}
+	if len(errs) != 0 {
+		return BlockDevice{}, errs
+	}
+
+	dev := devFromTF
+	dev.volumeID = devFromEC2.volumeID
+	dev.instanceID = devFromEC2.instanceID
+	dev.availabilityZone = devFromEC2.availabilityZone
+
+	// EC2 is the source of truth for the volume itself, if we looked it up.
+	if devFromEC2.size != 0 {
+		dev.size = devFromEC2.size
+		dev.volumeType = devFromEC2.volumeType
+		dev.iops = devFromEC2.iops
+		dev.encrypted = devFromEC2.encrypted
+		dev.snapshotId = devFromEC2.snapshotId
+		dev.kmsKeyID = devFromEC2.kmsKeyID
+		dev.tags = devFromEC2.tags
+		dev.throughput = devFromEC2.throughput
+		dev.multiAttachEnabled = devFromEC2.multiAttachEnabled
+		dev.outpostArn = devFromEC2.outpostArn
+	}
+
+	for _, field := range missingBlockDevFields(dev) {
+		errs = append(errs, &ValidationError{
+			Instance: instanceAddr,
+			Device:   devFromTF.deviceName.LongName(),
+			Field:    field,
+			Problem:  "is missing",
+		})
+	}
+	if len(errs) != 0 {
+		return BlockDevice{}, errs
+	}
+
+	return dev, nil
+}
+
+// A volume attribute whose value in the state differs from the one in EC2.
+type fieldMismatch struct {
+	field    string
+	tfValue  string
+	ec2Value string
+}
+
+// Compare the volume attributes in the state with the ones from EC2. Only
+// fields the state has a value for are compared, and nothing is compared if
+// the volume wasn't looked up in EC2 (in which case it has no size).
+func volumeMismatches(devFromTF BlockDevice, devFromEC2 BlockDevice) []fieldMismatch {
+	if devFromEC2.size == 0 {
+		return nil
+	}
+
+	var mismatches []fieldMismatch
+	compare := func(field string, tfValue string, ec2Value string) {
+		if tfValue != "" && tfValue != ec2Value {
+			mismatches = append(mismatches, fieldMismatch{field, tfValue, ec2Value})
+		}
+	}
+	compare("volume_size", strconv.Itoa(devFromTF.size), strconv.Itoa(devFromEC2.size))
+	compare("volume_type", devFromTF.volumeType, devFromEC2.volumeType)
+	if devFromTF.iops != 0 {
+		compare("iops", strconv.Itoa(devFromTF.iops), strconv.Itoa(devFromEC2.iops))
+	}
+	compare("encrypted", devFromTF.encrypted, devFromEC2.encrypted)
+	compare("kms_key_id", devFromTF.kmsKeyID, devFromEC2.kmsKeyID)
+	if devFromTF.throughput != 0 {
+		compare("throughput", strconv.Itoa(devFromTF.throughput), strconv.Itoa(devFromEC2.throughput))
+	}
+	compare("snapshot_id", devFromTF.snapshotId, devFromEC2.snapshotId)
+	// Newer states have the volume ID, which may be stale if the device
+	// was matched by name.
+	compare("volume_id", devFromTF.volumeID, devFromEC2.volumeID)
+	return mismatches
+}
+
+// The device in EC2 that one in the state was matched to, and the rule by
+// which they were if their names differ.
+type ec2DeviceMatch struct {
+	dev       BlockDevice
+	aliasRule string
+}
+
+// Match an instance's devices in the state with the ones EC2 has. The names
+// can differ: a device declared as `/dev/sdf` is reported by EC2 as
+// `/dev/xvdf` on some instances, and a root device as `/dev/xvda` rather than
+// `/dev/sda1`. So devices are matched in order of how sure we are:
+// 1. by the volume ID the state has, if EC2 has the volume attached
+// 2. by exactly the same name
+// 3. by a name that's an alias by `deviceAliasRule`, if only one is
+// Each device in EC2 is matched at most once. The devices that can't be
+// matched are returned with the reason.
+func matchEC2Devices(devMap map[DeviceName]BlockDevice, devNames []DeviceName, inst Instance) (map[DeviceName]ec2DeviceMatch, map[DeviceName]string) {
+	var ec2Names []DeviceName
+	for devName := range inst.BlockDevices {
+		ec2Names = append(ec2Names, devName)
+	}
+	sort.Slice(ec2Names, func(i, j int) bool {
+		return ec2Names[i].LongName() < ec2Names[j].LongName()
+	})
+
+	matches := make(map[DeviceName]ec2DeviceMatch)
+	claimed := make(map[DeviceName]bool)
+	match := func(devName DeviceName, ec2Name DeviceName, rule string) {
+		matches[devName] = ec2DeviceMatch{inst.BlockDevices[ec2Name], rule}
+		claimed[ec2Name] = true
+	}
+
+	for _, devName := range devNames {
+		volumeID := devMap[devName].volumeID
+		if volumeID == "" {
+			continue
+		}
+		for _, ec2Name := range ec2Names {
+			if inst.BlockDevices[ec2Name].volumeID != volumeID || claimed[ec2Name] {
+				continue
+			}
+			rule, ok := deviceAliasRule(devName, ec2Name)
+			if !ok {
+				rule = aliasVolumeID
+			}
+			match(devName, ec2Name, rule)
+			break
+		}
+	}
+
+	for _, devName := range devNames {
+		if _, ok := matches[devName]; ok {
+			continue
+		}
+		if _, ok := inst.BlockDevices[devName]; ok && !claimed[devName] {
+			match(devName, devName, "")
+		}
+	}
+
+	problems := make(map[DeviceName]string)
+	for _, devName := range devNames {
+		if _, ok := matches[devName]; ok {
+			continue
+		}
+		if devName.IsNVMe() {
+			problems[devName] = "is an NVMe device name, which can only be matched to a device in EC2 by the volume_id in the state, and there's none attached with it"
+			continue
+		}
+		var candidates []DeviceName
+		var rule string
+		for _, ec2Name := range ec2Names {
+			if r, ok := deviceAliasRule(devName, ec2Name); ok && !claimed[ec2Name] {
+				candidates = append(candidates, ec2Name)
+				rule = r
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			problems[devName] = "is not attached in EC2"
+		case 1:
+			match(devName, candidates[0], rule)
+		default:
+			var names []string
+			for _, name := range candidates {
+				names = append(names, name.LongName())
+			}
+			problems[devName] = fmt.Sprintf("could be any of %v in EC2, and the state has no volume_id to tell which", strings.Join(names, ", "))
+		}
+	}
+	return matches, problems
+}
+
+// Format the address of a resource like `aws_instance.web[0]`.
+func (n *TerraformName) Address() string {
+	switch {
+	case n.key != "":
+		return fmt.Sprintf("%s.%s[%q]", n.resourceType, n.name, n.key)
+	case n.index != -1:
+		return fmt.Sprintf("%s.%s[%d]", n.resourceType, n.name, n.index)
+	default:
+		return fmt.Sprintf("%s.%s", n.resourceType, n.name)
+	}
+}
+
+// Merge the `ebs_block_device`s read from an instance's state with the
+// information EC2 has about that instance. This is shared between the state
+// formats; it's up to the caller to turn the result into resources. Devices
+// already converted, according to `existing`, are returned separately, to be
+// left alone. If there are any problems with the instance's devices, all of
+// them are returned, and the instance shouldn't be converted. `instanceAZ` is
+// the instance's `availability_zone` in the state.
+func convertInstance(instanceResName *TerraformName, modulePath []string, devices []map[string]string, instanceAZ string, inst Instance, existing *existingResources, opts configOptions) ([]BlockDevice, []BlockDevice, ValidationErrors) {
+	instanceAddr := moduleAddressPrefix(modulePath) + instanceResName.Address()
+	devMap, err := createDeviceMap(instanceResName, devices, opts.profile())
+	if err != nil {
+		return nil, nil, ValidationErrors{{Instance: instanceAddr, Problem: fmt.Sprintf("Could not read its ebs_block_devices: %v", err)}}
+	}
+
+	var devNames []DeviceName
+	for devName := range devMap {
+		devNames = append(devNames, devName)
+	}
+	sort.Slice(devNames, func(i, j int) bool {
+		return devNames[i].LongName() < devNames[j].LongName()
+	})
+
+	var newDevs, unchanged []BlockDevice
+	var errs ValidationErrors
+	matches, problems := matchEC2Devices(devMap, devNames, inst)
+	for _, devName := range devNames {
+		devFromTFState := devMap[devName]
+		// Get the corresponding block device information from EC2.
+		m, ok := matches[devName]
+		if !ok {
+			errs = append(errs, &ValidationError{Instance: instanceAddr, Device: devName.LongName(), Problem: problems[devName]})
+			continue
+		}
+		devFromEC2Info := m.dev
+		if m.aliasRule != "" {
+			// The new resources use the name EC2 has, and the state's is kept
+			// for rewriting the config and for reporting the match.
+			devFromTFState.stateDeviceName = devName
+			devFromTFState.deviceName = devFromEC2Info.deviceName
+			devFromTFState.aliasRule = m.aliasRule
+		}
+
+		for _, m := range volumeMismatches(devFromTFState, devFromEC2Info) {
+			opts.warnings.addf("%v %v: %v is %q in the state but %q in EC2; using the EC2 value",
+				instanceAddr, devName, m.field, m.tfValue, m.ec2Value)
+		}
+
+		// Merge in the relevant fields, and check that everything looks reasonable.
+		dev, devErrs := mergeAndValidateBlockDevs(instanceAddr, devFromTFState, devFromEC2Info)
+		if len(devErrs) != 0 {
+			errs = append(errs, devErrs...)
+			continue
+		}
+		dev.modulePath = modulePath
+		dev.instanceAvailabilityZone = instanceAZ
+		dev = opts.profile().trimBlockDevice(dev)
+		if err := dev.checkAttrs(); err != nil {
+			errs = append(errs, &ValidationError{Instance: instanceAddr, Device: devName.LongName(), Problem: err.Error()})
+			continue
+		}
+
+		if opts.nameTemplate != nil {
+			dev.resourceName, err = renderResourceName(opts.nameTemplate, dev, inst.Tags)
+			if err != nil {
+				errs = append(errs, &ValidationError{Instance: instanceAddr, Device: devName.LongName(), Problem: err.Error()})
+				continue
+			}
+		}
+
+		converted, err := existing.check(dev, opts)
+		if err != nil {
+			errs = append(errs, &ValidationError{Instance: instanceAddr, Device: devName.LongName(), Problem: err.Error()})
+			continue
+		}
+		if converted {
+			unchanged = append(unchanged, dev)
+			continue
+		}
+
+		newDevs = append(newDevs, dev)
+	}
+	if len(errs) != 0 {
+		return nil, nil, errs
+	}
+	return newDevs, unchanged, nil
+}
+
+// Check the addresses the devices of an instance taken out of their `count`
+// group take instead, which `convertInstance` couldn't.
+func checkUngroupedAddresses(devs []BlockDevice, existing *existingResources, opts configOptions) ValidationErrors {
+	var errs ValidationErrors
+	for _, dev := range devs {
+		if !dev.ungrouped {
+			continue
+		}
+		if _, err := existing.check(dev, opts); err != nil {
+			errs = append(errs, &ValidationError{Instance: dev.InstanceAddress(), Device: dev.deviceName.LongName(), Problem: err.Error()})
+		}
+	}
+	return errs
+}
+
+// Format a module path like `["root", "web"]` as `root.web`.
+func modulePathString(path []string) string {
+	return strings.Join(path, ".")
+}
+
+// Do The Conversion on the Terraform state file given the extra resource ID
+// information from EC2. Returns the new terraform state, the block devices
+// converted, to generate the configuration for the `.tf` source files from,
+// the block devices that were already converted, and the problems with the
+// instances that couldn't be converted, which are left as they were.
+func generateNewTFState(stateToModify *tf.State, instMap map[string]Instance, opts configOptions) (*tf.State, []BlockDevice, []BlockDevice, ValidationErrors, error) {
+	outState := stateToModify.DeepCopy()
+	existing := legacyExistingResources(stateToModify)
+
+	var newDevs, unchanged []BlockDevice
+	var errs ValidationErrors
+	for _, module := range outState.Modules {
+		moduleDevs, moduleUnchanged, moduleErrs := convertModule(module, instMap, existing, opts)
+		newDevs = append(newDevs, moduleDevs...)
+		unchanged = append(unchanged, moduleUnchanged...)
+		errs = append(errs, moduleErrs...)
+	}
+	if err := validateResourceNames(newDevs, opts.forEach); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	errs.sort()
+	return outState, newDevs, unchanged, errs, nil
+}
+
+// Do the conversion for the instances in a single module, adding the new
+// resources to that same module. Returns the block devices that were converted,
+// those already converted, and the problems with the instances that weren't.
+func convertModule(module *tf.ModuleState, instMap map[string]Instance, existing *existingResources, opts configOptions) ([]BlockDevice, []BlockDevice, ValidationErrors) {
+	var newDevs, unchanged []BlockDevice
+	var errs ValidationErrors
+	newResources := make(map[string]*tf.ResourceState)
+
+	// The instances with devices to convert, which are only changed once
+	// the devices' `count` groups are known.
+	var converted []*tf.ResourceState
+	var instDevs [][]BlockDevice
+
+	for name, res := range module.Resources {
+		if res.Type != "aws_instance" {
+			// Do nothing if the resource isn't an instance.
+			continue
+		}
+		inst, ok := instMap[res.Primary.ID]
+		if !ok {
+			// Do nothing if the instance wasn't one of the ones that the EC2
+			// query returned.
+			continue
+		}
+
+		instanceAddr := legacyAddress(module.Path, name)
+		// An instance without `ebs_block_device`s at all has none to convert.
+		var interfaceDevices []interface{}
+		if rawDevices := flatmap.Expand(res.Primary.Attributes, "ebs_block_device"); rawDevices != nil {
+			if interfaceDevices, ok = rawDevices.([]interface{}); !ok {
+				errs = append(errs, &ValidationError{Instance: instanceAddr, Problem: "Could not expand its ebs_block_devices"})
+				continue
+			}
+		}
+
+		devices, ok := mapify(interfaceDevices)
+		if !ok {
+			errs = append(errs, &ValidationError{Instance: instanceAddr, Problem: "Could not mapify its ebs_block_devices"})
+			continue
+		}
+
+		instanceResName, err := ParseTerraformName(name)
+		if err != nil {
+			errs = append(errs, &ValidationError{Instance: instanceAddr, Problem: err.Error()})
+			continue
+		}
+
+		devs, instUnchanged, instErrs := convertInstance(instanceResName, module.Path, devices, res.Primary.Attributes["availability_zone"], inst, existing, opts)
+		if len(instErrs) != 0 {
+			errs = append(errs, instErrs...)
+			continue
+		}
+		unchanged = append(unchanged, instUnchanged...)
+		if len(devs) == 0 {
+			// Leave the instance alone if it's already converted.
+			continue
+		}
+		converted = append(converted, res)
+		instDevs = append(instDevs, devs)
+	}
+
+	splitCountGroups(instDevs, opts)
+	for i, res := range converted {
+		if instErrs := checkUngroupedAddresses(instDevs[i], existing, opts); len(instErrs) != 0 {
+			errs = append(errs, instErrs...)
+			continue
+		}
+
+		removeLegacyBlockDevices(res.Primary.Attributes, instDevs[i])
+
+		for _, dev := range instDevs[i] {
+			volumeRes := dev.makeVolumeRes()
+			attachmentRes := dev.makeAttachmentRes()
+
+			newResources[dev.VolumeName()] = volumeRes
+			newResources[dev.VolumeAttachmentName()] = attachmentRes
+
+			newDevs = append(newDevs, dev)
+		}
+	}
+
+	for k, v := range newResources {
+		module.Resources[k] = v
+	}
+
+	return newDevs, unchanged, errs
+}
+
+// The config for the converted devices, worked out before anything is
+// written so that a problem with it leaves the state alone too.
+type newConfig struct {
+	// The files of `configDir` rewritten in place.
+	rewritten []rewrittenFile
+	// The config for what couldn't be placed there, if anything, for
+	// `configOutPath`.
+	config        string
+	configOutPath string
+}
+
+// Make the config for the converted devices: in place in `configDir` if it's
+// given, and whatever can't be placed there for `configOutPath`.
+func makeNewConfig(configOutPath string, configDir string, newDevs []BlockDevice, opts configOptions) (*newConfig, error) {
+	nc := &newConfig{}
+	if configDir != "" {
+		var err error
+		newDevs, nc.rewritten, err = rewriteConfigDir(configDir, newDevs, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(newDevs) == 0 {
+			return nc, nil
+		}
+	}
+	var err error
+	if nc.config, err = genConfig(newDevs, opts); err != nil {
+		return nil, err
+	}
+	nc.configOutPath = configOutPath
+	return nc, nil
+}
+
+// Write the config out. Returns the files rewritten, and whether
+// `configOutPath` was written.
+func (nc *newConfig) write() ([]string, bool, error) {
+	var rewritten []string
+	for _, f := range nc.rewritten {
+		if err := f.write(); err != nil {
+			return nil, false, err
+		}
+		rewritten = append(rewritten, f.path)
+	}
+	if nc.configOutPath == "" {
+		return rewritten, false, nil
+	}
+	if err := writeConfig(nc.configOutPath, nc.config); err != nil {
+		return nil, false, err
+	}
+	return rewritten, true, nil
+}
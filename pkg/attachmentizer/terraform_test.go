@@ -0,0 +1,963 @@
+package attachmentizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/config/module"
+	"github.com/hashicorp/terraform/helper/schema"
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+func TestMakeVolumeRes(t *testing.T) {
+	var testCases = []struct {
+		in  BlockDevice
+		out tf.ResourceState
+	}{
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			tf.ResourceState{
+				Type: "aws_ebs_volume",
+				Primary: &tf.InstanceState{
+					ID: "v-abcd",
+					Attributes: map[string]string{
+						"size":              "10",
+						"type":              "gp2",
+						"id":                "v-abcd",
+						"encrypted":         "false",
+						"availability_zone": "us-east-1",
+						"snapshot_id":       "",
+						"iops":              "1500",
+					},
+				},
+			},
+		},
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "true",
+				snapshotId:          "snap-1234",
+				kmsKeyID:            "arn:aws:kms:us-east-1:123456789012:key/abcd",
+				tags:                map[string]string{"Name": "web-data"},
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			tf.ResourceState{
+				Type: "aws_ebs_volume",
+				Primary: &tf.InstanceState{
+					ID: "v-abcd",
+					Attributes: map[string]string{
+						"size":              "10",
+						"type":              "gp2",
+						"id":                "v-abcd",
+						"encrypted":         "true",
+						"availability_zone": "us-east-1",
+						"snapshot_id":       "snap-1234",
+						"kms_key_id":        "arn:aws:kms:us-east-1:123456789012:key/abcd",
+						"tags.%":            "1",
+						"tags.Name":         "web-data",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		actual := tt.in.makeVolumeRes()
+		if !actual.Equal(&tt.out) {
+			actual, _ := json.MarshalIndent(actual, "", "  ")
+			expected, _ := json.MarshalIndent(tt.out, "", "  ")
+			t.Errorf("Expected: %+v\nGot: %+v", string(expected), string(actual))
+		}
+	}
+}
+
+func TestMakeAttachmentRes(t *testing.T) {
+	var testCases = []struct {
+		in  BlockDevice
+		out tf.ResourceState
+	}{
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			tf.ResourceState{
+				Type: "aws_volume_attachment",
+				Primary: &tf.InstanceState{
+					ID: "vai-3194341925",
+					Attributes: map[string]string{
+						"device_name": "/dev/xvdb",
+						"instance_id": "i-1d7683bd",
+						"volume_id":   "v-abcd",
+						"id":          "vai-3194341925",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		actual := tt.in.makeAttachmentRes()
+		if !actual.Equal(&tt.out) {
+			actual, _ := json.MarshalIndent(actual, "", "  ")
+			expected, _ := json.MarshalIndent(tt.out, "", "  ")
+			t.Errorf("Expected: %+v\nGot: %+v", string(expected), string(actual))
+		}
+	}
+}
+
+func TestVolumeMismatches(t *testing.T) {
+	fromTF := BlockDevice{
+		size:       10,
+		volumeType: "gp2",
+		encrypted:  "false",
+		iops:       0,
+		snapshotId: "",
+	}
+	fromEC2 := BlockDevice{
+		size:       20,
+		volumeType: "gp2",
+		encrypted:  "true",
+		iops:       100,
+		snapshotId: "snap-1234",
+	}
+
+	expected := []fieldMismatch{
+		{"volume_size", "10", "20"},
+		{"encrypted", "false", "true"},
+	}
+	if actual := volumeMismatches(fromTF, fromEC2); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, actual)
+	}
+
+	// Without volume info from EC2 there's nothing to compare.
+	if actual := volumeMismatches(fromTF, BlockDevice{}); actual != nil {
+		t.Errorf("Expected no mismatches without volume info, got %+v", actual)
+	}
+}
+
+func TestBlockDeviceCrossValidation(t *testing.T) {
+	var testCases = []struct {
+		fromEC2 BlockDevice
+		fromTF  BlockDevice
+		out     bool
+	}{
+		{
+			BlockDevice{
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+			},
+			BlockDevice{
+				volumeID:            "v-abcd",
+				deviceName:          NewDeviceName("xvdb"),
+				deleteOnTermination: "false",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			true,
+		},
+		{
+			BlockDevice{
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+			},
+			BlockDevice{
+				volumeID:            "v-abcd",
+				deviceName:          NewDeviceName("/dev/xvdb"),
+				deleteOnTermination: "false",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			true,
+		},
+		{
+			BlockDevice{
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+			},
+			BlockDevice{
+				volumeID:            "v-abcd",
+				deviceName:          NewDeviceName("/dev/xvdb1"),
+				deleteOnTermination: "false",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			false,
+		},
+		{
+			BlockDevice{
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+			},
+			BlockDevice{
+				volumeID:            "v-abcd",
+				deviceName:          NewDeviceName("/dev/xvdb"),
+				deleteOnTermination: "true",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			false,
+		},
+	}
+	for _, tt := range testCases {
+		actual := validateEC2andTFDevs(tt.fromTF, tt.fromEC2)
+		if !(actual == tt.out) {
+			t.Errorf("Expected cross validation %t, got %t", tt.out, actual)
+		}
+	}
+}
+
+func TestBlockDeviceValidation(t *testing.T) {
+	var testCases = []struct {
+		in  BlockDevice
+		out bool
+	}{
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			true,
+		},
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName(""),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			false,
+		},
+		{
+			BlockDevice{
+				volumeID:            "",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			false,
+		},
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "",
+			},
+			false,
+		},
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			true,
+		},
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                0,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "i-1d7683bd",
+				availabilityZone:    "us-east-1",
+			},
+			false,
+		},
+		{
+			BlockDevice{
+				volumeID:            "v-abcd",
+				size:                10,
+				volumeType:          "gp2",
+				deleteOnTermination: "false",
+				deviceName:          NewDeviceName("xvdb"),
+				encrypted:           "false",
+				iops:                1500,
+				snapshotId:          "",
+				instanceID:          "",
+				availabilityZone:    "us-east-1",
+			},
+			false,
+		},
+	}
+
+	for i, tt := range testCases {
+		actual := validateBlockDev(tt.in)
+		if !(actual == tt.out) {
+			t.Errorf("[%d] Expected validation %t, got %t", i, tt.out, actual)
+		}
+	}
+}
+
+func TestParseTerraformName(t *testing.T) {
+	var testCases = []struct {
+		in  string
+		out *TerraformName
+	}{
+		{
+			"aws_instance.abc",
+			&TerraformName{
+				resourceType: "aws_instance",
+				name:         "abc",
+				index:        -1,
+			},
+		},
+		{
+			"aws_instance.abc.7",
+			&TerraformName{
+				resourceType: "aws_instance",
+				name:         "abc",
+				index:        7,
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		actual, err := ParseTerraformName(tt.in)
+		if err != nil && tt.out != nil {
+			t.Errorf("Unexptected failure on %v: %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(*actual, *tt.out) {
+			t.Errorf("Expected %+v, got %+v", tt.out, actual)
+		}
+	}
+}
+
+func TestGenerateNewTFStateModules(t *testing.T) {
+	instanceAttrs := map[string]string{
+		"id":                 "i-1d7683bd",
+		"ebs_block_device.#": "1",
+		"ebs_block_device.2576023345.delete_on_termination": "false",
+		"ebs_block_device.2576023345.device_name":           "/dev/xvdb",
+		"ebs_block_device.2576023345.encrypted":             "false",
+		"ebs_block_device.2576023345.iops":                  "300",
+		"ebs_block_device.2576023345.snapshot_id":           "",
+		"ebs_block_device.2576023345.volume_size":           "100",
+		"ebs_block_device.2576023345.volume_type":           "gp2",
+	}
+	state := &tf.State{
+		Modules: []*tf.ModuleState{
+			{
+				Path:      []string{"root"},
+				Resources: map[string]*tf.ResourceState{},
+			},
+			{
+				Path: []string{"root", "web"},
+				Resources: map[string]*tf.ResourceState{
+					"aws_instance.web": {
+						Type: "aws_instance",
+						Primary: &tf.InstanceState{
+							ID:         "i-1d7683bd",
+							Attributes: instanceAttrs,
+						},
+					},
+				},
+			},
+		},
+	}
+	instMap := map[string]Instance{
+		"i-1d7683bd": {
+			ID: "i-1d7683bd",
+			BlockDevices: map[DeviceName]BlockDevice{
+				NewDeviceName("xvdb"): {
+					volumeID:            "v-abcd",
+					deviceName:          NewDeviceName("xvdb"),
+					deleteOnTermination: "false",
+					instanceID:          "i-1d7683bd",
+					availabilityZone:    "us-east-1a",
+				},
+			},
+		},
+	}
+
+	newState, newDevs, _, _, err := generateNewTFState(state, instMap, configOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := mustGenConfig(t, newDevs, configOptions{})
+
+	if len(newState.Modules[0].Resources) != 0 {
+		t.Errorf("Expected no new resources in the root module, got %v", newState.Modules[0].Resources)
+	}
+	web := newState.Modules[1].Resources
+	for _, name := range []string{"aws_ebs_volume.web-xvdb", "aws_volume_attachment.web-xvdb"} {
+		if _, ok := web[name]; !ok {
+			t.Errorf("Expected %v in module root.web", name)
+		}
+	}
+	if n := web["aws_instance.web"].Primary.Attributes["ebs_block_device.#"]; n != "0" {
+		t.Errorf("Expected ebs_block_device to be emptied on aws_instance.web, got %v devices", n)
+	}
+	if !strings.HasPrefix(config, "# Module: root.web\n") {
+		t.Errorf("Expected config to be grouped under root.web, got:\n%v", config)
+	}
+}
+
+func TestGenerateRevertedTFState(t *testing.T) {
+	state := &tf.State{
+		Modules: []*tf.ModuleState{
+			{
+				Path: []string{"root"},
+				Resources: map[string]*tf.ResourceState{
+					"aws_instance.web": {
+						Type: "aws_instance",
+						Primary: &tf.InstanceState{
+							ID:         "i-1d7683bd",
+							Attributes: map[string]string{"id": "i-1d7683bd"},
+						},
+					},
+					"aws_ebs_volume.web-xvdb": {
+						Type: "aws_ebs_volume",
+						Primary: &tf.InstanceState{
+							ID: "v-abcd",
+							Attributes: map[string]string{
+								"id":                "v-abcd",
+								"size":              "100",
+								"type":              "gp2",
+								"encrypted":         "false",
+								"availability_zone": "us-east-1a",
+								"snapshot_id":       "",
+							},
+						},
+					},
+					"aws_volume_attachment.web-xvdb": {
+						Type: "aws_volume_attachment",
+						Primary: &tf.InstanceState{
+							ID: "vai-3194341925",
+							Attributes: map[string]string{
+								"id":          "vai-3194341925",
+								"device_name": "/dev/xvdb",
+								"instance_id": "i-1d7683bd",
+								"volume_id":   "v-abcd",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	newState, config, err := generateRevertedTFState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resources := newState.Modules[0].Resources
+	if len(resources) != 1 {
+		t.Errorf("Expected only aws_instance.web to be left, got %v", resources)
+	}
+	expected := map[string]string{
+		"id":                 "i-1d7683bd",
+		"ebs_block_device.#": "1",
+		"ebs_block_device.3905984573.delete_on_termination": "false",
+		"ebs_block_device.3905984573.device_name":           "/dev/xvdb",
+		"ebs_block_device.3905984573.encrypted":             "false",
+		"ebs_block_device.3905984573.iops":                  "0",
+		"ebs_block_device.3905984573.snapshot_id":           "",
+		"ebs_block_device.3905984573.volume_size":           "100",
+		"ebs_block_device.3905984573.volume_type":           "gp2",
+	}
+	actual := resources["aws_instance.web"].Primary.Attributes
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if !strings.Contains(config, "resource \"aws_instance\" \"web\" {\n  ebs_block_device {\n    delete_on_termination = false\n") {
+		t.Errorf("Expected an ebs_block_device block for aws_instance.web, got:\n%v", config)
+	}
+}
+
+func TestDiffStates(t *testing.T) {
+	state := &tf.State{
+		Modules: []*tf.ModuleState{
+			{
+				Path: []string{"root"},
+				Resources: map[string]*tf.ResourceState{
+					"aws_instance.web.0": {
+						Type: "aws_instance",
+						Primary: &tf.InstanceState{
+							ID: "i-1d7683bd",
+							Attributes: map[string]string{
+								"id":                 "i-1d7683bd",
+								"ebs_block_device.#": "1",
+								"ebs_block_device.3905984573.device_name": "/dev/xvdb",
+								"ebs_block_device.3905984573.iops":        "300",
+								"ebs_block_device.3905984573.volume_size": "100",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	instMap := map[string]Instance{
+		"i-1d7683bd": {
+			ID: "i-1d7683bd",
+			BlockDevices: map[DeviceName]BlockDevice{
+				NewDeviceName("xvdb"): {
+					volumeID:            "v-abcd",
+					deviceName:          NewDeviceName("xvdb"),
+					deleteOnTermination: "",
+					instanceID:          "i-1d7683bd",
+					availabilityZone:    "us-east-1a",
+				},
+			},
+		},
+	}
+
+	newState, _, _, _, err := generateNewTFState(state, instMap, configOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := diffStates(legacyFlatResources(state), legacyFlatResources(newState))
+
+	if len(plan.Instances) != 1 {
+		t.Fatalf("Expected 1 instance in the plan, got %d", len(plan.Instances))
+	}
+	inst := plan.Instances[0]
+	if inst.Address != "aws_instance.web[0]" {
+		t.Errorf("Expected aws_instance.web[0], got %v", inst.Address)
+	}
+	expectedKeys := []string{
+		"ebs_block_device.3905984573.device_name",
+		"ebs_block_device.3905984573.iops",
+		"ebs_block_device.3905984573.volume_size",
+	}
+	if !reflect.DeepEqual(inst.RemovedKeys, expectedKeys) {
+		t.Errorf("Expected removed keys %v, got %v", expectedKeys, inst.RemovedKeys)
+	}
+	var added []string
+	for _, res := range inst.AddedResources {
+		added = append(added, res.Address)
+	}
+	expectedAdded := []string{"aws_ebs_volume.web-xvdb-0", "aws_volume_attachment.web-xvdb-0"}
+	if !reflect.DeepEqual(added, expectedAdded) {
+		t.Errorf("Expected added resources %v, got %v", expectedAdded, added)
+	}
+}
+
+func TestDeviceAliasRule(t *testing.T) {
+	var testCases = []struct {
+		a, b string
+		rule string
+		ok   bool
+	}{
+		{"/dev/xvdf", "xvdf", "", true},
+		{"/dev/sdf", "/dev/xvdf", "sd/xvd", true},
+		{"/dev/sda1", "/dev/sda", "partition", true},
+		{"/dev/sda1", "/dev/xvda", "sd/xvd and partition", true},
+		{"/dev/xvdf", "/dev/sdg", "", false},
+		{"/dev/sda1", "/dev/xvda2", "", false},
+		{"/dev/sdf", "/dev/nvme1n1", "", false},
+		{"/dev/nvme1n1", "/dev/nvme1n1", "", true},
+	}
+
+	for _, tt := range testCases {
+		rule, ok := deviceAliasRule(NewDeviceName(tt.a), NewDeviceName(tt.b))
+		if rule != tt.rule || ok != tt.ok {
+			t.Errorf("Expected %v and %v to match by %q (%v), got %q (%v)", tt.a, tt.b, tt.rule, tt.ok, rule, ok)
+		}
+	}
+}
+
+func TestMatchEC2Devices(t *testing.T) {
+	inst := Instance{
+		ID: "i-1d7683bd",
+		BlockDevices: map[DeviceName]BlockDevice{
+			NewDeviceName("xvda"): NewBlockDevice("i-1d7683bd", "us-east-1a", "/dev/xvda", "v-root", true),
+			NewDeviceName("xvdf"): NewBlockDevice("i-1d7683bd", "us-east-1a", "/dev/xvdf", "v-f", false),
+			NewDeviceName("sdg"):  NewBlockDevice("i-1d7683bd", "us-east-1a", "/dev/sdg", "v-g", false),
+			NewDeviceName("xvdh"): NewBlockDevice("i-1d7683bd", "us-east-1a", "/dev/xvdh", "v-h", false),
+			NewDeviceName("sdh"):  NewBlockDevice("i-1d7683bd", "us-east-1a", "/dev/sdh", "v-h2", false),
+		},
+	}
+	devMap := map[DeviceName]BlockDevice{
+		NewDeviceName("sda1"): {deviceName: NewDeviceName("sda1")},
+		NewDeviceName("sdf"):  {deviceName: NewDeviceName("sdf")},
+		// The state's volume ID decides, whatever the name.
+		NewDeviceName("nvme1n1"): {deviceName: NewDeviceName("nvme1n1"), volumeID: "v-g"},
+		NewDeviceName("nvme2n1"): {deviceName: NewDeviceName("nvme2n1")},
+		// Either of two could be it.
+		NewDeviceName("xvdh1"): {deviceName: NewDeviceName("xvdh1")},
+		NewDeviceName("sdz"):   {deviceName: NewDeviceName("sdz")},
+	}
+	var devNames []DeviceName
+	for devName := range devMap {
+		devNames = append(devNames, devName)
+	}
+
+	matches, problems := matchEC2Devices(devMap, devNames, inst)
+	expectedMatches := map[string][2]string{
+		"sda1":    {"v-root", "sd/xvd and partition"},
+		"sdf":     {"v-f", "sd/xvd"},
+		"nvme1n1": {"v-g", "volume ID"},
+	}
+	for name, expected := range expectedMatches {
+		m, ok := matches[NewDeviceName(name)]
+		if !ok || m.dev.volumeID != expected[0] || m.aliasRule != expected[1] {
+			t.Errorf("Expected %v to match %v by %q, got %+v (%v)", name, expected[0], expected[1], m, ok)
+		}
+	}
+	if len(matches) != len(expectedMatches) {
+		t.Errorf("Expected %d matches, got %v", len(expectedMatches), matches)
+	}
+
+	expectedProblems := map[string]string{
+		"nvme2n1": "is an NVMe device name",
+		"xvdh1":   "could be any of /dev/sdh, /dev/xvdh in EC2",
+		"sdz":     "is not attached in EC2",
+	}
+	for name, expected := range expectedProblems {
+		if problem := problems[NewDeviceName(name)]; !strings.Contains(problem, expected) {
+			t.Errorf("Expected a problem with %q for %v, got %q", expected, name, problem)
+		}
+	}
+}
+
+// The schema of the `aws_instance`s in `testPlanConfig`, which is only what
+// the tests set on them.
+var testInstanceSchema = map[string]*schema.Schema{
+	"ami":               {Type: schema.TypeString, Required: true, ForceNew: true},
+	"instance_type":     {Type: schema.TypeString, Required: true},
+	"availability_zone": {Type: schema.TypeString, Optional: true, Computed: true, ForceNew: true},
+}
+
+// Plan a config with Terraform 0.9 against a state, as `terraform plan
+// -refresh=false` would, with providers that have the vendored AWS
+// provider's schemas and do nothing.
+func testPlan(t *testing.T, config string, state *tf.State) *tf.Plan {
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := module.NewTreeModule("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Load(nil, module.GetModeNone); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := func(s map[string]*schema.Schema) *schema.Resource {
+		noop := func(*schema.ResourceData, interface{}) error { return nil }
+		return &schema.Resource{Schema: s, Create: noop, Read: noop, Update: noop, Delete: noop}
+	}
+	provider := &schema.Provider{ResourcesMap: map[string]*schema.Resource{
+		"aws_instance":          resource(testInstanceSchema),
+		"aws_ebs_volume":        resource(providerSchema(t, "resource_aws_ebs_volume.go", "resourceAwsEbsVolume", "").Schema),
+		"aws_volume_attachment": resource(providerSchema(t, "resource_aws_volume_attachment.go", "resourceAwsVolumeAttachment", "").Schema),
+	}}
+	ctx, err := tf.NewContext(&tf.ContextOpts{
+		Module: tree,
+		State:  state,
+		Providers: map[string]tf.ResourceProviderFactory{
+			"aws": tf.ResourceProviderFactoryFixed(provider),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ctx.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// Instances with a `count` whose devices can't share one: the volume of one
+// sets `iops` and a tag the other's doesn't, which 0.9-era syntax can only set
+// to their zero values, and only some of the instances have an xvdc. Their
+// devices get resources of their own, so that Terraform plans no change.
+func TestGenerateNewTFStateSplitsCountGroups(t *testing.T) {
+	instanceAttrs := func(id string, devs ...string) map[string]string {
+		attrs := map[string]string{
+			"id":                 id,
+			"ami":                "ami-1234",
+			"instance_type":      "m4.large",
+			"availability_zone":  "us-east-1a",
+			"ebs_block_device.#": strconv.Itoa(len(devs)),
+		}
+		for i, name := range devs {
+			prefix := fmt.Sprintf("ebs_block_device.%d.", i)
+			attrs[prefix+"delete_on_termination"] = "false"
+			attrs[prefix+"device_name"] = "/dev/" + name
+			attrs[prefix+"encrypted"] = "false"
+			attrs[prefix+"iops"] = "300"
+			attrs[prefix+"snapshot_id"] = ""
+			attrs[prefix+"volume_size"] = "100"
+			attrs[prefix+"volume_type"] = "gp2"
+		}
+		return attrs
+	}
+	state := &tf.State{
+		Version: tf.StateVersion,
+		Modules: []*tf.ModuleState{{
+			Path: []string{"root"},
+			Resources: map[string]*tf.ResourceState{
+				"aws_instance.web.0": {Type: "aws_instance", Primary: &tf.InstanceState{ID: "i-0", Attributes: instanceAttrs("i-0", "xvdb")}},
+				"aws_instance.web.1": {Type: "aws_instance", Primary: &tf.InstanceState{ID: "i-1", Attributes: instanceAttrs("i-1", "xvdb", "xvdc")}},
+				"aws_instance.web.2": {Type: "aws_instance", Primary: &tf.InstanceState{ID: "i-2", Attributes: instanceAttrs("i-2", "xvdb", "xvdc")}},
+			},
+		}},
+	}
+	ec2Dev := func(instanceID string, name string, volumeType string, iops int, tags map[string]string) BlockDevice {
+		return BlockDevice{
+			volumeID:            "vol-" + instanceID + "-" + name,
+			deviceName:          NewDeviceName(name),
+			deleteOnTermination: "false",
+			encrypted:           "false",
+			size:                100,
+			volumeType:          volumeType,
+			iops:                iops,
+			tags:                tags,
+			instanceID:          instanceID,
+			availabilityZone:    "us-east-1a",
+		}
+	}
+	instMap := map[string]Instance{
+		"i-0": {ID: "i-0", BlockDevices: map[DeviceName]BlockDevice{
+			NewDeviceName("xvdb"): ec2Dev("i-0", "xvdb", "io1", 1000, map[string]string{"Owner": "ops"}),
+		}},
+		"i-1": {ID: "i-1", BlockDevices: map[DeviceName]BlockDevice{
+			NewDeviceName("xvdb"): ec2Dev("i-1", "xvdb", "gp2", 300, nil),
+			NewDeviceName("xvdc"): ec2Dev("i-1", "xvdc", "gp2", 300, nil),
+		}},
+		"i-2": {ID: "i-2", BlockDevices: map[DeviceName]BlockDevice{
+			NewDeviceName("xvdb"): ec2Dev("i-2", "xvdb", "gp2", 300, nil),
+			NewDeviceName("xvdc"): ec2Dev("i-2", "xvdc", "gp2", 300, nil),
+		}},
+	}
+
+	var warns warnings
+	opts := configOptions{warnings: &warns}
+	newState, newDevs, _, errs, err := generateNewTFState(state, instMap, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	for _, name := range []string{
+		"aws_ebs_volume.web-xvdb-0", "aws_ebs_volume.web-xvdb-1", "aws_ebs_volume.web-xvdb-2",
+		"aws_volume_attachment.web-xvdc-1", "aws_volume_attachment.web-xvdc-2",
+	} {
+		if _, ok := newState.Modules[0].Resources[name]; !ok {
+			t.Errorf("Expected %v in the new state", name)
+		}
+	}
+	var splitWarnings int
+	for _, warning := range warns {
+		if strings.Contains(warning, "can't share a count") {
+			splitWarnings++
+		}
+	}
+	if splitWarnings != 2 {
+		t.Errorf("Expected a warning for each group split, got %q", warns)
+	}
+
+	config := mustGenConfig(t, newDevs, opts)
+	for _, expected := range []string{
+		`instance_id = "${aws_instance.web.1.id}"`,
+		`availability_zone = "${aws_instance.web.2.availability_zone}"`,
+	} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("Expected %v in:\n%v", expected, config)
+		}
+	}
+
+	config += `
+resource "aws_instance" "web" {
+  count         = 3
+  ami           = "ami-1234"
+  instance_type = "m4.large"
+}
+`
+	if plan := testPlan(t, config, newState); !plan.Diff.Empty() {
+		t.Errorf("Expected no changes planned, got:\n%v\nfor the config:\n%v", plan.Diff, config)
+	}
+}
+
+// A device only one instance of a `count` has gets no `count` of its own, and
+// refers to its instance by index, whichever index that is.
+func TestGenerateNewTFStateLoneCountMember(t *testing.T) {
+	instanceAttrs := func(id string, dev string) map[string]string {
+		return map[string]string{
+			"id":                 id,
+			"ami":                "ami-1234",
+			"instance_type":      "m4.large",
+			"availability_zone":  "us-east-1a",
+			"ebs_block_device.#": "1",
+			"ebs_block_device.0.delete_on_termination": "false",
+			"ebs_block_device.0.device_name":           dev,
+			"ebs_block_device.0.encrypted":             "false",
+			"ebs_block_device.0.iops":                  "300",
+			"ebs_block_device.0.snapshot_id":           "",
+			"ebs_block_device.0.volume_size":           "100",
+			"ebs_block_device.0.volume_type":           "gp2",
+		}
+	}
+	state := &tf.State{
+		Version: tf.StateVersion,
+		Modules: []*tf.ModuleState{{
+			Path: []string{"root"},
+			Resources: map[string]*tf.ResourceState{
+				"aws_instance.web.0": {Type: "aws_instance", Primary: &tf.InstanceState{ID: "i-0", Attributes: instanceAttrs("i-0", "/dev/xvdf")}},
+				"aws_instance.web.1": {Type: "aws_instance", Primary: &tf.InstanceState{ID: "i-1", Attributes: instanceAttrs("i-1", "/dev/sdf")}},
+			},
+		}},
+	}
+	instMap := make(map[string]Instance)
+	for id, name := range map[string]string{"i-0": "/dev/xvdf", "i-1": "/dev/sdf"} {
+		dev := NewBlockDevice(id, "us-east-1a", name, "vol-"+id, false)
+		dev.size, dev.volumeType, dev.iops, dev.encrypted = 100, "gp2", 300, "false"
+		instMap[id] = Instance{ID: id, BlockDevices: map[DeviceName]BlockDevice{dev.deviceName: dev}}
+	}
+
+	var warns warnings
+	opts := configOptions{warnings: &warns}
+	newState, newDevs, _, errs, err := generateNewTFState(state, instMap, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 || len(warns) != 0 {
+		t.Fatal(errs, warns)
+	}
+
+	config := mustGenConfig(t, newDevs, opts)
+	for _, expected := range []string{
+		`resource "aws_ebs_volume" "web-xvdf-0"`,
+		`instance_id = "${aws_instance.web.0.id}"`,
+		`resource "aws_ebs_volume" "web-sdf-1"`,
+		`instance_id = "${aws_instance.web.1.id}"`,
+	} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("Expected %v in:\n%v", expected, config)
+		}
+	}
+
+	config += `
+resource "aws_instance" "web" {
+  count         = 2
+  ami           = "ami-1234"
+  instance_type = "m4.large"
+}
+`
+	if plan := testPlan(t, config, newState); !plan.Diff.Empty() {
+		t.Errorf("Expected no changes planned, got:\n%v\nfor the config:\n%v", plan.Diff, config)
+	}
+}
+
+// Only the converted devices' `ebs_block_device`s are removed.
+func TestRemoveLegacyBlockDevices(t *testing.T) {
+	attrs := map[string]string{
+		"id":                 "i-1d7683bd",
+		"ebs_block_device.#": "2",
+		"ebs_block_device.2576023345.device_name": "/dev/xvdb",
+		"ebs_block_device.2576023345.volume_size": "100",
+		"ebs_block_device.3905984573.device_name": "/dev/sdc",
+		"ebs_block_device.3905984573.volume_size": "10",
+	}
+	removeLegacyBlockDevices(attrs, []BlockDevice{{deviceName: NewDeviceName("xvdb")}})
+
+	expected := map[string]string{
+		"id":                 "i-1d7683bd",
+		"ebs_block_device.#": "1",
+		"ebs_block_device.3905984573.device_name": "/dev/sdc",
+		"ebs_block_device.3905984573.volume_size": "10",
+	}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, attrs)
+	}
+}
@@ -0,0 +1,212 @@
+package attachmentizer
+
+// This file contains the vendored provider's schemas for the resources and
+// blocks we read and write, which the profiles in `profiles.go` build on, and
+// the translation of attributes between them.
+//
+// The provider package is vendored, but not buildable here since most of its
+// dependencies aren't, so the schemas are mirrored from
+//    vendor/github.com/hashicorp/terraform/builtin/providers/aws
+// and `TestSchemasMatchProvider` checks that they still match it. Only the
+// attribute names and types matter, so the rest of each `schema.Schema` is
+// left out other than `Required`.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// The `ebs_block_device` block of `resourceAwsInstance()`.
+var awsInstanceEbsBlockDeviceSchema = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"delete_on_termination": {Type: schema.TypeBool, Optional: true},
+		"device_name":           {Type: schema.TypeString, Required: true},
+		"encrypted":             {Type: schema.TypeBool, Optional: true},
+		"iops":                  {Type: schema.TypeInt, Optional: true},
+		"snapshot_id":           {Type: schema.TypeString, Optional: true},
+		"volume_size":           {Type: schema.TypeInt, Optional: true},
+		"volume_type":           {Type: schema.TypeString, Optional: true},
+	},
+}
+
+// `resourceAwsEbsVolume()`.
+var awsEbsVolumeSchema = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"availability_zone": {Type: schema.TypeString, Required: true},
+		"encrypted":         {Type: schema.TypeBool, Optional: true},
+		"iops":              {Type: schema.TypeInt, Optional: true},
+		"kms_key_id":        {Type: schema.TypeString, Optional: true},
+		"size":              {Type: schema.TypeInt, Optional: true},
+		"snapshot_id":       {Type: schema.TypeString, Optional: true},
+		"type":              {Type: schema.TypeString, Optional: true},
+		"tags":              {Type: schema.TypeMap, Optional: true},
+	},
+}
+
+// `resourceAwsVolumeAttachment()`.
+var awsVolumeAttachmentSchema = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		"device_name":  {Type: schema.TypeString, Required: true},
+		"instance_id":  {Type: schema.TypeString, Required: true},
+		"volume_id":    {Type: schema.TypeString, Required: true},
+		"force_detach": {Type: schema.TypeBool, Optional: true},
+		"skip_destroy": {Type: schema.TypeBool, Optional: true},
+	},
+}
+
+// The attributes of an `ebs_block_device` that have a different name on the
+// `aws_ebs_volume`. The others keep their name on whichever of the volume
+// and the attachment has them; `delete_on_termination` is on neither.
+var blockDeviceRenames = map[string]string{
+	"volume_size": "size",
+	"volume_type": "type",
+}
+
+// Translate the flatmapped attributes of an `ebs_block_device` to those of
+// the `aws_ebs_volume` and `aws_volume_attachment` made from it, by a
+// profile's schemas. Values that aren't of their type in the block's schema
+// are an error. Empty values are left out, as are attributes not in the
+// schema, which other versions of the provider have.
+func (p *providerProfile) translateBlockDevice(block map[string]string) (map[string]string, map[string]string, error) {
+	known := make(map[string]string)
+	for k, value := range block {
+		if _, ok := p.ebsBlockDevice.Schema[attrName(k)]; ok {
+			known[k] = value
+		}
+	}
+	if err := checkAttrs(p.ebsBlockDevice, "ebs_block_device", known); err != nil {
+		return nil, nil, err
+	}
+
+	volume := make(map[string]string)
+	attachment := make(map[string]string)
+	for k, value := range known {
+		if value == "" {
+			continue
+		}
+		attr, name := attrName(k), k
+		if renamed, ok := blockDeviceRenames[attr]; ok {
+			attr, name = renamed, renamed+strings.TrimPrefix(k, attr)
+		}
+		if _, ok := p.ebsVolume.Schema[attr]; ok {
+			volume[name] = value
+		}
+		if _, ok := p.volumeAttachment.Schema[attr]; ok {
+			attachment[name] = value
+		}
+	}
+	return volume, attachment, nil
+}
+
+// Get the attribute a flatmapped key is in, e.g. `tags` for `tags.Name`.
+func attrName(k string) string {
+	if i := strings.Index(k, "."); i != -1 {
+		return k[:i]
+	}
+	return k
+}
+
+// Check flatmapped attributes built for a resource, like those from
+// `makeVolumeAttrs`, against its schema in the profile.
+func (p *providerProfile) checkResourceAttrs(resourceType string, attrs map[string]string) error {
+	res, ok := p.resourceSchema(resourceType)
+	if !ok {
+		return fmt.Errorf("No schema for %v", resourceType)
+	}
+	return checkAttrs(res, resourceType, attrs)
+}
+
+// Check the attributes of the resources a device is converted to against
+// their schemas.
+func (dev *BlockDevice) checkAttrs() error {
+	if err := dev.profile().checkResourceAttrs("aws_ebs_volume", dev.makeVolumeAttrs()); err != nil {
+		return err
+	}
+	return dev.profile().checkResourceAttrs("aws_volume_attachment", dev.makeAttachmentAttrs())
+}
+
+// Check that each flatmapped attribute is in a schema and has a value of its
+// type, and that the required ones have values. `id` is in every schema. The
+// first problem found, in attribute order, is returned.
+func checkAttrs(res *schema.Resource, name string, attrs map[string]string) error {
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if k == "id" {
+			continue
+		}
+		attr := attrName(k)
+		key := strings.TrimPrefix(strings.TrimPrefix(k, attr), ".")
+		s, ok := res.Schema[attr]
+		if !ok {
+			return fmt.Errorf("%v isn't an attribute of %v", attr, name)
+		}
+
+		value := attrs[k]
+		if value == "" && key == "" {
+			if s.Required {
+				return fmt.Errorf("%v of %v is required", attr, name)
+			}
+			continue
+		}
+
+		// Maps are the only collections in the schemas, flatmapped as
+		// `tags.%` and `tags.<key>`.
+		valueType := s.Type
+		switch {
+		case key == "" && s.Type == schema.TypeMap:
+			return fmt.Errorf("%v of %v is a map, not a single value", attr, name)
+		case key != "" && s.Type != schema.TypeMap:
+			return fmt.Errorf("%v of %v is a %v, not a map", attr, name, typeName(s.Type))
+		case key == "%":
+			valueType = schema.TypeInt
+		case key != "":
+			valueType = schema.TypeString
+		}
+		if value != "" && !valueHasType(value, valueType) {
+			return fmt.Errorf("%v of %v is %q, which isn't a %v", k, name, value, typeName(valueType))
+		}
+	}
+	return nil
+}
+
+func valueHasType(value string, valueType schema.ValueType) bool {
+	switch valueType {
+	case schema.TypeInt:
+		_, err := strconv.Atoi(value)
+		return err == nil
+	case schema.TypeFloat:
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	case schema.TypeBool:
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// The name of a type as it's written in the config.
+func typeName(valueType schema.ValueType) string {
+	switch valueType {
+	case schema.TypeInt, schema.TypeFloat:
+		return "number"
+	default:
+		return strings.ToLower(strings.TrimPrefix(valueType.String(), "Type"))
+	}
+}
+
+// Version 4 state and the generated config have attributes with their schema
+// types rather than as strings. These are the non-string attributes of the
+// resources and blocks we create, in any profile.
+var numberAttrs = schemaAttrsOfType(schema.TypeInt)
+
+var boolAttrs = schemaAttrsOfType(schema.TypeBool)
@@ -0,0 +1,238 @@
+package attachmentizer
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const vendoredProviderDir = "../../vendor/github.com/hashicorp/terraform/builtin/providers/aws"
+
+// Get the value of the first `key: value` under a node, with `key` a string
+// literal or, if `ident` is set, an identifier.
+func findKeyValue(root ast.Node, key string, ident bool) ast.Expr {
+	var value ast.Expr
+	ast.Inspect(root, func(n ast.Node) bool {
+		if kv, ok := n.(*ast.KeyValueExpr); ok && value == nil {
+			switch k := kv.Key.(type) {
+			case *ast.Ident:
+				if ident && k.Name == key {
+					value = kv.Value
+				}
+			case *ast.BasicLit:
+				if !ident && k.Value == strconv.Quote(key) {
+					value = kv.Value
+				}
+			}
+		}
+		return value == nil
+	})
+	return value
+}
+
+// Read the attribute names, types and whether they're required, optional,
+// computed or force a new resource from the `Schema` of a resource in the
+// vendored provider, or of one of its blocks.
+func providerSchema(t *testing.T, file string, funcName string, block string) *schema.Resource {
+	f, err := parser.ParseFile(token.NewFileSet(), filepath.Join(vendoredProviderDir, file), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root ast.Node
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == funcName {
+			root = fn
+		}
+	}
+	if root != nil && block != "" {
+		root = findKeyValue(root, block, false)
+	}
+	if root == nil {
+		t.Fatalf("No %v %v in %v", funcName, block, file)
+	}
+	lit, ok := findKeyValue(root, "Schema", true).(*ast.CompositeLit)
+	if !ok {
+		t.Fatalf("No schema in %v %v", funcName, block)
+	}
+
+	valueTypes := make(map[string]schema.ValueType)
+	for vt := schema.TypeBool; vt <= schema.TypeSet; vt++ {
+		valueTypes[vt.String()] = vt
+	}
+	res := &schema.Resource{Schema: make(map[string]*schema.Schema)}
+	for _, elt := range lit.Elts {
+		kv := elt.(*ast.KeyValueExpr)
+		name, _ := strconv.Unquote(kv.Key.(*ast.BasicLit).Value)
+		s := &schema.Schema{}
+		switch v := kv.Value.(type) {
+		case *ast.CallExpr:
+			// `tagsSchema()`.
+			if fn, ok := v.Fun.(*ast.Ident); !ok || !strings.HasPrefix(fn.Name, "tagsSchema") {
+				t.Fatalf("Unexpected schema for %v in %v", name, funcName)
+			}
+			s.Type = schema.TypeMap
+			s.Optional = true
+		case *ast.CompositeLit:
+			if sel, ok := findKeyValue(v, "Type", true).(*ast.SelectorExpr); ok {
+				s.Type = valueTypes[sel.Sel.Name]
+			}
+			for key, flag := range map[string]*bool{"Required": &s.Required, "Optional": &s.Optional, "Computed": &s.Computed, "ForceNew": &s.ForceNew} {
+				if value, ok := findKeyValue(v, key, true).(*ast.Ident); ok {
+					*flag = value.Name == "true"
+				}
+			}
+		}
+		res.Schema[name] = s
+	}
+	return res
+}
+
+// Only the types and whether the attributes are required are mirrored.
+func schemaSummary(res *schema.Resource) map[string][2]interface{} {
+	summary := make(map[string][2]interface{})
+	for name, s := range res.Schema {
+		summary[name] = [2]interface{}{s.Type, s.Required}
+	}
+	return summary
+}
+
+func TestSchemasMatchProvider(t *testing.T) {
+	var testCases = []struct {
+		file     string
+		funcName string
+		block    string
+		mirrored *schema.Resource
+	}{
+		{"resource_aws_instance.go", "resourceAwsInstance", "ebs_block_device", awsInstanceEbsBlockDeviceSchema},
+		{"resource_aws_ebs_volume.go", "resourceAwsEbsVolume", "", awsEbsVolumeSchema},
+		{"resource_aws_volume_attachment.go", "resourceAwsVolumeAttachment", "", awsVolumeAttachmentSchema},
+	}
+
+	for _, tt := range testCases {
+		expected := schemaSummary(providerSchema(t, tt.file, tt.funcName, tt.block))
+		if actual := schemaSummary(tt.mirrored); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected the schema of %v %v to match the provider's:\n%v\ngot:\n%v", tt.funcName, tt.block, expected, actual)
+		}
+	}
+}
+
+func TestTranslateBlockDevice(t *testing.T) {
+	volume, attachment, err := providerProfiles["0.9"].translateBlockDevice(map[string]string{
+		"delete_on_termination": "false",
+		"device_name":           "/dev/xvdb",
+		"encrypted":             "false",
+		"iops":                  "",
+		"snapshot_id":           "",
+		"volume_size":           "100",
+		"volume_type":           "gp2",
+		// From a newer provider.
+		"throughput": "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedVolume := map[string]string{"encrypted": "false", "size": "100", "type": "gp2"}
+	if !reflect.DeepEqual(volume, expectedVolume) {
+		t.Errorf("Expected volume attributes %v, got %v", expectedVolume, volume)
+	}
+	expectedAttachment := map[string]string{"device_name": "/dev/xvdb"}
+	if !reflect.DeepEqual(attachment, expectedAttachment) {
+		t.Errorf("Expected attachment attributes %v, got %v", expectedAttachment, attachment)
+	}
+
+	_, _, err = providerProfiles["0.9"].translateBlockDevice(map[string]string{"device_name": "/dev/xvdb", "volume_size": "big"})
+	if err == nil || !strings.Contains(err.Error(), `volume_size of ebs_block_device is "big", which isn't a number`) {
+		t.Errorf("Expected an error for the size, got %v", err)
+	}
+}
+
+func TestCreateDeviceMapVolumeType(t *testing.T) {
+	devMap, err := createDeviceMap(&TerraformName{"aws_instance", "web", 0, ""}, []map[string]string{{
+		"delete_on_termination": "false",
+		"device_name":           "/dev/xvdb",
+		"volume_size":           "100",
+		"volume_type":           "io1",
+		"iops":                  "300",
+	}}, providerProfiles["0.9"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := devMap[NewDeviceName("xvdb")]
+	if dev.volumeType != "io1" || dev.size != 100 || dev.iops != 300 {
+		t.Errorf("Expected an io1 device of 100 GB with 300 iops, got %+v", dev)
+	}
+}
+
+func TestCheckResourceAttrs(t *testing.T) {
+	var testCases = []struct {
+		resourceType string
+		attrs        map[string]string
+		problem      string
+	}{
+		{
+			"aws_ebs_volume",
+			map[string]string{
+				"id": "v-abcd", "availability_zone": "us-east-1a", "size": "10", "type": "gp2",
+				"encrypted": "false", "snapshot_id": "", "tags.%": "1", "tags.Name": "web",
+			},
+			"",
+		},
+		{
+			"aws_ebs_volume",
+			map[string]string{"availability_zone": "us-east-1a", "volume_size": "10"},
+			"volume_size isn't an attribute of aws_ebs_volume",
+		},
+		{
+			"aws_ebs_volume",
+			map[string]string{"availability_zone": "us-east-1a", "iops": "fast"},
+			`iops of aws_ebs_volume is "fast", which isn't a number`,
+		},
+		{
+			"aws_ebs_volume",
+			map[string]string{"availability_zone": "us-east-1a", "encrypted": "yes"},
+			`encrypted of aws_ebs_volume is "yes", which isn't a bool`,
+		},
+		{
+			"aws_ebs_volume",
+			map[string]string{"availability_zone": "", "size": "10"},
+			"availability_zone of aws_ebs_volume is required",
+		},
+		{
+			"aws_ebs_volume",
+			map[string]string{"availability_zone": "us-east-1a", "tags": "Name"},
+			"tags of aws_ebs_volume is a map, not a single value",
+		},
+		{
+			"aws_ebs_volume",
+			map[string]string{"availability_zone": "us-east-1a", "size.%": "1"},
+			"size of aws_ebs_volume is a number, not a map",
+		},
+		{
+			"aws_volume_attachment",
+			map[string]string{"id": "vai-1", "device_name": "/dev/xvdb", "instance_id": "i-1", "volume_id": "v-1"},
+			"",
+		},
+		{
+			"aws_volume_attachment",
+			map[string]string{"device_name": "/dev/xvdb", "instance_id": "i-1", "volume_id": "v-1", "type": "gp2"},
+			"type isn't an attribute of aws_volume_attachment",
+		},
+	}
+
+	for i, tt := range testCases {
+		err := providerProfiles["0.9"].checkResourceAttrs(tt.resourceType, tt.attrs)
+		switch {
+		case tt.problem == "" && err != nil:
+			t.Errorf("[%d] Expected no problem, got %v", i, err)
+		case tt.problem != "" && (err == nil || err.Error() != tt.problem):
+			t.Errorf("[%d] Expected %q, got %v", i, tt.problem, err)
+		}
+	}
+}
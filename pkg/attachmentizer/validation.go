@@ -0,0 +1,142 @@
+package attachmentizer
+
+// This file handles reporting the problems found while converting instances,
+// so that they can all be fixed in one go rather than one run at a time.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A problem with an instance, or one of its devices, that stops it being
+// converted. `Field`, `TFValue` and `EC2Value` are set for a field that's
+// missing or differs between the state and EC2.
+type ValidationError struct {
+	// The address of the instance, e.g. `module.web.aws_instance.web[0]`.
+	Instance string `json:"instance"`
+	Device   string `json:"device,omitempty"`
+	Field    string `json:"field,omitempty"`
+	TFValue  string `json:"tf_value,omitempty"`
+	EC2Value string `json:"ec2_value,omitempty"`
+	Problem  string `json:"problem"`
+}
+
+func (e *ValidationError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString(e.Instance)
+	if e.Device != "" {
+		buf.WriteString(" " + e.Device)
+	}
+	buf.WriteString(": ")
+	if e.Field != "" {
+		buf.WriteString(e.Field + " ")
+	}
+	buf.WriteString(e.Problem)
+	if e.TFValue != "" || e.EC2Value != "" {
+		buf.WriteString(fmt.Sprintf(" (%q in the state, %q in EC2)", e.TFValue, e.EC2Value))
+	}
+	return buf.String()
+}
+
+// All the problems found in a conversion.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%d problems found in %d instances:", len(errs), len(errs.Instances())))
+	for _, err := range errs {
+		buf.WriteString("\n  " + err.Error())
+	}
+	return buf.String()
+}
+
+// Get the addresses of the instances with problems, sorted.
+func (errs ValidationErrors) Instances() []string {
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, err := range errs {
+		if !seen[err.Instance] {
+			seen[err.Instance] = true
+			addrs = append(addrs, err.Instance)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (errs ValidationErrors) sort() {
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Instance != errs[j].Instance {
+			return errs[i].Instance < errs[j].Instance
+		}
+		return errs[i].Device < errs[j].Device
+	})
+}
+
+// Get the address of the resource an instance address is for, without its
+// index or key.
+func resourceOfInstance(instanceAddr string) string {
+	if i := strings.IndexByte(instanceAddr, '['); i != -1 {
+		return instanceAddr[:i]
+	}
+	return instanceAddr
+}
+
+// Find the converted devices of instances whose resource also has instances
+// with problems. Returns the instances without those, to convert again, and
+// problems saying why they were skipped. If there are none, nothing needs
+// converting again.
+func skipInvalidGroups(instMap map[string]Instance, newDevs []BlockDevice, errs ValidationErrors) (map[string]Instance, ValidationErrors) {
+	invalid := make(map[string]bool)
+	for _, err := range errs {
+		invalid[resourceOfInstance(err.Instance)] = true
+	}
+
+	skipped := make(map[string]bool)
+	var siblingErrs ValidationErrors
+	for _, dev := range newDevs {
+		instanceAddr := dev.InstanceAddress()
+		if !invalid[resourceOfInstance(instanceAddr)] || skipped[dev.instanceID] {
+			continue
+		}
+		skipped[dev.instanceID] = true
+		siblingErrs = append(siblingErrs, &ValidationError{
+			Instance: instanceAddr,
+			Problem:  "shares its resources with instances that have problems",
+		})
+	}
+
+	remaining := make(map[string]Instance)
+	for id, inst := range instMap {
+		if !skipped[id] {
+			remaining[id] = inst
+		}
+	}
+	return remaining, siblingErrs
+}
+
+// The warnings about a conversion that don't stop it, collected for the caller
+// to show. Adding to a nil collector drops the warning.
+type warnings []string
+
+func (w *warnings) addf(format string, args ...interface{}) {
+	if w != nil {
+		*w = append(*w, fmt.Sprintf(format, args...))
+	}
+}
+
+func (w *warnings) len() int {
+	if w == nil {
+		return 0
+	}
+	return len(*w)
+}
+
+// Drop the warnings added since there were `n`.
+func (w *warnings) truncate(n int) {
+	if w != nil {
+		*w = (*w)[:n]
+	}
+}
@@ -0,0 +1,123 @@
+package attachmentizer
+
+import (
+	"reflect"
+	"testing"
+
+	tf "github.com/hashicorp/terraform/terraform"
+)
+
+func TestGenerateNewTFStateValidationErrors(t *testing.T) {
+	instanceAttrs := func(id string) map[string]string {
+		return map[string]string{
+			"id":                 id,
+			"ebs_block_device.#": "2",
+			"ebs_block_device.2576023345.delete_on_termination": "false",
+			"ebs_block_device.2576023345.device_name":           "/dev/xvdb",
+			"ebs_block_device.2576023345.volume_size":           "100",
+			"ebs_block_device.2576023345.volume_type":           "gp2",
+			"ebs_block_device.1234567890.delete_on_termination": "false",
+			"ebs_block_device.1234567890.device_name":           "/dev/xvdc",
+			"ebs_block_device.1234567890.volume_size":           "10",
+			"ebs_block_device.1234567890.volume_type":           "gp2",
+		}
+	}
+	state := &tf.State{
+		Modules: []*tf.ModuleState{
+			{
+				Path: []string{"root"},
+				Resources: map[string]*tf.ResourceState{
+					"aws_instance.web.0": {
+						Type:    "aws_instance",
+						Primary: &tf.InstanceState{ID: "i-1d7683bd", Attributes: instanceAttrs("i-1d7683bd")},
+					},
+					"aws_instance.web.1": {
+						Type:    "aws_instance",
+						Primary: &tf.InstanceState{ID: "i-2e8794ce", Attributes: instanceAttrs("i-2e8794ce")},
+					},
+				},
+			},
+		},
+	}
+	ec2Dev := func(instanceID string, name string, deleteOnTermination string) BlockDevice {
+		return BlockDevice{
+			volumeID:            "v-" + name,
+			deviceName:          NewDeviceName(name),
+			deleteOnTermination: deleteOnTermination,
+			instanceID:          instanceID,
+			availabilityZone:    "us-east-1a",
+		}
+	}
+	instMap := map[string]Instance{
+		"i-1d7683bd": {
+			ID: "i-1d7683bd",
+			BlockDevices: map[DeviceName]BlockDevice{
+				NewDeviceName("xvdb"): ec2Dev("i-1d7683bd", "xvdb", "false"),
+				NewDeviceName("xvdc"): ec2Dev("i-1d7683bd", "xvdc", "false"),
+			},
+		},
+		// Both of this instance's devices have problems.
+		"i-2e8794ce": {
+			ID: "i-2e8794ce",
+			BlockDevices: map[DeviceName]BlockDevice{
+				NewDeviceName("xvdb"): ec2Dev("i-2e8794ce", "xvdb", "true"),
+			},
+		},
+	}
+
+	newState, newDevs, _, errs, err := generateNewTFState(state, instMap, configOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ValidationErrors{
+		{Instance: "aws_instance.web[1]", Device: "/dev/xvdb", Field: "delete_on_termination", TFValue: "false", EC2Value: "true", Problem: "differs between the state and EC2"},
+		{Instance: "aws_instance.web[1]", Device: "/dev/xvdc", Problem: "is not attached in EC2"},
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expected %v, got %v", expected, errs)
+	}
+
+	if len(newDevs) != 2 {
+		t.Errorf("Expected the 2 devices of aws_instance.web[0] to be converted, got %+v", newDevs)
+	}
+	resources := newState.Modules[0].Resources
+	if n := resources["aws_instance.web.0"].Primary.Attributes["ebs_block_device.#"]; n != "0" {
+		t.Errorf("Expected ebs_block_device to be emptied on aws_instance.web.0, got %v devices", n)
+	}
+	if _, ok := resources["aws_instance.web.1"].Primary.Attributes["ebs_block_device.#"]; !ok {
+		t.Errorf("Expected ebs_block_device to be left on aws_instance.web.1")
+	}
+	if _, ok := resources["aws_ebs_volume.web-xvdb.1"]; ok {
+		t.Errorf("Expected no volume for aws_instance.web.1")
+	}
+}
+
+func TestSkipInvalidGroups(t *testing.T) {
+	devs := testConfigDevs()
+	instMap := map[string]Instance{
+		"i-1d7683bd": {ID: "i-1d7683bd"},
+		"i-2e8794ce": {ID: "i-2e8794ce"},
+		"i-3f98a5df": {ID: "i-3f98a5df"},
+		"i-4fa9b6e0": {ID: "i-4fa9b6e0"},
+	}
+	errs := ValidationErrors{
+		{Instance: "aws_instance.web[2]", Device: "/dev/xvdb", Problem: "is not attached in EC2"},
+	}
+
+	remaining, siblingErrs := skipInvalidGroups(instMap, devs, errs)
+
+	expected := ValidationErrors{
+		{Instance: "aws_instance.web[0]", Problem: "shares its resources with instances that have problems"},
+		{Instance: "aws_instance.web[1]", Problem: "shares its resources with instances that have problems"},
+	}
+	if !reflect.DeepEqual(siblingErrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, siblingErrs)
+	}
+	if len(remaining) != 2 {
+		t.Errorf("Expected the db instance and the invalid one to remain, got %v", remaining)
+	}
+	if _, ok := remaining["i-3f98a5df"]; !ok {
+		t.Errorf("Expected the db instance to remain, got %v", remaining)
+	}
+}